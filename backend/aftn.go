@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"mini-amhs/config"
+)
+
+// AFTN framing. A telegram runs from the start-of-message line
+// (ZCZC, transmission identifier, time) to the end-of-message line NNNN.
+const (
+	aftnStart      = "ZCZC"
+	aftnEnd        = "NNNN"
+	aftnCheck      = "CH"
+	aftnLineEnd    = "\r\n"
+	aftnAddrOnLine = 7
+)
+
+// A transmission identifier: channel id and sequence number.
+var transmissionIDPattern = regexp.MustCompile(`^([A-Z]{3})([0-9]{3})$`)
+
+// telegram is one AFTN transmission. Check is set for channel checks,
+// which carry no addresses or text.
+type telegram struct {
+	Channel    string
+	Seq        int
+	Time       string
+	Check      bool
+	Priority   string
+	Addressees []string
+	FilingTime string
+	Originator string
+	Text       string
+}
+
+// TransmissionID is the channel id and sequence number, e.g. LON042.
+func (t telegram) TransmissionID() string {
+	return fmt.Sprintf("%s%03d", t.Channel, t.Seq)
+}
+
+// parseTelegram reads a telegram from the lines before its NNNN.
+func parseTelegram(lines []string) (telegram, error) {
+	var t telegram
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 {
+		return t, errors.New("empty telegram")
+	}
+	heading := strings.Fields(lines[0])
+	if len(heading) < 2 || heading[0] != aftnStart {
+		return t, errors.New("missing ZCZC heading")
+	}
+	m := transmissionIDPattern.FindStringSubmatch(heading[1])
+	if m == nil {
+		return t, fmt.Errorf("invalid transmission identifier %q", heading[1])
+	}
+	t.Channel = m[1]
+	t.Seq, _ = strconv.Atoi(m[2])
+	if len(heading) > 2 {
+		t.Time = heading[2]
+	}
+
+	var rest []string
+	for _, l := range lines[1:] {
+		if l = strings.TrimSpace(l); l != "" || len(rest) > 0 {
+			rest = append(rest, l)
+		}
+	}
+	for len(rest) > 0 && rest[len(rest)-1] == "" {
+		rest = rest[:len(rest)-1]
+	}
+	if len(rest) == 1 && rest[0] == aftnCheck {
+		t.Check = true
+		return t, nil
+	}
+
+	// Address lines: the priority, then addressees, continued on further
+	// lines until the origin line.
+	if len(rest) == 0 {
+		return t, errors.New("missing address line")
+	}
+	fields := strings.Fields(rest[0])
+	t.Priority = fields[0]
+	if !slices.Contains(messagePriorities, t.Priority) {
+		return t, fmt.Errorf("invalid priority indicator %q", t.Priority)
+	}
+	fields = fields[1:]
+	i := 1
+	for ; ; i++ {
+		for _, a := range fields {
+			if !originatorPattern.MatchString(a) {
+				return t, fmt.Errorf("invalid addressee %q", a)
+			}
+			t.Addressees = append(t.Addressees, a)
+		}
+		if i >= len(rest) {
+			return t, errors.New("missing origin line")
+		}
+		fields = strings.Fields(rest[i])
+		if len(fields) > 0 && filingTimePattern.MatchString(fields[0]) {
+			break
+		}
+	}
+	if len(t.Addressees) == 0 {
+		return t, errors.New("no addressees")
+	}
+	if len(fields) < 2 || !originatorPattern.MatchString(fields[1]) {
+		return t, errors.New("origin line must be the filing time and the originator")
+	}
+	t.FilingTime, t.Originator = fields[0], fields[1]
+	t.Text = strings.Join(rest[i+1:], "\n")
+	return t, nil
+}
+
+// format renders t for the wire, without the terminating NNNN line.
+func (t telegram) format() []string {
+	lines := []string{strings.TrimSpace(aftnStart + " " + t.TransmissionID() + " " + t.Time), ""}
+	if t.Check {
+		return append(lines, aftnCheck, "")
+	}
+	for i := 0; i < len(t.Addressees); i += aftnAddrOnLine {
+		line := strings.Join(t.Addressees[i:min(i+aftnAddrOnLine, len(t.Addressees))], " ")
+		if i == 0 {
+			line = t.Priority + " " + line
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, t.FilingTime+" "+t.Originator)
+	lines = append(lines, strings.Split(t.Text, "\n")...)
+	return append(lines, "")
+}
+
+// checkTelegramText refuses text that would break the framing.
+func checkTelegramText(text string) error {
+	if strings.Contains(text, aftnEnd) || strings.Contains(text, aftnStart) {
+		return errors.New("text contains an AFTN framing sequence (ZCZC or NNNN)")
+	}
+	return nil
+}
+
+// aftnTime formats t as DDHHMM in UTC.
+func aftnTime(t time.Time) string {
+	return t.UTC().Format("021504")
+}
+
+// aftnChannel is one end of an AFTN circuit. It numbers outgoing
+// transmissions, restarting at 001 each UTC day, and checks the numbering
+// of incoming ones.
+type aftnChannel struct {
+	id, remoteID string
+	conn         net.Conn
+	br           *bufio.Reader
+	// idle bounds the wait for the next line; timeout bounds a write.
+	idle, timeout time.Duration
+
+	mu    sync.Mutex
+	txSeq int
+	txDay int
+
+	rxSeq int
+	// gaps counts missing or repeated sequence numbers.
+	gaps int
+}
+
+func newAFTNChannel(conn net.Conn, id, remoteID string, idle, timeout time.Duration) *aftnChannel {
+	return &aftnChannel{id: id, remoteID: remoteID, conn: conn, br: bufio.NewReader(conn), idle: idle, timeout: timeout}
+}
+
+// send numbers t and writes it, returning it as sent.
+func (c *aftnChannel) send(t telegram) (telegram, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UTC()
+	if day := now.YearDay(); day != c.txDay {
+		c.txDay, c.txSeq = day, 0
+	}
+	c.txSeq = c.txSeq%999 + 1
+	t.Channel, t.Seq, t.Time = c.id, c.txSeq, aftnTime(now)
+
+	lines := append(t.format(), aftnEnd)
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write([]byte(strings.Join(lines, aftnLineEnd) + aftnLineEnd))
+	return t, err
+}
+
+// sendCheck sends a channel check.
+func (c *aftnChannel) sendCheck() error {
+	_, err := c.send(telegram{Check: true})
+	return err
+}
+
+// errBadTelegram wraps telegrams that could not be parsed; the circuit
+// stays up.
+var errBadTelegram = errors.New("bad telegram")
+
+// receive reads the next telegram. Sequence gaps are logged, not refused:
+// the telegram itself is still good.
+func (c *aftnChannel) receive() (telegram, error) {
+	var lines []string
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.idle))
+		line, err := c.br.ReadString('\n')
+		if err != nil {
+			return telegram{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == aftnEnd {
+			break
+		}
+		lines = append(lines, line)
+	}
+	t, err := parseTelegram(lines)
+	if err != nil {
+		return t, fmt.Errorf("%w: %v", errBadTelegram, err)
+	}
+	if t.Channel != c.remoteID {
+		return t, fmt.Errorf("%w: channel id %s, expected %s", errBadTelegram, t.Channel, c.remoteID)
+	}
+	if want := c.rxSeq%999 + 1; c.rxSeq != 0 && t.Seq != want && t.Seq != 1 {
+		c.gaps++
+		log.Printf("AFTN channel %s: expected sequence %03d, got %03d", c.remoteID, want, t.Seq)
+	}
+	c.rxSeq = t.Seq
+	return t, nil
+}
+
+// telegramSubject is the subject of a message made from a telegram: its
+// first line of text.
+func telegramSubject(t telegram) string {
+	subject, _, _ := strings.Cut(strings.TrimSpace(t.Text), "\n")
+	if subject = strings.TrimSpace(subject); subject == "" {
+		subject = "AFTN " + t.TransmissionID() + " from " + t.Originator
+	}
+	if len(subject) > appConfig.Limits.MaxSubjectLen {
+		subject = subject[:appConfig.Limits.MaxSubjectLen]
+	}
+	return subject
+}
+
+// telegramText is the text of the telegram sent for msg: the body, led by
+// the subject unless the body already starts with it.
+func telegramText(msg Message) string {
+	if strings.HasPrefix(msg.Body, msg.Subject) {
+		return msg.Body
+	}
+	return msg.Subject + "\n" + msg.Body
+}
+
+// aftnGateway connects the message store to an AFTN circuit. Telegrams
+// received become messages for each addressee; queued messages routed to
+// the gateway's name go out as telegrams.
+type aftnGateway struct {
+	db    *sql.DB
+	cfg   config.AFTNConfig
+	queue *relayer
+}
+
+func newAFTNGateway(db *sql.DB, store attachmentStore, cfg config.AFTNConfig, relay config.RelayConfig) *aftnGateway {
+	return &aftnGateway{db: db, cfg: cfg, queue: newRelayer(db, store, relay)}
+}
+
+// runAFTNGateway keeps the circuit to the AFTN switch up until ctx is done,
+// dialling again after every drop.
+func runAFTNGateway(ctx context.Context, db *sql.DB, store attachmentStore, cfg config.AFTNConfig, relay config.RelayConfig) {
+	g := newAFTNGateway(db, store, cfg, relay)
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "tcp", cfg.Address)
+		if err == nil {
+			log.Printf("AFTN channel %s connected to %s", cfg.ChannelID, cfg.Address)
+			err = g.serve(ctx, newAFTNChannel(conn, cfg.ChannelID, cfg.RemoteChannelID, 3*cfg.CheckInterval, relay.Timeout))
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("AFTN channel %s down: %v", cfg.ChannelID, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.ReconnectInterval):
+		}
+	}
+}
+
+// serve runs one connection: it reads incoming telegrams, sends queued
+// messages every relay poll and a channel check every check interval. It
+// returns when the connection fails.
+func (g *aftnGateway) serve(ctx context.Context, ch *aftnChannel) error {
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			t, err := ch.receive()
+			if errors.Is(err, errBadTelegram) {
+				log.Printf("AFTN channel %s: %v", ch.remoteID, err)
+				continue
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			if !t.Check {
+				g.receive(t)
+			}
+		}
+	}()
+
+	if err := ch.sendCheck(); err != nil {
+		return err
+	}
+	poll := time.NewTicker(g.queue.cfg.PollInterval)
+	defer poll.Stop()
+	check := time.NewTicker(g.cfg.CheckInterval)
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return err
+		case <-check.C:
+			if err := ch.sendCheck(); err != nil {
+				return err
+			}
+		case <-poll.C:
+			if err := g.sendQueued(ch); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receive stores a telegram as one message per addressee, from its
+// originator. Addressees routed back to the circuit are not ours and are
+// skipped.
+func (g *aftnGateway) receive(t telegram) {
+	for _, addr := range t.Addressees {
+		in := newMessage{
+			Receiver:   addr,
+			Subject:    telegramSubject(t),
+			Body:       t.Text,
+			Priority:   t.Priority,
+			Originator: t.Originator,
+			FilingTime: t.FilingTime,
+			ChannelSeq: t.TransmissionID(),
+		}
+		if strings.TrimSpace(in.Body) == "" {
+			in.Body = in.Subject
+		}
+		if err := in.validate(); err != nil {
+			log.Printf("AFTN %s for %s refused: %v", t.TransmissionID(), addr, err)
+			continue
+		}
+		receiver, rt, err := resolveRecipient(g.db, in.Receiver)
+		if err != nil {
+			log.Printf("AFTN %s for %s refused: %v", t.TransmissionID(), addr, err)
+			continue
+		}
+		if rt != nil && rt.NextHop == g.cfg.Name {
+			log.Printf("AFTN %s for %s skipped: routed back to the circuit", t.TransmissionID(), addr)
+			continue
+		}
+		in.Receiver, in.Route = receiver, rt
+		if _, err := sendMessage(g.db, t.Originator, in); err != nil {
+			log.Printf("AFTN %s for %s not stored: %v", t.TransmissionID(), addr, err)
+		}
+	}
+}
+
+// originatorFor is the AFTN address telegrams from msg's sender go out
+// under: the sender's own, if it is an address or listed in the
+// directory, or else the gateway's station address.
+func (g *aftnGateway) originatorFor(msg Message) (string, error) {
+	if originatorPattern.MatchString(msg.Sender) {
+		return msg.Sender, nil
+	}
+	var addr string
+	err := g.db.QueryRow(`SELECT aftn_address FROM directory_entries WHERE username=$1 AND aftn_address <> ''`, msg.Sender).Scan(&addr)
+	if err == sql.ErrNoRows {
+		return g.cfg.Station, nil
+	}
+	return addr, err
+}
+
+// sendQueued sends the due messages routed to the gateway. An error means
+// the circuit failed; messages it could not take are retried.
+func (g *aftnGateway) sendQueued(ch *aftnChannel) error {
+	for {
+		items, err := g.queue.claim(g.cfg.Name)
+		if err != nil {
+			log.Printf("AFTN claim error: %v", err)
+			return nil
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		ids := make([]int64, len(items))
+		for i, it := range items {
+			ids[i] = it.MessageID
+		}
+		msgs, err := queryMessages(g.db, `SELECT `+messageColumns+` FROM messages WHERE id = ANY($1)`, pq.Array(ids))
+		if err != nil {
+			log.Printf("AFTN load error: %v", err)
+			return nil
+		}
+		for n, it := range items {
+			msg, ok := msgs[it.MessageID]
+			if !ok {
+				continue
+			}
+			if err := g.sendMessage(ch, it, msg); err != nil {
+				for _, rest := range items[n:] {
+					g.queue.retry(rest, msgs[rest.MessageID], err.Error())
+				}
+				return err
+			}
+		}
+	}
+}
+
+// sendMessage sends one queued message as a telegram. Only a write
+// failure is returned; messages that cannot be sent over AFTN at all are
+// dead-lettered.
+func (g *aftnGateway) sendMessage(ch *aftnChannel, it relayItem, msg Message) error {
+	text := telegramText(msg)
+	if err := checkTelegramText(text); err != nil {
+		g.queue.deadLetter(it, msg, err.Error())
+		return nil
+	}
+	atts, err := loadAttachments(g.db, msg.ID)
+	if err == nil && len(atts) > 0 {
+		g.queue.deadLetter(it, msg, "attachments cannot be sent over AFTN")
+		return nil
+	}
+	origin, oerr := g.originatorFor(msg)
+	if err = errors.Join(err, oerr); err != nil {
+		g.queue.retry(it, msg, err.Error())
+		return nil
+	}
+	t, err := ch.send(telegram{
+		Priority:   msg.Priority,
+		Addressees: []string{msg.Receiver},
+		FilingTime: aftnTime(msg.CreatedAt),
+		Originator: origin,
+		Text:       text,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("AFTN %s sent message %d to %s", t.TransmissionID(), msg.ID, msg.Receiver)
+	g.queue.markRelayed(it, msg, g.cfg.Name)
+	return nil
+}
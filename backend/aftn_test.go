@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"mini-amhs/config"
+)
+
+func TestParseTelegram(t *testing.T) {
+	tg, err := parseTelegram(strings.Split("\r\nZCZC PAR042 191030\r\n\r\nFF EGLLZPZX EGKKZTZX\r\nEGCCZTZX\r\n191029 LFPGZTZX\r\nSLOT REVISION\r\nCTOT 1130\r\n\r", "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, telegram{
+		Channel:    "PAR",
+		Seq:        42,
+		Time:       "191030",
+		Priority:   "FF",
+		Addressees: []string{"EGLLZPZX", "EGKKZTZX", "EGCCZTZX"},
+		FilingTime: "191029",
+		Originator: "LFPGZTZX",
+		Text:       "SLOT REVISION\nCTOT 1130",
+	}, tg)
+	assert.Equal(t, "PAR042", tg.TransmissionID())
+
+	tg, err = parseTelegram([]string{"ZCZC PAR043", "", "CH", ""})
+	assert.NoError(t, err)
+	assert.True(t, tg.Check)
+
+	for _, bad := range [][]string{
+		{"PAR044 191030", "GG EGLLZPZX", "191029 LFPGZTZX", "x"},
+		{"ZCZC PAR44", "GG EGLLZPZX", "191029 LFPGZTZX", "x"},
+		{"ZCZC PAR044", "XX EGLLZPZX", "191029 LFPGZTZX", "x"},
+		{"ZCZC PAR044", "GG EGLL", "191029 LFPGZTZX", "x"},
+		{"ZCZC PAR044", "GG EGLLZPZX"},
+		{"ZCZC PAR044", "GG", "191029 LFPGZTZX"},
+		{"ZCZC PAR044", "GG EGLLZPZX", "191029"},
+	} {
+		_, err := parseTelegram(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestTelegram_FormatRoundTrip(t *testing.T) {
+	addrs := []string{"EGLLZPZX", "EGKKZTZX", "EGCCZTZX", "EGPHZTZX", "EGSSZTZX", "EGGWZTZX", "EGBBZTZX", "EGNXZTZX"}
+	tg := telegram{Channel: "AMH", Seq: 7, Time: "191030", Priority: "GG", Addressees: addrs, FilingTime: "191029", Originator: "EGLLYFYX", Text: "RWY 27L CLSD\n\nUNTIL 1200"}
+	lines := tg.format()
+	assert.Equal(t, "ZCZC AMH007 191030", lines[0])
+	assert.Equal(t, "GG "+strings.Join(addrs[:7], " "), lines[2])
+	assert.Equal(t, "EGNXZTZX", lines[3])
+
+	back, err := parseTelegram(lines)
+	assert.NoError(t, err)
+	assert.Equal(t, tg, back)
+}
+
+func TestAFTNChannel_Sequence(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	tx := newAFTNChannel(a, "AMH", "SIM", time.Minute, time.Second)
+	rx := newAFTNChannel(b, "SIM", "AMH", time.Second, time.Second)
+
+	go func() {
+		tx.sendCheck()
+		tx.send(telegram{Priority: "GG", Addressees: []string{"LFPGZTZX"}, FilingTime: "191029", Originator: "EGLLYFYX", Text: "HELLO"})
+		tx.mu.Lock()
+		tx.txSeq = 5
+		tx.mu.Unlock()
+		tx.sendCheck()
+	}()
+
+	first, err := rx.receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "AMH001", first.TransmissionID())
+	second, err := rx.receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "AMH002", second.TransmissionID())
+	assert.Equal(t, "HELLO", second.Text)
+	assert.Equal(t, 0, rx.gaps)
+
+	// 003 to 005 never arrived.
+	third, err := rx.receive()
+	assert.NoError(t, err)
+	assert.Equal(t, 6, third.Seq)
+	assert.Equal(t, 1, rx.gaps)
+}
+
+func TestAFTNGateway_Receive(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	g := newAFTNGateway(db, nil, config.AFTNConfig{Name: "aftn"}, config.Default().Relay)
+
+	// EGLLZPZX is a local user; EGKKZTZX routes back out over the circuit.
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("EGLLZPZX", "EGLLZPZX").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("heathrow"))
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).
+		WithArgs(dedupLockClass, "LFPGZTZX 191029 PAR042 LFPGZTZX heathrow").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE originator=\$1`).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("LFPGZTZX", "heathrow", "SLOT REVISION", "SLOT REVISION\nCTOT 1130", "FF", nil, nil, nil, nil, "LFPGZTZX", "191029", "PAR042", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(30, "LFPGZTZX", "heathrow", "SLOT REVISION", "SLOT REVISION\nCTOT 1130", "FF", false, false, false, nil, nil, nil, 30, now, nil, now, nil, false, "LFPGZTZX", "191029", "PAR042", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("EGKKZTZX", "EGKKZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE username=\$1\)`).
+		WithArgs("EGKKZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`SELECT .* FROM routes`).
+		WithArgs("EGKKZTZX", defaultRoutePattern).
+		WillReturnRows(sqlmock.NewRows(routeColumnNames).AddRow(1, "*", "aftn", "", now, now))
+
+	g.receive(telegram{
+		Channel: "PAR", Seq: 42, Priority: "FF", Addressees: []string{"EGLLZPZX", "EGKKZTZX"},
+		FilingTime: "191029", Originator: "LFPGZTZX", Text: "SLOT REVISION\nCTOT 1130",
+	})
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAFTNGateway_SendQueued(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Date(2026, 10, 19, 10, 29, 0, 0, time.UTC)
+	g := newAFTNGateway(db, nil, config.AFTNConfig{Name: "aftn", Station: "EGLLYFYX"}, config.Default().Relay)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	mock.ExpectQuery(`UPDATE outbound_queue SET status=\$1, attempts=attempts\+1`).
+		WithArgs(queueSending, sqlmock.AnyArg(), "aftn", queuePending, sqlmock.AnyArg(), 20).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "message_id", "attempts", "trace"}).AddRow(1, 9, 1, []byte("[]")))
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id = ANY\(\$1\)`).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).
+			AddRow(9, "alice", "LFPGZTZX", "Slot", "CTOT 1030", "FF", false, false, false, nil, nil, nil, 9, now, nil, nil, nil, false, "", "", "", false, nil, "*", "aftn"))
+	mock.ExpectQuery(`SELECT .* FROM attachments`).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(attachmentColumnNames))
+	mock.ExpectQuery(`SELECT aftn_address FROM directory_entries WHERE username=\$1`).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"aftn_address"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbound_queue SET status=\$1, sent_at=NOW\(\)`).
+		WithArgs(queueSent, int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`UPDATE messages SET delivered_at=NOW\(\)`).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"delivered_at"}).AddRow(now))
+	expectAudit(mock, auditMessageRelay)
+	mock.ExpectCommit()
+	mock.ExpectQuery(`UPDATE outbound_queue SET status=\$1, attempts=attempts\+1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "message_id", "attempts", "trace"}))
+
+	received := make(chan string, 1)
+	go func() {
+		var sb strings.Builder
+		br := bufio.NewReader(b)
+		for {
+			line, err := br.ReadString('\n')
+			sb.WriteString(line)
+			if err != nil || strings.TrimSpace(line) == aftnEnd {
+				break
+			}
+		}
+		received <- sb.String()
+	}()
+
+	ch := newAFTNChannel(a, "AMH", "SIM", time.Minute, time.Second)
+	assert.NoError(t, g.sendQueued(ch))
+	wire := <-received
+	assert.Contains(t, wire, "ZCZC AMH001 ")
+	assert.Contains(t, wire, "FF LFPGZTZX\r\n191029 EGLLYFYX\r\nSlot\r\nCTOT 1030\r\n\r\nNNNN\r\n")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCheckTelegramText(t *testing.T) {
+	assert.NoError(t, checkTelegramText("RWY 27L CLSD"))
+	assert.Error(t, checkTelegramText("END\nNNNN"))
+	assert.Error(t, checkTelegramText("ZCZC ABC001"))
+}
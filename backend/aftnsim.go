@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aftnSim is a stand-in AFTN switch for local testing. It accepts one
+// circuit at a time, prints what it receives, and can answer each telegram
+// to its originator and inject telegrams typed on stdin.
+type aftnSim struct {
+	channelID, remoteID string
+	check               time.Duration
+	echo                bool
+	out                 io.Writer
+
+	mu sync.Mutex
+	ch *aftnChannel
+}
+
+// runAFTNSim implements the aftn-sim subcommand.
+func runAFTNSim(args []string) int {
+	fs := flag.NewFlagSet("aftn-sim", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:2600", "address to accept the gateway's circuit on")
+	channelID := fs.String("channel-id", "SIM", "channel id of the simulator's transmissions")
+	remoteID := fs.String("remote-channel-id", "AMH", "channel id expected from the gateway")
+	check := fs.Duration("check-interval", 20*time.Minute, "interval between channel checks")
+	echo := fs.Bool("echo", true, "answer each telegram to its originator")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Printf("aftn-sim: %v", err)
+		return 1
+	}
+	defer ln.Close()
+	sim := &aftnSim{channelID: *channelID, remoteID: *remoteID, check: *check, echo: *echo, out: os.Stdout}
+	log.Printf("aftn-sim listening on %s; type \"PRIORITY ADDRESSEE ORIGINATOR TEXT\" to send", ln.Addr())
+	go sim.readCommands(os.Stdin)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("aftn-sim: %v", err)
+			return 1
+		}
+		log.Printf("aftn-sim: circuit up from %s", conn.RemoteAddr())
+		err = sim.serve(conn)
+		conn.Close()
+		log.Printf("aftn-sim: circuit down: %v", err)
+	}
+}
+
+// serve runs one circuit until it fails.
+func (s *aftnSim) serve(conn net.Conn) error {
+	ch := newAFTNChannel(conn, s.channelID, s.remoteID, 3*s.check, 10*time.Second)
+	s.mu.Lock()
+	s.ch = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.ch = nil
+		s.mu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(s.check)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := ch.sendCheck(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		t, err := ch.receive()
+		if errors.Is(err, errBadTelegram) {
+			fmt.Fprintf(s.out, "!! %v\n", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if t.Check {
+			fmt.Fprintf(s.out, "<< %s CH\n", t.TransmissionID())
+			continue
+		}
+		fmt.Fprintf(s.out, "<< %s %s %s from %s\n%s\n", t.TransmissionID(), t.Priority, strings.Join(t.Addressees, " "), t.Originator, t.Text)
+		if s.echo {
+			s.send(simEcho(t))
+		}
+	}
+}
+
+// simEcho answers t from its first addressee to its originator.
+func simEcho(t telegram) telegram {
+	return telegram{
+		Priority:   t.Priority,
+		Addressees: []string{t.Originator},
+		FilingTime: aftnTime(time.Now()),
+		Originator: t.Addressees[0],
+		Text:       "ACK " + t.TransmissionID() + " " + t.FilingTime + "\n" + t.Text,
+	}
+}
+
+// send transmits t on the current circuit, if there is one.
+func (s *aftnSim) send(t telegram) {
+	s.mu.Lock()
+	ch := s.ch
+	s.mu.Unlock()
+	if ch == nil {
+		fmt.Fprintln(s.out, "!! no circuit")
+		return
+	}
+	sent, err := ch.send(t)
+	if err != nil {
+		fmt.Fprintf(s.out, "!! send failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, ">> %s %s %s from %s\n", sent.TransmissionID(), sent.Priority, strings.Join(sent.Addressees, " "), sent.Originator)
+}
+
+// parseSimCommand reads "PRIORITY ADDRESSEE ORIGINATOR TEXT" typed on
+// stdin.
+func parseSimCommand(line string) (telegram, error) {
+	f := strings.SplitN(strings.TrimSpace(line), " ", 4)
+	if len(f) < 4 {
+		return telegram{}, errors.New("want PRIORITY ADDRESSEE ORIGINATOR TEXT")
+	}
+	t := telegram{
+		Priority:   strings.ToUpper(f[0]),
+		Addressees: []string{strings.ToUpper(f[1])},
+		Originator: strings.ToUpper(f[2]),
+		FilingTime: aftnTime(time.Now()),
+		Text:       f[3],
+	}
+	// Round-trip through the parser to apply its checks.
+	t.Channel, t.Seq = "SIM", 1
+	if _, err := parseTelegram(t.format()); err != nil {
+		return telegram{}, err
+	}
+	return t, checkTelegramText(t.Text)
+}
+
+func (s *aftnSim) readCommands(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		t, err := parseSimCommand(sc.Text())
+		if err != nil {
+			fmt.Fprintf(s.out, "!! %v\n", err)
+			continue
+		}
+		s.send(t)
+	}
+}
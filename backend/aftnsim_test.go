@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a strings.Builder safe to write from the simulator while
+// the test reads it.
+type syncBuffer struct {
+	mu sync.Mutex
+	sb strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sb.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sb.String()
+}
+
+func TestParseSimCommand(t *testing.T) {
+	tg, err := parseSimCommand("ff egllzpzx lfpgztzx SLOT REVISION CTOT 1130")
+	assert.NoError(t, err)
+	assert.Equal(t, "FF", tg.Priority)
+	assert.Equal(t, []string{"EGLLZPZX"}, tg.Addressees)
+	assert.Equal(t, "LFPGZTZX", tg.Originator)
+	assert.Equal(t, "SLOT REVISION CTOT 1130", tg.Text)
+
+	_, err = parseSimCommand("GG EGLLZPZX")
+	assert.Error(t, err)
+	_, err = parseSimCommand("QQ EGLLZPZX LFPGZTZX text")
+	assert.Error(t, err)
+	_, err = parseSimCommand("GG EGLLZPZX LFPGZTZX text NNNN")
+	assert.Error(t, err)
+}
+
+func TestAFTNSim_Echo(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	var out syncBuffer
+	sim := &aftnSim{channelID: "SIM", remoteID: "AMH", check: time.Hour, echo: true, out: &out}
+	go sim.serve(b)
+
+	gw := newAFTNChannel(a, "AMH", "SIM", time.Second, time.Second)
+	_, err := gw.send(telegram{Priority: "GG", Addressees: []string{"LFPGZTZX"}, FilingTime: "191029", Originator: "EGLLYFYX", Text: "HELLO"})
+	assert.NoError(t, err)
+
+	echo, err := gw.receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "SIM001", echo.TransmissionID())
+	assert.Equal(t, []string{"EGLLYFYX"}, echo.Addressees)
+	assert.Equal(t, "LFPGZTZX", echo.Originator)
+	assert.Equal(t, "ACK AMH001 191029\nHELLO", echo.Text)
+	assert.Contains(t, out.String(), "<< AMH001 GG LFPGZTZX from EGLLYFYX\nHELLO\n")
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// API key scopes.
+const (
+	scopeMessagesRead = "messages:read"
+	scopeMessagesSend = "messages:send"
+)
+
+var apiKeyScopes = []string{scopeMessagesRead, scopeMessagesSend}
+
+// apiKeyRoutes lists the routes API keys may call, by method and pattern,
+// with the scope each needs. Every other route refuses API keys.
+var apiKeyRoutes = map[string]string{
+	"GET /api/messages":                        scopeMessagesRead,
+	"PUT /api/messages":                        scopeMessagesRead,
+	"GET /api/messages/{id}":                   scopeMessagesRead,
+	"PATCH /api/messages/{id}":                 scopeMessagesRead,
+	"GET /api/messages/{id}/thread":            scopeMessagesRead,
+	"GET /api/messages/{id}/attachments/{aid}": scopeMessagesRead,
+	"GET /api/events":                          scopeMessagesRead,
+	"POST /api/messages":                       scopeMessagesSend,
+	"GET /api/messages/scheduled":              scopeMessagesSend,
+	"POST /api/messages/{id}/reply":            scopeMessagesSend,
+	"POST /api/messages/{id}/forward":          scopeMessagesSend,
+	"POST /api/messages/{id}/cancel":           scopeMessagesSend,
+}
+
+// apiKeyPrefix starts every key, so leaked keys are easy to spot. The
+// prefix stored with a key adds the first characters of its secret part.
+const (
+	apiKeyPrefix      = "amhs_"
+	apiKeyShownLength = len(apiKeyPrefix) + 8
+)
+
+// apiKeyDB is set at startup; API keys are looked up in it.
+var apiKeyDB *sql.DB
+
+const apiKeyColumns = `id, username, name, prefix, scopes, created_by, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	err := row.Scan(&k.ID, &k.Username, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.CreatedBy, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt)
+	return k, err
+}
+
+// newAPIKey returns a fresh key and the hash it is stored under.
+func newAPIKey() (key, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + hex.EncodeToString(b)
+	return key, hashAPIKey(key), nil
+}
+
+// hashAPIKey hashes a key for storage. Keys are long and random, so a
+// plain SHA-256 is enough and lets them be looked up by hash.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "ApiKey ") {
+		return "", false
+	}
+	return strings.TrimPrefix(authHeader, "ApiKey "), true
+}
+
+// apiKeyRouteScope returns the scope an API key needs for the route r was
+// matched to, and false if API keys cannot call it.
+func apiKeyRouteScope(r *http.Request) (string, bool) {
+	pattern := r.Pattern
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+	scope, ok := apiKeyRoutes[r.Method+" "+pattern]
+	return scope, ok
+}
+
+// serveWithAPIKey authenticates r by the API key key and passes it on to
+// next as the key's account if the key has the scope the route needs.
+func serveWithAPIKey(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	if apiKeyDB == nil {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return
+	}
+	var username, role string
+	var scopes []string
+	err := apiKeyDB.QueryRow(
+		`UPDATE api_keys k SET last_used_at=NOW() FROM users u
+		 WHERE k.key_hash=$1 AND k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > NOW())
+		   AND u.username = k.username
+		 RETURNING k.username, k.scopes, u.role`,
+		hashAPIKey(key),
+	).Scan(&username, pq.Array(&scopes), &role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("api key lookup error:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	scope, ok := apiKeyRouteScope(r)
+	if !ok {
+		http.Error(w, "api keys cannot be used here", http.StatusForbidden)
+		return
+	}
+	if !slices.Contains(scopes, scope) {
+		http.Error(w, "api key lacks the "+scope+" scope", http.StatusForbidden)
+		return
+	}
+	next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), username, role)))
+}
+
+// serviceAccountsHandler serves GET and POST /api/service-accounts for
+// admins. Service accounts have no password and authenticate with API
+// keys only.
+func serviceAccountsHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := getUsername(r.Context())
+
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query(`SELECT id, username, description, created_at FROM users WHERE service ORDER BY username`)
+			if err != nil {
+				log.Println("select service accounts error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			accounts := []ServiceAccount{}
+			for rows.Next() {
+				var a ServiceAccount
+				if err := rows.Scan(&a.ID, &a.Username, &a.Description, &a.CreatedAt); err != nil {
+					log.Println("scan error:", err)
+					continue
+				}
+				accounts = append(accounts, a)
+			}
+			writeJSON(w, accounts)
+
+		case http.MethodPost:
+			var in struct {
+				Username    string `json:"username"`
+				Description string `json:"description"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			in.Username = strings.TrimSpace(in.Username)
+			if err := validateUsername(in.Username); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var a ServiceAccount
+			err := withTx(db, func(tx *sql.Tx) error {
+				// An empty password hash never matches, so the account
+				// cannot log in.
+				err := tx.QueryRow(
+					`INSERT INTO users(username, password_hash, service, description) VALUES($1, '', TRUE, $2)
+					 RETURNING id, username, description, created_at`,
+					in.Username, strings.TrimSpace(in.Description),
+				).Scan(&a.ID, &a.Username, &a.Description, &a.CreatedAt)
+				if err != nil {
+					return err
+				}
+				return appendAudit(tx, admin, auditServiceAccountCreate, 0, map[string]any{"username": a.Username})
+			})
+			if err != nil {
+				log.Println("insert service account error:", err)
+				if strings.Contains(strings.ToLower(err.Error()), "unique") {
+					http.Error(w, "username already taken", http.StatusConflict)
+				} else {
+					http.Error(w, "db error", http.StatusInternalServerError)
+				}
+				return
+			}
+			writeJSON(w, a)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// serviceAccountExists reports whether the {username} path value names a
+// service account, answering 404 if not.
+func serviceAccountExists(db *sql.DB, w http.ResponseWriter, r *http.Request) (string, bool) {
+	username := r.PathValue("username")
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username=$1 AND service)`, username).Scan(&exists)
+	if err != nil {
+		log.Println("select service account error:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return "", false
+	}
+	if !exists {
+		http.Error(w, "service account not found", http.StatusNotFound)
+		return "", false
+	}
+	return username, true
+}
+
+// apiKeyInput is a key as requested by an admin.
+type apiKeyInput struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (in *apiKeyInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(in.Scopes) == 0 {
+		return errors.New("scopes must name at least one scope")
+	}
+	for _, s := range in.Scopes {
+		if !slices.Contains(apiKeyScopes, s) {
+			return fmt.Errorf("scopes must be among %s", strings.Join(apiKeyScopes, ", "))
+		}
+	}
+	slices.Sort(in.Scopes)
+	in.Scopes = slices.Compact(in.Scopes)
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	return nil
+}
+
+// apiKeysHandler serves GET and POST /api/service-accounts/{username}/keys
+// for admins. A new key is shown once, in the response that creates it.
+func apiKeysHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := getUsername(r.Context())
+		username, ok := serviceAccountExists(db, w, r)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE username=$1 ORDER BY id`, username)
+			if err != nil {
+				log.Println("select api keys error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			keys := []APIKey{}
+			for rows.Next() {
+				k, err := scanAPIKey(rows)
+				if err != nil {
+					log.Println("scan error:", err)
+					continue
+				}
+				keys = append(keys, k)
+			}
+			writeJSON(w, keys)
+
+		case http.MethodPost:
+			var in apiKeyInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			if err := in.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			key, hash, err := newAPIKey()
+			if err != nil {
+				log.Println("api key error:", err)
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+
+			var k APIKey
+			err = withTx(db, func(tx *sql.Tx) error {
+				var err error
+				k, err = scanAPIKey(tx.QueryRow(
+					`INSERT INTO api_keys(username, name, prefix, key_hash, scopes, created_by, expires_at)
+					 VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING `+apiKeyColumns,
+					username, in.Name, key[:apiKeyShownLength], hash, pq.Array(in.Scopes), admin, in.ExpiresAt,
+				))
+				if err != nil {
+					return err
+				}
+				return appendAudit(tx, admin, auditAPIKeyCreate, 0, map[string]any{
+					"username": username, "key_id": k.ID, "prefix": k.Prefix, "scopes": k.Scopes,
+				})
+			})
+			if err != nil {
+				log.Println("insert api key error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			k.Key = key
+			writeJSON(w, k)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// revokeAPIKeyHandler serves DELETE
+// /api/service-accounts/{username}/keys/{id} for admins. Revoked keys stay
+// listed.
+func revokeAPIKeyHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := getUsername(r.Context())
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id < 1 {
+			http.Error(w, "invalid key id", http.StatusBadRequest)
+			return
+		}
+		username := r.PathValue("username")
+
+		err = withTx(db, func(tx *sql.Tx) error {
+			var prefix string
+			err := tx.QueryRow(
+				`UPDATE api_keys SET revoked_at=NOW() WHERE id=$1 AND username=$2 AND revoked_at IS NULL RETURNING prefix`,
+				id, username,
+			).Scan(&prefix)
+			if err != nil {
+				return err
+			}
+			return appendAudit(tx, admin, auditAPIKeyRevoke, 0, map[string]any{
+				"username": username, "key_id": id, "prefix": prefix,
+			})
+		})
+		if err == sql.ErrNoRows {
+			http.Error(w, "api key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("revoke api key error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var apiKeyColumnNames = []string{"id", "username", "name", "prefix", "scopes", "created_by", "created_at", "expires_at", "last_used_at", "revoked_at"}
+
+// captureArg matches any argument and keeps it.
+type captureArg struct{ v driver.Value }
+
+func (c *captureArg) Match(v driver.Value) bool {
+	c.v = v
+	return true
+}
+
+func TestJWTAuthMiddleware_APIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	saved := apiKeyDB
+	defer func() { apiKeyDB = saved }()
+	apiKeyDB = db
+
+	whoami := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := getUsername(r.Context())
+		w.Write([]byte(username + " " + getRole(r.Context())))
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/api/messages", jwtAuthMiddleware(whoami))
+	mux.Handle("GET /api/audit", jwtAuthMiddleware(whoami))
+	do := func(method, path, key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "ApiKey "+key)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	expectKey := func(key string, scopes string) {
+		q := mock.ExpectQuery(`UPDATE api_keys k SET last_used_at=NOW\(\) FROM users u`).WithArgs(hashAPIKey(key))
+		if scopes == "" {
+			q.WillReturnError(sql.ErrNoRows)
+			return
+		}
+		q.WillReturnRows(sqlmock.NewRows([]string{"username", "scopes", "role"}).AddRow("egll-gateway", scopes, roleUser))
+	}
+
+	expectKey("amhs_reader", "{messages:read}")
+	rr := do(http.MethodGet, "/api/messages", "amhs_reader")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "egll-gateway user", rr.Body.String())
+
+	expectKey("amhs_reader", "{messages:read}")
+	rr = do(http.MethodPost, "/api/messages", "amhs_reader")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "api key lacks the messages:send scope\n", rr.Body.String())
+
+	expectKey("amhs_sender", "{messages:read,messages:send}")
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/api/messages", "amhs_sender").Code)
+
+	expectKey("amhs_sender", "{messages:read,messages:send}")
+	rr = do(http.MethodGet, "/api/audit", "amhs_sender")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "api keys cannot be used here\n", rr.Body.String())
+
+	// Unknown, revoked and expired keys all fail the lookup.
+	expectKey("amhs_revoked", "")
+	rr = do(http.MethodGet, "/api/messages", "amhs_revoked")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "invalid api key\n", rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestServiceAccountsHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	post := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/api/service-accounts", strings.NewReader(body))
+		req = req.WithContext(withIdentity(req.Context(), "root", roleAdmin))
+		rr := httptest.NewRecorder()
+		serviceAccountsHandler(db).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post(`{"username":"gw@egll"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "username must not contain @\n", rr.Body.String())
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO users\(username, password_hash, service, description\) VALUES\(\$1, '', TRUE, \$2\)`).
+		WithArgs("egll-gateway", "EGLL AFTN gateway").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "description", "created_at"}).AddRow(7, "egll-gateway", "EGLL AFTN gateway", time.Now()))
+	expectAudit(mock, auditServiceAccountCreate)
+	mock.ExpectCommit()
+	rr = post(`{"username":" egll-gateway ","description":"EGLL AFTN gateway"}`)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"username": "egll-gateway"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAPIKeysHandler_Create(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	post := func(account, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/api/service-accounts/"+account+"/keys", strings.NewReader(body))
+		req.SetPathValue("username", account)
+		req = req.WithContext(withIdentity(req.Context(), "root", roleAdmin))
+		rr := httptest.NewRecorder()
+		apiKeysHandler(db).ServeHTTP(rr, req)
+		return rr
+	}
+	expectAccount := func(account string, exists bool) {
+		mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE username=\$1 AND service\)`).
+			WithArgs(account).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(exists))
+	}
+
+	expectAccount("alice", false)
+	assert.Equal(t, http.StatusNotFound, post("alice", `{"name":"ci","scopes":["messages:read"]}`).Code)
+
+	expectAccount("egll-gateway", true)
+	rr := post("egll-gateway", `{"name":"ci","scopes":["messages:delete"]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "scopes must be among messages:read, messages:send\n", rr.Body.String())
+
+	expectAccount("egll-gateway", true)
+	assert.Equal(t, http.StatusBadRequest, post("egll-gateway", `{"name":"ci","scopes":["messages:read"],"expires_at":"2001-01-01T00:00:00Z"}`).Code)
+
+	prefix, hash := &captureArg{}, &captureArg{}
+	now := time.Now()
+	expectAccount("egll-gateway", true)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO api_keys`).
+		WithArgs("egll-gateway", "ci", prefix, hash, sqlmock.AnyArg(), "root", nil).
+		WillReturnRows(sqlmock.NewRows(apiKeyColumnNames).AddRow(3, "egll-gateway", "ci", "amhs_0123abcd", "{messages:read,messages:send}", "root", now, nil, nil, nil))
+	expectAudit(mock, auditAPIKeyCreate)
+	mock.ExpectCommit()
+	rr = post("egll-gateway", `{"name":" ci ","scopes":["messages:send","messages:read"]}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var k APIKey
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &k))
+	assert.True(t, strings.HasPrefix(k.Key, "amhs_"))
+	assert.Equal(t, k.Key[:apiKeyShownLength], prefix.v)
+	// Only the hash is stored.
+	assert.Equal(t, hashAPIKey(k.Key), hash.v)
+	assert.NotContains(t, hash.v, k.Key)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeAPIKeyHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	revoke := func(id string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodDelete, "/api/service-accounts/egll-gateway/keys/"+id, nil)
+		req.SetPathValue("username", "egll-gateway")
+		req.SetPathValue("id", id)
+		req = req.WithContext(withIdentity(req.Context(), "root", roleAdmin))
+		rr := httptest.NewRecorder()
+		revokeAPIKeyHandler(db).ServeHTTP(rr, req)
+		return rr
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE api_keys SET revoked_at=NOW\(\)`).
+		WithArgs(int64(3), "egll-gateway").
+		WillReturnRows(sqlmock.NewRows([]string{"prefix"}).AddRow("amhs_0123abcd"))
+	expectAudit(mock, auditAPIKeyRevoke)
+	mock.ExpectCommit()
+	assert.Equal(t, http.StatusNoContent, revoke("3").Code)
+
+	// Already revoked.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE api_keys SET revoked_at=NOW\(\)`).
+		WithArgs(int64(3), "egll-gateway").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	assert.Equal(t, http.StatusNotFound, revoke("3").Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
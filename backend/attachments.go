@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const attachmentColumns = `id, message_id, filename, content_type, size, sha256, storage_key, created_at`
+
+func scanAttachment(row rowScanner) (Attachment, error) {
+	var a Attachment
+	err := row.Scan(&a.ID, &a.MessageID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.StorageKey, &a.CreatedAt)
+	return a, err
+}
+
+// maxFormFieldLen caps the non-file fields of a multipart submission.
+const maxFormFieldLen = 64 << 10
+
+// uploadError is a client mistake in a multipart submission; Status is the
+// HTTP status to answer with.
+type uploadError struct {
+	Status int
+	Msg    string
+}
+
+func (e *uploadError) Error() string { return e.Msg }
+
+// bodyError is the uploadError for a failure to read the request body:
+// 413 when it went over the http.MaxBytesReader limit, else msg as a 400.
+func bodyError(err error, msg string) *uploadError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds maximum size of %d bytes", tooLarge.Limit)}
+	}
+	return &uploadError{http.StatusBadRequest, msg}
+}
+
+// readMultipartMessage streams a multipart/form-data submission. Text fields
+// fill in the message; every file part is checked against the configured
+// limits, hashed and written to store while it is read, so uploads are
+// never held in memory. On error, anything already stored is removed.
+func readMultipartMessage(r *http.Request, store attachmentStore) (newMessage, error) {
+	var in newMessage
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return in, &uploadError{http.StatusBadRequest, "invalid multipart body"}
+	}
+
+	fail := func(err error) (newMessage, error) {
+		discardAttachments(store, in.Attachments)
+		return newMessage{}, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(bodyError(err, "invalid multipart body"))
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldLen+1))
+			if err != nil {
+				return fail(bodyError(err, "invalid multipart body"))
+			}
+			if len(value) > maxFormFieldLen {
+				return fail(&uploadError{http.StatusBadRequest, "form field too large"})
+			}
+			switch part.FormName() {
+			case "receiver":
+				in.Receiver = string(value)
+			case "subject":
+				in.Subject = string(value)
+			case "body":
+				in.Body = string(value)
+			case "priority":
+				in.Priority = string(value)
+			case "originator":
+				in.Originator = string(value)
+			case "filing_time":
+				in.FilingTime = string(value)
+			case "channel_seq":
+				in.ChannelSeq = string(value)
+			case "deliver_at", "expires_at":
+				if len(value) == 0 {
+					break
+				}
+				t, err := time.Parse(time.RFC3339, string(value))
+				if err != nil {
+					return fail(&uploadError{http.StatusBadRequest, part.FormName() + " must be an RFC 3339 time"})
+				}
+				if part.FormName() == "deliver_at" {
+					in.DeliverAt = &t
+				} else {
+					in.ExpiresAt = &t
+				}
+			}
+			continue
+		}
+
+		if len(in.Attachments) >= appConfig.Attachments.MaxCount {
+			return fail(&uploadError{http.StatusBadRequest, fmt.Sprintf("at most %d attachments allowed", appConfig.Attachments.MaxCount)})
+		}
+		att, err := storeAttachment(store, part)
+		if err != nil {
+			return fail(err)
+		}
+		in.Attachments = append(in.Attachments, att)
+	}
+	return in, nil
+}
+
+// storeAttachment writes one file part to store and returns its metadata.
+func storeAttachment(store attachmentStore, part *multipart.Part) (Attachment, error) {
+	limits := appConfig.Attachments
+	att := Attachment{Filename: sanitizeFilename(part.FileName())}
+
+	br := bufio.NewReaderSize(part, 512)
+	head, _ := br.Peek(512)
+	att.ContentType = part.Header.Get("Content-Type")
+	if att.ContentType == "" || att.ContentType == "application/octet-stream" {
+		att.ContentType = http.DetectContentType(head)
+	}
+	mediaType, _, err := mime.ParseMediaType(att.ContentType)
+	if err != nil || !typeAllowed(mediaType, limits.AllowedTypes) {
+		return att, &uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("attachment %q: type %s not allowed", att.Filename, att.ContentType)}
+	}
+
+	key, err := newStorageKey()
+	if err != nil {
+		return att, err
+	}
+	h := sha256.New()
+	lr := &io.LimitedReader{R: br, N: int64(limits.MaxSize) + 1}
+	if err := store.Put(key, io.TeeReader(lr, h)); err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			return att, bodyError(err, "invalid multipart body")
+		}
+		return att, fmt.Errorf("store attachment: %w", err)
+	}
+	att.Size = int64(limits.MaxSize) + 1 - lr.N
+	if att.Size > int64(limits.MaxSize) {
+		store.Delete(key)
+		return att, &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("attachment %q exceeds maximum size of %d bytes", att.Filename, limits.MaxSize)}
+	}
+	att.StorageKey = key
+	att.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return att, nil
+}
+
+// storeAttachmentData is storeAttachment for a file already in memory, as
+// received from a peer server or in an email.
+func storeAttachmentData(store attachmentStore, filename, contentType string, data []byte) (Attachment, error) {
+	limits := appConfig.Attachments
+	att := Attachment{Filename: sanitizeFilename(filename), ContentType: contentType, Size: int64(len(data))}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !typeAllowed(mediaType, limits.AllowedTypes) {
+		return att, &uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("attachment %q: type %s not allowed", att.Filename, contentType)}
+	}
+	if att.Size > int64(limits.MaxSize) {
+		return att, &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("attachment %q exceeds maximum size of %d bytes", att.Filename, limits.MaxSize)}
+	}
+	key, err := newStorageKey()
+	if err != nil {
+		return att, err
+	}
+	if err := store.Put(key, bytes.NewReader(data)); err != nil {
+		return att, fmt.Errorf("store attachment: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	att.StorageKey = key
+	att.SHA256 = hex.EncodeToString(sum[:])
+	return att, nil
+}
+
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+func typeAllowed(mediaType string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == "*/*" || strings.EqualFold(a, mediaType) {
+			return true
+		}
+		if family, ok := strings.CutSuffix(a, "/*"); ok && strings.HasPrefix(mediaType, family+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// discardAttachments removes stored files that never made it into the
+// database.
+func discardAttachments(store attachmentStore, atts []Attachment) {
+	for _, a := range atts {
+		if a.StorageKey == "" {
+			continue
+		}
+		if err := store.Delete(a.StorageKey); err != nil {
+			log.Println("attachment cleanup error:", err)
+		}
+	}
+}
+
+func insertAttachment(db dbtx, messageID int64, a Attachment) (Attachment, error) {
+	return scanAttachment(db.QueryRow(
+		`INSERT INTO attachments(message_id, filename, content_type, size, sha256, storage_key)
+		 VALUES($1,$2,$3,$4,$5,$6)
+		 RETURNING `+attachmentColumns,
+		messageID, a.Filename, a.ContentType, a.Size, a.SHA256, a.StorageKey,
+	))
+}
+
+func loadAttachments(db dbtx, messageID int64) ([]Attachment, error) {
+	rows, err := db.Query(`SELECT `+attachmentColumns+` FROM attachments WHERE message_id=$1 ORDER BY id`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var atts []Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		atts = append(atts, a)
+	}
+	return atts, rows.Err()
+}
+
+// attachmentHandler serves GET /api/messages/{id}/attachments/{aid},
+// streaming the file to the message's sender or receiver.
+func attachmentHandler(db *sql.DB, store attachmentStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+		aid, err := strconv.ParseInt(r.PathValue("aid"), 10, 64)
+		if err != nil || aid < 1 {
+			http.Error(w, "invalid attachment id", http.StatusBadRequest)
+			return
+		}
+
+		att, err := scanAttachment(db.QueryRow(
+			`SELECT `+attachmentColumns+` FROM attachments WHERE id=$1 AND message_id=$2`, aid, msg.ID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "attachment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("select attachment error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := store.Open(att.StorageKey)
+		if err != nil {
+			log.Println("open attachment error:", err)
+			http.Error(w, "attachment unavailable", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		h := w.Header()
+		h.Set("Content-Type", att.ContentType)
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename}))
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Checksum-SHA256", att.SHA256)
+		h.Set("ETag", `"`+att.SHA256+`"`)
+		if rs, ok := f.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, "", att.CreatedAt, rs)
+			return
+		}
+		h.Set("Content-Length", strconv.FormatInt(att.Size, 10))
+		io.Copy(w, f)
+	})
+}
+
+// copyAttachments stores a second copy of each file under a new key.
+func copyAttachments(store attachmentStore, atts []Attachment) ([]Attachment, error) {
+	var copies []Attachment
+	for _, a := range atts {
+		key, err := newStorageKey()
+		if err != nil {
+			discardAttachments(store, copies)
+			return nil, err
+		}
+		f, err := store.Open(a.StorageKey)
+		if err != nil {
+			discardAttachments(store, copies)
+			return nil, err
+		}
+		err = store.Put(key, f)
+		f.Close()
+		if err != nil {
+			discardAttachments(store, copies)
+			return nil, err
+		}
+		a.StorageKey = key
+		copies = append(copies, a)
+	}
+	return copies, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var attachmentColumnNames = []string{"id", "message_id", "filename", "content_type", "size", "sha256", "storage_key", "created_at"}
+
+func newMultipartRequest(t *testing.T, username string, fields map[string]string, filename, contentType, content string) *http.Request {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+	h.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(h)
+	assert.NoError(t, err)
+	part.Write([]byte(content))
+	assert.NoError(t, mw.Close())
+
+	req, _ := http.NewRequest("POST", "/api/messages", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req.WithContext(context.WithValue(req.Context(), userContextKey, username))
+}
+
+// storedFiles lists the attachment files under dir, ignoring fan-out
+// directories.
+func storedFiles(t *testing.T, dir string) []string {
+	var files []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	return files
+}
+
+func TestMessagesHandler_MultipartUpload(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dir := t.TempDir()
+	store, err := newLocalStore(dir)
+	assert.NoError(t, err)
+
+	content := "RWY 09/27 CLOSED"
+	sum := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("alice", "bob", "NOTAM", "see attached", "GG", nil, nil, nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(1, "alice", "bob", "NOTAM", "see attached", "GG", false, false, false, nil, nil, nil, 1, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+	mock.ExpectQuery(`INSERT INTO attachments`).
+		WithArgs(int64(1), "notam.txt", "text/plain", int64(len(content)), checksum, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(attachmentColumnNames).AddRow(1, 1, "notam.txt", "text/plain", len(content), checksum, "key", now))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fields := map[string]string{"receiver": "bob", "subject": "NOTAM", "body": "see attached"}
+	messagesHandler(db, store).ServeHTTP(rr, newMultipartRequest(t, "alice", fields, `..\notam.txt`, "text/plain", content))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), checksum)
+	assert.Len(t, storedFiles(t, dir), 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMessagesHandler_MultipartRejectsDisallowedType(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dir := t.TempDir()
+	store, err := newLocalStore(dir)
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	fields := map[string]string{"receiver": "bob", "subject": "tool", "body": "run this"}
+	messagesHandler(db, store).ServeHTTP(rr, newMultipartRequest(t, "alice", fields, "setup.exe", "application/x-msdownload", "MZ"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+	assert.Empty(t, storedFiles(t, dir))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMessagesHandler_MultipartBodyTooLarge(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dir := t.TempDir()
+	store, err := newLocalStore(dir)
+	assert.NoError(t, err)
+	saved := appConfig.Attachments
+	defer func() { appConfig.Attachments = saved }()
+	appConfig.Attachments.MaxSize = 16
+	appConfig.Attachments.MaxCount = 1
+
+	// Each field is within its own limit, but together they are not.
+	fields := map[string]string{"receiver": "bob", "subject": "NOTAM", "body": "see attached"}
+	for i := 0; i < 5; i++ {
+		fields[fmt.Sprintf("pad%d", i)] = strings.Repeat("x", maxFormFieldLen)
+	}
+	rr := httptest.NewRecorder()
+	messagesHandler(db, store).ServeHTTP(rr, newMultipartRequest(t, "alice", fields, "notam.txt", "text/plain", "RWY 09/27 CLOSED"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Contains(t, rr.Body.String(), "request body exceeds maximum size")
+	assert.Empty(t, storedFiles(t, dir))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAttachmentHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	store, err := newLocalStore(t.TempDir())
+	assert.NoError(t, err)
+	key := "00112233445566778899aabbccddeeff"
+	assert.NoError(t, store.Put(key, strings.NewReader("hello")))
+
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "Hi", "Body", "GG", false, false, false, nil, nil, nil, 7, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", ""))
+	mock.ExpectQuery(`SELECT .* FROM attachments WHERE id=\$1 AND message_id=\$2`).
+		WithArgs(int64(3), int64(7)).
+		WillReturnRows(sqlmock.NewRows(attachmentColumnNames).AddRow(3, 7, "hello.txt", "text/plain", 5, "abc", key, time.Now()))
+
+	req := newMessageRequest("GET", "bob", "7", "")
+	req.SetPathValue("aid", "3")
+	rr := httptest.NewRecorder()
+	attachmentHandler(db, store).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "hello", rr.Body.String())
+	assert.Equal(t, `attachment; filename=hello.txt`, rr.Header().Get("Content-Disposition"))
+	assert.Equal(t, "abc", rr.Header().Get("X-Checksum-SHA256"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectAudit registers the statements appendAudit runs for one entry
+// with the given action.
+func expectAudit(mock sqlmock.Sqlmock, action string) {
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1\)`).
+		WithArgs(auditLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow("prev"))
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), action, sqlmock.AnyArg(), sqlmock.AnyArg(), "prev", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	t0 := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	id := int64(42)
+	h1 := auditHash("", t0, "alice", auditMessageSend, &id, `{"receiver":"bob"}`)
+	h2 := auditHash(h1, t0.Add(time.Second), "bob", auditMessageRead, &id, `{}`)
+	h3 := auditHash(h2, t0.Add(2*time.Second), "bob", auditMessageDelete, &id, `{}`)
+
+	columns := []string{"id", "occurred_at", "actor", "action", "message_id", "details", "prev_hash", "hash"}
+	mock.ExpectQuery(`SELECT .* FROM audit_log ORDER BY id`).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, t0, "alice", auditMessageSend, id, `{"receiver":"bob"}`, "", h1).
+			AddRow(2, t0.Add(time.Second), "bob", auditMessageRead, id, `{}`, h1, h2).
+			AddRow(3, t0.Add(2*time.Second), "bob", auditMessageDelete, id, `{}`, h2, h3))
+
+	checked, breaks, err := verifyAuditChain(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, checked)
+	assert.Empty(t, breaks)
+
+	// Someone rewrote who read the message and deleted the delete entry.
+	mock.ExpectQuery(`SELECT .* FROM audit_log ORDER BY id`).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, t0, "alice", auditMessageSend, id, `{"receiver":"bob"}`, "", h1).
+			AddRow(2, t0.Add(time.Second), "mallory", auditMessageRead, id, `{}`, h1, h2).
+			AddRow(4, t0.Add(3*time.Second), "bob", auditMessageRestore, id, `{}`, h3,
+				auditHash(h3, t0.Add(3*time.Second), "bob", auditMessageRestore, &id, `{}`)))
+
+	checked, breaks, err = verifyAuditChain(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, checked)
+	assert.Equal(t, []auditBreak{
+		{2, "hash does not match entry contents"},
+		{4, "prev_hash does not match the previous entry"},
+	}, breaks)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -18,24 +19,24 @@ var (
 	bcryptCompareHashAndPassword  = bcrypt.CompareHashAndPassword
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
+// jwtKey is set from the loaded configuration at startup.
+var jwtKey []byte
 
 type Claims struct {
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
 func registerHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		setCORS(w, r)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if localLoginDisabled(w) {
+			return
+		}
 
 		var in struct {
 			Username string `json:"username"`
@@ -48,8 +49,8 @@ func registerHandler(db *sql.DB) http.HandlerFunc {
 
 		in.Username = strings.TrimSpace(in.Username)
 		in.Password = strings.TrimSpace(in.Password)
-		if in.Username == "" || len(in.Username) < 3 {
-			http.Error(w, "username must be at least 3 characters", http.StatusBadRequest)
+		if err := validateUsername(in.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		if in.Password == "" || len(in.Password) < 8 {
@@ -65,11 +66,17 @@ func registerHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		var user User
-		err = db.QueryRow(
-			`INSERT INTO users(username, password_hash) VALUES($1, $2)
-			 RETURNING id, username, created_at`,
-			in.Username, string(passwordHash),
-		).Scan(&user.ID, &user.Username, &user.CreatedAt)
+		err = withTx(db, func(tx *sql.Tx) error {
+			err := tx.QueryRow(
+				`INSERT INTO users(username, password_hash) VALUES($1, $2)
+				 RETURNING id, username, created_at, role`,
+				in.Username, string(passwordHash),
+			).Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Role)
+			if err != nil {
+				return err
+			}
+			return appendAudit(tx, user.Username, auditUserRegister, 0, nil)
+		})
 		if err != nil {
 			log.Println("db insert user error:", err)
 			if strings.Contains(strings.ToLower(err.Error()), "unique") {
@@ -84,17 +91,31 @@ func registerHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// validateUsername checks a new account name.
+func validateUsername(username string) error {
+	if len(username) < 3 {
+		return errors.New("username must be at least 3 characters")
+	}
+	// Mail to user@domain is delivered to user, and senders with an @
+	// are remote; local names must not look like either.
+	if strings.Contains(username, "@") {
+		return errors.New("username must not contain @")
+	}
+	if strings.EqualFold(username, systemMailbox) {
+		return errors.New("username is reserved")
+	}
+	return nil
+}
+
 func loginHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		setCORS(w, r)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if localLoginDisabled(w) {
+			return
+		}
 
 		var in struct {
 			Username string `json:"username"`
@@ -107,11 +128,12 @@ func loginHandler(db *sql.DB) http.HandlerFunc {
 
 		var user User
 		err := db.QueryRow(
-			`SELECT id, username, password_hash, created_at FROM users WHERE username=$1`,
+			`SELECT id, username, password_hash, created_at, role FROM users WHERE username=$1`,
 			in.Username,
-		).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
+		).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.Role)
 		if err != nil {
 			if err == sql.ErrNoRows {
+				auditLogin(db, in.Username, auditUserLoginFailed, "unknown user")
 				http.Error(w, "invalid credentials", http.StatusUnauthorized)
 			} else {
 				log.Println("db query user error:", err)
@@ -121,26 +143,93 @@ func loginHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		if err := bcryptCompareHashAndPassword([]byte(user.PasswordHash), []byte(in.Password)); err != nil {
+			auditLogin(db, user.Username, auditUserLoginFailed, "wrong password")
 			http.Error(w, "invalid credentials", http.StatusUnauthorized)
 			return
 		}
 
-		expirationTime := time.Now().Add(24 * time.Hour)
-		claims := &Claims{
-			Username: user.Username,
-			RegisteredClaims: jwt.RegisteredClaims{
-				ExpiresAt: jwt.NewNumericDate(expirationTime),
-			},
-		}
-
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString(jwtKey)
+		tokenString, err := issueToken(user)
 		if err != nil {
 			log.Println("jwt sign error:", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
 			return
 		}
+		if err := auditLogin(db, user.Username, auditUserLogin, ""); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
 
 		writeJSON(w, map[string]string{"token": tokenString})
 	}
 }
+
+// auditLogin records a login attempt. Failures to audit a rejected login
+// are only logged, since the caller is turned away either way.
+func auditLogin(db *sql.DB, username, action, reason string) error {
+	var details map[string]any
+	if reason != "" {
+		details = map[string]any{"reason": reason}
+	}
+	err := withTx(db, func(tx *sql.Tx) error {
+		return appendAudit(tx, username, action, 0, details)
+	})
+	if err != nil {
+		log.Println("audit login error:", err)
+	}
+	return err
+}
+
+// issueToken signs an auth token for user.
+func issueToken(user User) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		Username: user.Username,
+		Role:     user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    appConfig.Auth.Issuer,
+			Audience:  jwt.ClaimStrings{appConfig.Auth.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(appConfig.Auth.TokenLifetime)),
+		},
+	}
+	alg := appConfig.Auth.SigningAlg
+	if alg == "HS256" {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+	}
+	key, ok := signingKeys.current(now)
+	if !ok {
+		return "", errors.New("no active signing key")
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(alg), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// parseToken verifies an auth token: it must be signed with the configured
+// algorithm by a known key, and name this service as issuer and audience.
+func parseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, tokenKey,
+		jwt.WithValidMethods([]string{appConfig.Auth.SigningAlg}),
+		jwt.WithIssuer(appConfig.Auth.Issuer),
+		jwt.WithAudience(appConfig.Auth.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// tokenKey returns the key to verify token with.
+func tokenKey(token *jwt.Token) (any, error) {
+	if appConfig.Auth.SigningAlg == "HS256" {
+		return jwtKey, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := signingKeys.publicKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
@@ -39,12 +39,15 @@ func TestRegisterHandler_Success(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler := registerHandler(db)
 
-	rows := sqlmock.NewRows([]string{"id", "username", "created_at"}).
-		AddRow(1, "testuser", time.Now())
+	rows := sqlmock.NewRows([]string{"id", "username", "created_at", "role"}).
+		AddRow(1, "testuser", time.Now(), "user")
 
+	mock.ExpectBegin()
 	mock.ExpectQuery(`INSERT INTO users`).
 		WithArgs("testuser", "hashedpassword").
 		WillReturnRows(rows)
+	expectAudit(mock, auditUserRegister)
+	mock.ExpectCommit()
 
 	handler.ServeHTTP(rr, req)
 
@@ -83,10 +86,13 @@ func TestRegisterHandler_UsernameTaken(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler := registerHandler(db)
 
+	mock.ExpectBegin()
 	mock.ExpectQuery(`INSERT INTO users`).
 		WithArgs("testuser", "hashedpassword").
 		WillReturnError(errors.New("pq: duplicate key value violates unique constraint \"users_username_key\""))
 
+	mock.ExpectRollback()
+
 	handler.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusConflict, rr.Code)
@@ -121,12 +127,15 @@ func TestLoginHandler_Success(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler := loginHandler(db)
 
-	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "created_at"}).
-		AddRow(1, "testuser", "hashedpassword", time.Now())
+	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "created_at", "role"}).
+		AddRow(1, "testuser", "hashedpassword", time.Now(), "supervisor")
 	
-	mock.ExpectQuery(`SELECT id, username, password_hash, created_at FROM users`).
+	mock.ExpectQuery(`SELECT id, username, password_hash, created_at, role FROM users`).
 		WithArgs("testuser").
 		WillReturnRows(rows)
+	mock.ExpectBegin()
+	expectAudit(mock, auditUserLogin)
+	mock.ExpectCommit()
 
 	handler.ServeHTTP(rr, req)
 
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func envFrom(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "amhs.yaml")
+	err := os.WriteFile(path, []byte(`
+listen_addr: ":9000"
+db:
+  dsn: postgres://file
+  max_open_conns: 10
+auth:
+  jwt_secret: from-file
+  token_lifetime: 2h
+cors:
+  allowed_origins: [http://file.example]
+`), 0o600)
+	require.NoError(t, err)
+
+	env := envFrom(map[string]string{
+		"DB_DSN":      "postgres://env",
+		"CORS_ORIGIN": "http://env.example",
+	})
+	cfg, err := Load([]string{"-config", path, "-cors-origins", "http://flag.example, https://*.flag.example"}, env)
+	require.NoError(t, err)
+
+	assert.Equal(t, ":9000", cfg.ListenAddr, "file overrides default")
+	assert.Equal(t, 10, cfg.DB.MaxOpenConns, "file overrides default")
+	assert.Equal(t, "postgres://env", cfg.DB.DSN, "env overrides file")
+	assert.Equal(t, "from-file", cfg.Auth.JWTSecret)
+	assert.Equal(t, 2*time.Hour, cfg.Auth.TokenLifetime)
+	assert.Equal(t, []string{"http://flag.example", "https://*.flag.example"}, cfg.CORS.AllowedOrigins, "flag overrides env")
+	assert.Equal(t, 100, cfg.Limits.MaxPageSize, "default kept")
+}
+
+func TestLoad_ValidationErrors(t *testing.T) {
+	_, err := Load([]string{"-tls-cert", "server.pem", "-token-lifetime", "0s"}, envFrom(nil))
+	require.Error(t, err)
+	msg := err.Error()
+	assert.Contains(t, msg, "database DSN not set")
+	assert.Contains(t, msg, "JWT secret not set")
+	assert.Contains(t, msg, "tls.cert_file and tls.key_file must be set together")
+	assert.Contains(t, msg, "auth.token_lifetime must be positive")
+}
+
+func TestLoad_CORSValidation(t *testing.T) {
+	env := envFrom(map[string]string{"DB_DSN": "postgres://env", "JWT_SECRET_KEY": "s"})
+	_, err := Load([]string{"-cors-origins", " , "}, env)
+	assert.EqualError(t, err, "cors.allowed_origins must list at least one origin")
+
+	_, err = Load([]string{"-cors-origins", "*, *", "-cors-allow-credentials=true"}, env)
+	assert.EqualError(t, err, `cors.allowed_origins must not contain "*" when cors.allow_credentials is set`)
+}
+
+func TestLoad_BadValue(t *testing.T) {
+	_, err := Load(nil, envFrom(map[string]string{"DB_MAX_OPEN_CONNS": "many"}))
+	assert.EqualError(t, err, `DB_MAX_OPEN_CONNS: invalid integer "many"`)
+}
+
+func TestLoad_UnknownFileKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "amhs.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("listen: \":1\"\n"), 0o600))
+
+	_, err := Load([]string{"-config", path}, envFrom(nil))
+	assert.ErrorContains(t, err, "field listen not found")
+}
+
+func TestLoad_RelayPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "amhs.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+relay:
+  peers:
+    london-mta:
+      url: ftp://london.example
+    oslo-mta:
+      url: https://oslo.example
+      secret: s3cret
+      concurrency: 2
+`), 0o600))
+
+	env := envFrom(map[string]string{"DB_DSN": "postgres://env", "JWT_SECRET_KEY": "k"})
+	_, err := Load([]string{"-config", path}, env)
+	require.Error(t, err)
+	msg := err.Error()
+	assert.Contains(t, msg, "relay.name must be set when relay.peers are configured")
+	assert.Contains(t, msg, "relay.peers.london-mta.url must be an http or https URL")
+	assert.Contains(t, msg, "relay.peers.london-mta.secret must be set")
+	assert.NotContains(t, msg, "oslo-mta")
+
+	_, err = Load([]string{"-config", path, "-relay-name", "paris-mta"}, env)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "relay.name")
+}
+
+func TestLoad_SMTP(t *testing.T) {
+	env := envFrom(map[string]string{
+		"DB_DSN": "postgres://env", "JWT_SECRET_KEY": "k",
+		"SMTP_LISTEN": ":2526", "SMTP_RELAY": "mail.example.com:25", "SMTP_FROM": "AMHS <amhs@example.com>",
+	})
+	_, err := Load(nil, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "smtp.domains must be set when smtp.listen is")
+	assert.Contains(t, err.Error(), "smtp.from must be a plain email address")
+
+	cfg, err := Load([]string{"-smtp-domains", "amhs.example.com, ops.example.com", "-smtp-from", "amhs@example.com"}, env)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"amhs.example.com", "ops.example.com"}, cfg.SMTP.Domains)
+	assert.Equal(t, 30*time.Second, cfg.SMTP.ForwardInterval)
+}
+
+func TestLoad_OIDC(t *testing.T) {
+	env := envFrom(map[string]string{
+		"DB_DSN": "postgres://env", "JWT_SECRET_KEY": "k",
+		"OIDC_ISSUER": "http://127.0.0.1:9400", "OIDC_SCOPES": "profile",
+	})
+	_, err := Load(nil, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "oidc.redirect_url must be an http or https URL")
+	assert.Contains(t, err.Error(), "oidc.client_id must be set when oidc.issuer is")
+	assert.Contains(t, err.Error(), `oidc.scopes must include "openid"`)
+
+	_, err = Load([]string{"-oidc-disable-local-login=true"}, envFrom(map[string]string{"DB_DSN": "postgres://env", "JWT_SECRET_KEY": "k"}))
+	assert.EqualError(t, err, "oidc.disable_local_login requires oidc.issuer")
+
+	cfg, err := Load([]string{"-oidc-client-id", "amhs", "-oidc-redirect-url", "http://localhost:8080/api/auth/oidc/callback", "-oidc-scopes", "openid,groups"}, env)
+	require.NoError(t, err)
+	assert.True(t, cfg.OIDC.Enabled())
+	assert.Equal(t, []string{"openid", "groups"}, cfg.OIDC.Scopes)
+	assert.Equal(t, "preferred_username", cfg.OIDC.UsernameClaim)
+}
+
+func TestLoad_SigningAlg(t *testing.T) {
+	env := envFrom(map[string]string{"DB_DSN": "postgres://env"})
+	_, err := Load(nil, env)
+	assert.EqualError(t, err, "JWT secret not set (JWT_SECRET_KEY, -jwt-secret or auth.jwt_secret)")
+
+	_, err = Load([]string{"-jwt-signing-alg", "none", "-jwt-key-rotation", "5m"}, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `auth.signing_alg "none" is not supported`)
+	assert.Contains(t, err.Error(), "auth.key_rotation must be 0 or at least 1h")
+
+	// Asymmetric signing needs no secret.
+	cfg, err := Load([]string{"-jwt-signing-alg", "EdDSA", "-jwt-key-rotation", "168h"}, env)
+	require.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, cfg.Auth.KeyRotation)
+	assert.Equal(t, "mini-amhs", cfg.Auth.Issuer)
+}
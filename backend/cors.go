@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mini-amhs/config"
+)
+
+const (
+	corsAllowMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders = "Content-Type, Authorization, Idempotency-Key"
+	// corsExposeHeaders are response headers browser code may read.
+	corsExposeHeaders = "Idempotent-Replayed, Duplicate-Of, X-Checksum-SHA256"
+)
+
+// corsPolicy decides which browser origins may call the API.
+type corsPolicy struct {
+	anyOrigin   bool
+	exact       map[string]bool
+	suffixes    []originSuffix
+	credentials bool
+	maxAge      string
+}
+
+// originSuffix matches "scheme://*.example.com" style patterns: any host
+// with at least one extra label under the given domain.
+type originSuffix struct {
+	scheme string
+	domain string
+}
+
+func newCORSPolicy(cfg config.CORSConfig) *corsPolicy {
+	p := &corsPolicy{
+		exact:       map[string]bool{},
+		credentials: cfg.AllowCredentials,
+	}
+	if cfg.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+	for _, o := range cfg.AllowedOrigins {
+		o = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(o)), "/")
+		switch {
+		case o == "*":
+			p.anyOrigin = true
+		case strings.Contains(o, "://*."):
+			scheme, host, _ := strings.Cut(o, "://*.")
+			p.suffixes = append(p.suffixes, originSuffix{scheme: scheme, domain: "." + host})
+		case o != "":
+			p.exact[o] = true
+		}
+	}
+	return p
+}
+
+func (p *corsPolicy) allowed(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok {
+		return false
+	}
+	for _, s := range p.suffixes {
+		if scheme == s.scheme && strings.HasSuffix(host, s.domain) && len(host) > len(s.domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware applies the policy once for the whole API. Requests from
+// disallowed origins are rejected outright rather than merely left without
+// CORS headers, and preflights are answered here without reaching handlers.
+func corsMiddleware(p *corsPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" {
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !p.allowed(origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if p.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+		h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		if p.maxAge != "" {
+			h.Set("Access-Control-Max-Age", p.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-amhs/config"
+)
+
+func newTestCORSHandler(cfg config.CORSConfig) http.Handler {
+	return corsMiddleware(newCORSPolicy(cfg), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+}
+
+func TestCORSPolicy_Allowed(t *testing.T) {
+	p := newCORSPolicy(config.CORSConfig{
+		AllowedOrigins: []string{"http://localhost:3000", "https://*.example.com"},
+	})
+
+	assert.True(t, p.allowed("http://localhost:3000"))
+	assert.True(t, p.allowed("https://ops.example.com"))
+	assert.True(t, p.allowed("https://a.b.example.com"))
+	assert.False(t, p.allowed("https://example.com"))
+	assert.False(t, p.allowed("http://ops.example.com"))
+	assert.False(t, p.allowed("https://evil-example.com"))
+	assert.False(t, p.allowed("http://localhost:3001"))
+}
+
+func TestCORSMiddleware_Preflight(t *testing.T) {
+	handler := newTestCORSHandler(config.CORSConfig{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowCredentials: true,
+		MaxAge:           5 * time.Minute,
+	})
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/messages", nil)
+	req.Header.Set("Origin", "https://ops.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "https://ops.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "300", rr.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, rr.Header().Values("Vary"), "Origin")
+	assert.Empty(t, rr.Body.String(), "preflight must not reach the handler")
+}
+
+func TestCORSMiddleware_DisallowedOrigin(t *testing.T) {
+	handler := newTestCORSHandler(config.CORSConfig{AllowedOrigins: []string{"http://localhost:3000"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+	req.Header.Set("Origin", "https://attacker.test")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rr.Header().Values("Vary"), "Origin")
+}
+
+func TestCORSMiddleware_SimpleRequest(t *testing.T) {
+	handler := newTestCORSHandler(config.CORSConfig{AllowedOrigins: []string{"http://localhost:3000"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ok", rr.Body.String())
+	assert.Equal(t, "http://localhost:3000", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Credentials"))
+
+	// Same-origin and non-browser clients send no Origin and pass through.
+	req = httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+}
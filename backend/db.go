@@ -2,16 +2,44 @@ package main
 
 import (
 	"database/sql"
+
 	_ "github.com/lib/pq"
+
+	"mini-amhs/config"
 )
 
-func connectDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", dsn)
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so helpers can run
+// inside or outside a transaction.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func connectDB(cfg config.DBConfig) (*sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.DSN)
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 	if err := db.Ping(); err != nil {
 		return nil, err
 	}
 	return db, nil
 }
+
+// withTx runs fn in a transaction that is committed if fn returns nil and
+// rolled back otherwise.
+func withTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
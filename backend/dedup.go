@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	dedupFlag     = "flag"
+	dedupSuppress = "suppress"
+)
+
+// dedupLockClass namespaces the advisory locks taken per transmission
+// identifier, so that two copies arriving together cannot both miss each
+// other.
+const dedupLockClass = 0x44555045
+
+var (
+	// An AFTN address: location indicator, organisation and department.
+	originatorPattern = regexp.MustCompile(`^[A-Z]{8}$`)
+	// Filing time as DDHHMM.
+	filingTimePattern = regexp.MustCompile(`^(0[1-9]|[12][0-9]|3[01])([01][0-9]|2[0-3])[0-5][0-9]$`)
+	// Channel identifier followed by the channel sequence number.
+	channelSeqPattern = regexp.MustCompile(`^[A-Z]{3}[0-9]{3,4}$`)
+)
+
+// validateTransmissionID checks the optional transmission identifier,
+// which must be given in full or not at all.
+func (in *newMessage) validateTransmissionID() error {
+	in.Originator = strings.ToUpper(strings.TrimSpace(in.Originator))
+	in.FilingTime = strings.TrimSpace(in.FilingTime)
+	in.ChannelSeq = strings.ToUpper(strings.TrimSpace(in.ChannelSeq))
+	if in.Originator == "" && in.FilingTime == "" && in.ChannelSeq == "" {
+		return nil
+	}
+	if in.Originator == "" || in.FilingTime == "" || in.ChannelSeq == "" {
+		return errors.New("originator, filing_time and channel_seq must be given together")
+	}
+	if !originatorPattern.MatchString(in.Originator) {
+		return errors.New("originator must be an 8-letter AFTN address")
+	}
+	if !filingTimePattern.MatchString(in.FilingTime) {
+		return errors.New("filing_time must be DDHHMM")
+	}
+	if !channelSeqPattern.MatchString(in.ChannelSeq) {
+		return errors.New("channel_seq must be a 3-letter channel id and sequence number, e.g. ABC123")
+	}
+	return nil
+}
+
+// findDuplicate looks for an earlier message from the same sender to the
+// same receiver with the same transmission identifier inside the dedup
+// window. It locks the identifier until tx ends. One transmission
+// addressed to several stations is not a duplicate, and neither is a
+// message from another sender, whose original the caller must not see.
+func findDuplicate(tx *sql.Tx, sender string, in newMessage) (Message, bool, error) {
+	id := in.Originator + " " + in.FilingTime + " " + in.ChannelSeq + " " + sender + " " + in.Receiver
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2))`, dedupLockClass, id); err != nil {
+		return Message{}, false, err
+	}
+	msg, err := scanMessage(tx.QueryRow(
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE originator=$1 AND filing_time=$2 AND channel_seq=$3 AND sender=$4 AND receiver=$5
+		   AND created_at > NOW() - make_interval(secs => $6)
+		 ORDER BY id LIMIT 1`,
+		in.Originator, in.FilingTime, in.ChannelSeq, sender, in.Receiver, appConfig.Dedup.Window.Seconds(),
+	))
+	if err == sql.ErrNoRows {
+		return Message{}, false, nil
+	}
+	return msg, err == nil, err
+}
+
+func transmissionDetails(in newMessage) map[string]any {
+	return map[string]any{
+		"originator":  in.Originator,
+		"filing_time": in.FilingTime,
+		"channel_seq": in.ChannelSeq,
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMessage_ValidateTransmissionID(t *testing.T) {
+	in := newMessage{Receiver: "bob", Subject: "FPL", Body: "...", Originator: "eglxzpzx", FilingTime: "011030", ChannelSeq: "abc123"}
+	assert.NoError(t, in.validate())
+	assert.Equal(t, "EGLXZPZX", in.Originator)
+	assert.Equal(t, "ABC123", in.ChannelSeq)
+
+	in = newMessage{Receiver: "bob", Subject: "FPL", Body: "...", Originator: "EGLXZPZX"}
+	assert.EqualError(t, in.validate(), "originator, filing_time and channel_seq must be given together")
+
+	in = newMessage{Receiver: "bob", Subject: "FPL", Body: "...", Originator: "EGLXZPZX", FilingTime: "321030", ChannelSeq: "ABC123"}
+	assert.EqualError(t, in.validate(), "filing_time must be DDHHMM")
+}
+
+func TestSendMessage_Duplicate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	defer func(mode string) { appConfig.Dedup.Mode = mode }(appConfig.Dedup.Mode)
+
+	now := time.Now()
+	in := newMessage{Receiver: "bob", Subject: "FPL", Body: "(FPL-BAW123-IS", Priority: "FF", Originator: "EGLXZPZX", FilingTime: "011030", ChannelSeq: "ABC123"}
+	original := sqlmock.NewRows(messageColumnNames).AddRow(4, "gateway", "bob", "FPL", "(FPL-BAW123-IS", "FF", false, false, false, nil, nil, nil, 4, now, nil, now, nil, false, "EGLXZPZX", "011030", "ABC123", false, nil, "", "")
+	expectLookup := func() {
+		mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1, hashtext\(\$2\)\)`).
+			WithArgs(dedupLockClass, "EGLXZPZX 011030 ABC123 gateway bob").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SELECT .* FROM messages WHERE originator=\$1 AND filing_time=\$2 AND channel_seq=\$3 AND sender=\$4 AND receiver=\$5`).
+			WithArgs("EGLXZPZX", "011030", "ABC123", "gateway", "bob", sqlmock.AnyArg()).
+			WillReturnRows(original)
+	}
+
+	// Flag mode stores the copy, marked as a possible duplicate.
+	appConfig.Dedup.Mode = dedupFlag
+	mock.ExpectBegin()
+	expectLookup()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("gateway", "bob", "FPL", "(FPL-BAW123-IS", "FF", nil, nil, nil, nil, "EGLXZPZX", "011030", "ABC123", true, int64(4), "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(5, "gateway", "bob", "FPL", "(FPL-BAW123-IS", "FF", false, false, false, nil, nil, nil, 5, now, nil, now, nil, false, "EGLXZPZX", "011030", "ABC123", true, 4, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	msg, err := sendMessage(db, "gateway", in)
+	assert.NoError(t, err)
+	assert.True(t, msg.PossibleDuplicate)
+	assert.Equal(t, int64(4), *msg.DuplicateOf)
+
+	// Suppress mode stores nothing and hands back the original.
+	appConfig.Dedup.Mode = dedupSuppress
+	original = sqlmock.NewRows(messageColumnNames).AddRow(4, "gateway", "bob", "FPL", "(FPL-BAW123-IS", "FF", false, false, false, nil, nil, nil, 4, now, nil, now, nil, false, "EGLXZPZX", "011030", "ABC123", false, nil, "", "")
+	mock.ExpectBegin()
+	expectLookup()
+	expectAudit(mock, auditMessageDuplicate)
+	mock.ExpectCommit()
+
+	msg, err = sendMessage(db, "gateway", in)
+	assert.NoError(t, err)
+	assert.True(t, msg.Suppressed)
+	assert.Equal(t, int64(4), msg.ID)
+
+	// The same identifier from another sender is looked up among that
+	// sender's messages only, so it is stored as new.
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1, hashtext\(\$2\)\)`).
+		WithArgs(dedupLockClass, "EGLXZPZX 011030 ABC123 mallory bob").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE originator=\$1 AND filing_time=\$2 AND channel_seq=\$3 AND sender=\$4 AND receiver=\$5`).
+		WithArgs("EGLXZPZX", "011030", "ABC123", "mallory", "bob", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("mallory", "bob", "FPL", "(FPL-BAW123-IS", "FF", nil, nil, nil, nil, "EGLXZPZX", "011030", "ABC123", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(6, "mallory", "bob", "FPL", "(FPL-BAW123-IS", "FF", false, false, false, nil, nil, nil, 6, now, nil, now, nil, false, "EGLXZPZX", "011030", "ABC123", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	msg, err = sendMessage(db, "mallory", in)
+	assert.NoError(t, err)
+	assert.False(t, msg.Suppressed)
+	assert.Equal(t, int64(6), msg.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const directoryColumns = `id, username, aftn_address, organisation, location_indicator, display_name, updated_at`
+
+const (
+	directoryOpen   = "open"
+	directoryStrict = "strict"
+)
+
+// Search result bounds for GET /api/directory.
+const (
+	defaultDirectoryLimit = 20
+	maxDirectoryLimit     = 100
+)
+
+// maxDirectoryImportSize bounds the CSV accepted by one import.
+const maxDirectoryImportSize = 4 << 20
+
+// An ICAO location indicator, e.g. EGLL.
+var locationIndicatorPattern = regexp.MustCompile(`^[A-Z]{4}$`)
+
+var errUnknownRecipient = errors.New("unknown recipient")
+
+func scanDirectoryEntry(row rowScanner) (DirectoryEntry, error) {
+	var e DirectoryEntry
+	err := row.Scan(&e.ID, &e.Username, &e.AFTNAddress, &e.Organisation, &e.LocationIndicator, &e.DisplayName, &e.UpdatedAt)
+	return e, err
+}
+
+// normalize tidies an imported entry and checks it. The location indicator
+// defaults to the first four letters of the AFTN address.
+func (e *DirectoryEntry) normalize() error {
+	e.Username = strings.TrimSpace(e.Username)
+	e.AFTNAddress = strings.ToUpper(strings.TrimSpace(e.AFTNAddress))
+	e.Organisation = strings.TrimSpace(e.Organisation)
+	e.LocationIndicator = strings.ToUpper(strings.TrimSpace(e.LocationIndicator))
+	e.DisplayName = strings.TrimSpace(e.DisplayName)
+	if e.Username == "" {
+		return errors.New("username is required")
+	}
+	if strings.HasPrefix(e.Username, listAddressPrefix) {
+		return fmt.Errorf("username must not start with %q", listAddressPrefix)
+	}
+	if e.AFTNAddress != "" && !originatorPattern.MatchString(e.AFTNAddress) {
+		return errors.New("aftn_address must be an 8-letter AFTN address")
+	}
+	if e.LocationIndicator == "" && e.AFTNAddress != "" {
+		e.LocationIndicator = e.AFTNAddress[:4]
+	}
+	if e.LocationIndicator != "" && !locationIndicatorPattern.MatchString(e.LocationIndicator) {
+		return errors.New("location_indicator must be 4 letters")
+	}
+	if e.AFTNAddress != "" && !strings.HasPrefix(e.AFTNAddress, e.LocationIndicator) {
+		return errors.New("aftn_address must start with the location_indicator")
+	}
+	limits := appConfig.Limits
+	if len(e.Organisation) > limits.MaxSubjectLen || len(e.DisplayName) > limits.MaxSubjectLen {
+		return fmt.Errorf("organisation and display_name must be at most %d characters", limits.MaxSubjectLen)
+	}
+	return nil
+}
+
+// resolveRecipient maps a receiver to the mailbox that gets its traffic,
+// and the route it takes. A listed receiver is local, and an AFTN address
+// resolves to the username it is listed under. An unlisted AFTN address
+// takes the route with the longest matching prefix, unless it is also a
+// local username. name@server, as relayed senders are recorded, goes to
+// server when it is a relay peer, and is name when server is this one. In
+// strict mode a receiver must be listed or routed; in open mode anything
+// else is taken as a local username.
+func resolveRecipient(db dbtx, receiver string) (string, *Route, error) {
+	if i := strings.LastIndex(receiver, "@"); i >= 0 && appConfig.Relay.Name != "" {
+		server := receiver[i+1:]
+		if server == appConfig.Relay.Name {
+			receiver = receiver[:i]
+		} else if _, ok := appConfig.Relay.Peers[server]; ok {
+			return receiver, &Route{Pattern: "@" + server, NextHop: server}, nil
+		}
+	}
+	address := strings.ToUpper(receiver)
+	isAddress := originatorPattern.MatchString(address)
+	strict := appConfig.Directory.Recipients == directoryStrict
+	if receiver == "" || !isAddress && !strict {
+		return receiver, nil, nil
+	}
+	var username string
+	err := db.QueryRow(
+		`SELECT username FROM directory_entries WHERE username=$1 OR aftn_address=$2
+		 ORDER BY username=$1 DESC LIMIT 1`,
+		receiver, address,
+	).Scan(&username)
+	if err == nil {
+		return username, nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", nil, err
+	}
+	if isAddress {
+		// A local username of eight letters is not an address.
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username=$1)`, receiver).Scan(&exists); err != nil {
+			return "", nil, err
+		}
+		if exists {
+			return receiver, nil, nil
+		}
+		rt, ok, err := routeFor(db, address)
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			return address, &rt, nil
+		}
+	}
+	if strict {
+		return "", nil, fmt.Errorf("%w: %q", errUnknownRecipient, receiver)
+	}
+	return receiver, nil, nil
+}
+
+// directoryHandler serves GET /api/directory. q autocompletes on username,
+// AFTN address, location indicator and display name; filter takes an
+// LDAP-style filter (see compileFilter). Both may be combined.
+func directoryHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if limit < 1 || limit > maxDirectoryLimit {
+			limit = defaultDirectoryLimit
+		}
+
+		where := []string{"TRUE"}
+		var args []any
+		if f := strings.TrimSpace(query.Get("filter")); f != "" {
+			cond, fargs, err := compileFilter(f, len(args))
+			if err != nil {
+				http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			where = append(where, cond)
+			args = append(args, fargs...)
+		}
+		order := "username"
+		if q := strings.TrimSpace(query.Get("q")); q != "" {
+			prefix := escapeLike(q) + "%"
+			args = append(args, prefix, "%"+prefix)
+			n := len(args)
+			where = append(where, fmt.Sprintf(
+				`(username ILIKE $%[1]d OR aftn_address ILIKE $%[1]d OR location_indicator ILIKE $%[1]d
+				  OR display_name ILIKE $%[1]d OR display_name ILIKE $%[2]d)`, n-1, n))
+			// Usernames that start with q first, then the rest.
+			order = fmt.Sprintf("username ILIKE $%d DESC, username", n-1)
+		}
+		args = append(args, limit)
+
+		rows, err := db.Query(
+			`SELECT `+directoryColumns+` FROM directory_entries
+			 WHERE `+strings.Join(where, " AND ")+`
+			 ORDER BY `+order+`
+			 LIMIT $`+strconv.Itoa(len(args)),
+			args...,
+		)
+		if err != nil {
+			log.Println("directory query error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		entries := []DirectoryEntry{}
+		for rows.Next() {
+			e, err := scanDirectoryEntry(rows)
+			if err != nil {
+				log.Println("scan error:", err)
+				continue
+			}
+			entries = append(entries, e)
+		}
+		writeJSON(w, entries)
+	})
+}
+
+// getDirectoryEntryHandler serves GET /api/directory/{username}.
+func getDirectoryEntryHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, err := scanDirectoryEntry(db.QueryRow(
+			`SELECT `+directoryColumns+` FROM directory_entries WHERE username=$1`, r.PathValue("username"),
+		))
+		if err == sql.ErrNoRows {
+			http.Error(w, "entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("select directory entry error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, e)
+	})
+}
+
+// deleteDirectoryEntryHandler serves DELETE /api/directory/{username} for
+// admins.
+func deleteDirectoryEntryHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := getUsername(r.Context())
+		username := r.PathValue("username")
+		err := withTx(db, func(tx *sql.Tx) error {
+			var id int64
+			if err := tx.QueryRow(`DELETE FROM directory_entries WHERE username=$1 RETURNING id`, username).Scan(&id); err != nil {
+				return err
+			}
+			return appendAudit(tx, admin, auditDirectoryDelete, 0, map[string]any{"username": username})
+		})
+		if err == sql.ErrNoRows {
+			http.Error(w, "entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("delete directory entry error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// directoryImportError points at a CSV line that could not be imported.
+type directoryImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// readDirectoryCSV parses an import file. The header row names the
+// columns, using the same names as filters; only username is required.
+// Every bad line is reported, not just the first.
+func readDirectoryCSV(r io.Reader) ([]DirectoryEntry, []directoryImportError, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("empty file")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := make([]string, len(header))
+	hasUsername := false
+	for i, name := range header {
+		column, ok := directoryAttributes[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown column %q", name)
+		}
+		columns[i] = column
+		hasUsername = hasUsername || column == "username"
+	}
+	if !hasUsername {
+		return nil, nil, errors.New("a username column is required")
+	}
+
+	var entries []DirectoryEntry
+	var bad []directoryImportError
+	usernames := map[string]int{}
+	addresses := map[string]int{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				return nil, nil, err
+			}
+			bad = append(bad, directoryImportError{Line: perr.Line, Error: perr.Err.Error()})
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		var e DirectoryEntry
+		for i, v := range record {
+			switch columns[i] {
+			case "username":
+				e.Username = v
+			case "aftn_address":
+				e.AFTNAddress = v
+			case "organisation":
+				e.Organisation = v
+			case "location_indicator":
+				e.LocationIndicator = v
+			case "display_name":
+				e.DisplayName = v
+			}
+		}
+		if err := e.normalize(); err != nil {
+			bad = append(bad, directoryImportError{Line: line, Error: err.Error()})
+			continue
+		}
+		if first, ok := usernames[e.Username]; ok {
+			bad = append(bad, directoryImportError{Line: line, Error: fmt.Sprintf("username repeats line %d", first)})
+			continue
+		}
+		if first, ok := addresses[e.AFTNAddress]; ok && e.AFTNAddress != "" {
+			bad = append(bad, directoryImportError{Line: line, Error: fmt.Sprintf("aftn_address repeats line %d", first)})
+			continue
+		}
+		usernames[e.Username] = line
+		addresses[e.AFTNAddress] = line
+		entries = append(entries, e)
+	}
+	return entries, bad, nil
+}
+
+// importDirectoryHandler serves POST /api/directory/import for admins. The
+// body is a CSV file; entries are created or, by username, replaced. The
+// import is all or nothing: any bad line fails it with 422 and a list of
+// the problems.
+func importDirectoryHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin, _ := getUsername(r.Context())
+		r.Body = http.MaxBytesReader(w, r.Body, maxDirectoryImportSize)
+		entries, bad, err := readDirectoryCSV(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "invalid csv: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(bad) > 0 {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJSON(w, map[string]any{"errors": bad})
+			return
+		}
+
+		var created, updated int
+		err = withTx(db, func(tx *sql.Tx) error {
+			for _, e := range entries {
+				var inserted bool
+				err := tx.QueryRow(
+					`INSERT INTO directory_entries(username, aftn_address, organisation, location_indicator, display_name)
+					 VALUES($1,$2,$3,$4,$5)
+					 ON CONFLICT (username) DO UPDATE SET aftn_address=EXCLUDED.aftn_address,
+					   organisation=EXCLUDED.organisation, location_indicator=EXCLUDED.location_indicator,
+					   display_name=EXCLUDED.display_name, updated_at=NOW()
+					 RETURNING xmax = 0`,
+					e.Username, e.AFTNAddress, e.Organisation, e.LocationIndicator, e.DisplayName,
+				).Scan(&inserted)
+				if err != nil {
+					return err
+				}
+				if inserted {
+					created++
+				} else {
+					updated++
+				}
+			}
+			return appendAudit(tx, admin, auditDirectoryImport, 0, map[string]any{"created": created, "updated": updated})
+		})
+		if err != nil {
+			if strings.Contains(strings.ToLower(err.Error()), "unique") {
+				http.Error(w, "an aftn_address in the file is already listed under another username", http.StatusConflict)
+				return
+			}
+			log.Println("directory import error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]int{"created": created, "updated": updated})
+	})
+}
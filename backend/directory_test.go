@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var directoryColumnNames = []string{"id", "username", "aftn_address", "organisation", "location_indicator", "display_name", "updated_at"}
+
+func TestCompileFilter(t *testing.T) {
+	cond, args, err := compileFilter(`(&(o=NATS)(|(l=EGLL)(l=EGKK))(!(cn=*test*)))`, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, `((lower(organisation) = lower($1)) AND ((lower(location_indicator) = lower($2)) OR (lower(location_indicator) = lower($3))) AND NOT (display_name ILIKE $4))`, cond)
+	assert.Equal(t, []any{"NATS", "EGLL", "EGKK", "%test%"}, args)
+
+	cond, args, err = compileFilter(`(aftn=EG*)`, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, `(aftn_address ILIKE $3)`, cond)
+	assert.Equal(t, []any{"EG%"}, args)
+
+	// Presence, and escapes that would otherwise be wildcards.
+	cond, args, err = compileFilter(`(&(aftn=*)(cn=100\2a_off*))`, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, `((aftn_address <> '') AND (display_name ILIKE $1))`, cond)
+	assert.Equal(t, []any{`100*\_off%`}, args)
+
+	for _, bad := range []string{`o=NATS`, `(o=NATS`, `(&)`, `(title=x)`, `(l>=EG)`, `(o=NATS))`, `(cn=a\2)`, strings.Repeat("(!", 20) + "(o=x)" + strings.Repeat(")", 20)} {
+		_, _, err := compileFilter(bad, 0)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestReadDirectoryCSV(t *testing.T) {
+	entries, bad, err := readDirectoryCSV(strings.NewReader(
+		"username,aftn_address,o,display_name\n" +
+			"heathrow,egllzpzx,NATS,Heathrow Tower\n" +
+			"gatwick,EGKKZTZX,NATS,Gatwick Tower\n" +
+			",EGCCZTZX,NATS,\n" +
+			"luton,EGGWZT,NATS,Luton\n" +
+			"heathrow2,EGLLZPZX,NATS,Duplicate\n",
+	))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "EGLLZPZX", entries[0].AFTNAddress)
+	assert.Equal(t, "EGLL", entries[0].LocationIndicator)
+	assert.Equal(t, []directoryImportError{
+		{Line: 4, Error: "username is required"},
+		{Line: 5, Error: "aftn_address must be an 8-letter AFTN address"},
+		{Line: 6, Error: "aftn_address repeats line 2"},
+	}, bad)
+
+	_, _, err = readDirectoryCSV(strings.NewReader("aftn_address\nEGLLZPZX\n"))
+	assert.EqualError(t, err, "a username column is required")
+}
+
+func TestResolveRecipient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	defer func(mode string) { appConfig.Directory.Recipients = mode }(appConfig.Directory.Recipients)
+
+	// Open mode passes usernames through untouched.
+	appConfig.Directory.Recipients = directoryOpen
+	receiver, rt, err := resolveRecipient(db, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", receiver)
+	assert.Nil(t, rt)
+
+	// An AFTN address resolves to the user listed under it.
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("egllzpzx", "EGLLZPZX").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("heathrow"))
+	receiver, _, err = resolveRecipient(db, "egllzpzx")
+	assert.NoError(t, err)
+	assert.Equal(t, "heathrow", receiver)
+
+	// A local username that looks like an address stays local, whatever
+	// the default route.
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("operator", "OPERATOR").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE username=\$1\)`).
+		WithArgs("operator").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	receiver, rt, err = resolveRecipient(db, "operator")
+	assert.NoError(t, err)
+	assert.Equal(t, "operator", receiver)
+	assert.Nil(t, rt)
+
+	// Strict mode refuses receivers the directory does not know.
+	appConfig.Directory.Recipients = directoryStrict
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("mallory", "MALLORY").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	_, _, err = resolveRecipient(db, "mallory")
+	assert.EqualError(t, err, `unknown recipient: "mallory"`)
+
+	// A relayed sender goes back to its server; one of ours is local.
+	asRelayServer(t)
+	receiver, rt, err = resolveRecipient(db, "LFPGZTZX@paris-mta")
+	assert.NoError(t, err)
+	assert.Equal(t, "LFPGZTZX@paris-mta", receiver)
+	assert.Equal(t, &Route{Pattern: "@paris-mta", NextHop: "paris-mta"}, rt)
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("bob", "BOB").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("bob"))
+	receiver, rt, err = resolveRecipient(db, "bob@london-mta")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", receiver)
+	assert.Nil(t, rt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDirectoryHandler_Search(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT .* FROM directory_entries WHERE TRUE AND \(lower\(organisation\) = lower\(\$1\)\) AND \(username ILIKE \$2 .* LIMIT \$4`).
+		WithArgs("NATS", "heath%", "%heath%", 5).
+		WillReturnRows(sqlmock.NewRows(directoryColumnNames).AddRow(1, "heathrow", "EGLLZPZX", "NATS", "EGLL", "Heathrow Tower", time.Now()))
+	req, _ := http.NewRequest(http.MethodGet, "/api/directory?q=heath&filter=(o=NATS)&limit=5", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, "alice"))
+	rr := httptest.NewRecorder()
+	directoryHandler(db).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var entries []DirectoryEntry
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "EGLLZPZX", entries[0].AFTNAddress)
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/directory?filter=(o=NATS", nil)
+	rr = httptest.NewRecorder()
+	directoryHandler(db).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImportDirectoryHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	handler := importDirectoryHandler(db)
+	post := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/api/directory/import", strings.NewReader(body))
+		req = req.WithContext(withIdentity(req.Context(), "root", roleAdmin))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO directory_entries`).
+		WithArgs("heathrow", "EGLLZPZX", "NATS", "EGLL", "Heathrow Tower").
+		WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+	mock.ExpectQuery(`INSERT INTO directory_entries`).
+		WithArgs("gatwick", "EGKKZTZX", "NATS", "EGKK", "Gatwick Tower").
+		WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(false))
+	expectAudit(mock, auditDirectoryImport)
+	mock.ExpectCommit()
+	rr := post("username,aftn_address,organisation,display_name\nheathrow,EGLLZPZX,NATS,Heathrow Tower\ngatwick,EGKKZTZX,NATS,Gatwick Tower\n")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.JSONEq(t, `{"created": 1, "updated": 1}`, rr.Body.String())
+
+	// A bad line fails the whole import without touching the database.
+	rr = post("username,location_indicator\nheathrow,EGL\n")
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.JSONEq(t, `{"errors": [{"line": 2, "error": "location_indicator must be 4 letters"}]}`, rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
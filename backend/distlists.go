@@ -0,0 +1,432 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const distributionListColumns = `id, name, owner, description, members, created_at, updated_at`
+
+const listExpansionColumns = `id, list_id, list_name, sender, recipients, message_ids, created_at`
+
+// listAddressPrefix marks a receiver as the name of a distribution list
+// rather than a mailbox, e.g. "@met-offices".
+const listAddressPrefix = "@"
+
+// maxListMembers bounds how many messages one submission can fan out to.
+const maxListMembers = 500
+
+var listNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var (
+	errUnknownList = errors.New("unknown distribution list")
+	errEmptyList   = errors.New("distribution list has no members")
+)
+
+func scanDistributionList(row rowScanner) (DistributionList, error) {
+	var l DistributionList
+	var owner sql.NullString
+	err := row.Scan(&l.ID, &l.Name, &owner, &l.Description, pq.Array(&l.Members), &l.CreatedAt, &l.UpdatedAt)
+	l.Owner = owner.String
+	l.Global = !owner.Valid
+	return l, err
+}
+
+func scanListExpansion(row rowScanner) (ListExpansion, error) {
+	var e ListExpansion
+	var listID sql.NullInt64
+	err := row.Scan(&e.ID, &listID, &e.List, &e.Sender, pq.Array(&e.Recipients), pq.Array(&e.MessageIDs), &e.CreatedAt)
+	if listID.Valid {
+		e.ListID = &listID.Int64
+	}
+	return e, err
+}
+
+// distributionListInput is the body of list create and update requests.
+// Global only matters on create: a list keeps its scope for life.
+type distributionListInput struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []string `json:"members"`
+	Global      bool     `json:"global"`
+}
+
+func (in *distributionListInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	in.Description = strings.TrimSpace(in.Description)
+	if !listNamePattern.MatchString(in.Name) {
+		return errors.New("name must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+	if len(in.Description) > appConfig.Limits.MaxSubjectLen {
+		return fmt.Errorf("description exceeds maximum length of %d characters", appConfig.Limits.MaxSubjectLen)
+	}
+	seen := map[string]bool{}
+	var members []string
+	for _, m := range in.Members {
+		m = strings.TrimSpace(m)
+		if m == "" || seen[m] {
+			continue
+		}
+		if strings.HasPrefix(m, listAddressPrefix) {
+			return errors.New("lists cannot contain other lists")
+		}
+		seen[m] = true
+		members = append(members, m)
+	}
+	if len(members) == 0 {
+		return errors.New("members are required")
+	}
+	if len(members) > maxListMembers {
+		return fmt.Errorf("a list can have at most %d members", maxListMembers)
+	}
+	in.Members = members
+	return nil
+}
+
+// canManageList reports whether the caller may change or delete l.
+func canManageList(l DistributionList, username, role string) bool {
+	if l.Global {
+		return role == roleAdmin
+	}
+	return l.Owner == username
+}
+
+// resolveListAddress returns the list a receiver names, if it names one.
+// The sender's own list wins over a global list of the same name.
+func resolveListAddress(db dbtx, sender, receiver string) (DistributionList, bool, error) {
+	name, ok := strings.CutPrefix(receiver, listAddressPrefix)
+	if !ok {
+		return DistributionList{}, false, nil
+	}
+	l, err := scanDistributionList(db.QueryRow(
+		`SELECT `+distributionListColumns+` FROM distribution_lists
+		 WHERE lower(name)=lower($1) AND (owner=$2 OR owner IS NULL)
+		 ORDER BY owner IS NULL LIMIT 1`,
+		name, sender,
+	))
+	if err == sql.ErrNoRows {
+		return l, false, fmt.Errorf("%w: %q", errUnknownList, name)
+	}
+	if err != nil {
+		return l, false, err
+	}
+	if len(l.Members) == 0 {
+		return l, false, fmt.Errorf("%w: %q", errEmptyList, name)
+	}
+	return l, true, nil
+}
+
+// submission is a validated POST /api/messages: one message, or one per
+// member when it is addressed to a distribution list.
+type submission struct {
+	List     *DistributionList
+	Messages []newMessage
+}
+
+// prepareSubmission expands a list address into one message per member
+// and resolves and routes each receiver. Each copy gets its own
+// attachment files, so that the copies can be deleted and purged
+// independently.
+func prepareSubmission(db *sql.DB, store attachmentStore, sender string, in newMessage) (submission, error) {
+	l, ok, err := resolveListAddress(db, sender, in.Receiver)
+	if err != nil {
+		return submission{Messages: []newMessage{in}}, err
+	}
+	if !ok {
+		receiver, rt, err := resolveRecipient(db, in.Receiver)
+		if err != nil {
+			return submission{Messages: []newMessage{in}}, err
+		}
+		in.Receiver, in.Route = receiver, rt
+		return submission{Messages: []newMessage{in}}, nil
+	}
+	sub := submission{List: &l}
+	for i, member := range l.Members {
+		m := in
+		m.Receiver, m.Route, err = resolveRecipient(db, member)
+		if err != nil {
+			sub.discardCopies(store)
+			return submission{Messages: []newMessage{in}}, err
+		}
+		m.DistributionList = l.Name
+		if i > 0 && len(in.Attachments) > 0 {
+			m.Attachments, err = copyAttachments(store, in.Attachments)
+			if err != nil {
+				sub.discardCopies(store)
+				return submission{Messages: []newMessage{in}}, err
+			}
+		}
+		sub.Messages = append(sub.Messages, m)
+	}
+	return sub, nil
+}
+
+// discardCopies removes the attachment files made for list members beyond
+// the first, whose files are the uploaded originals.
+func (s submission) discardCopies(store attachmentStore) {
+	for _, m := range s.Messages[min(1, len(s.Messages)):] {
+		discardAttachments(store, m.Attachments)
+	}
+}
+
+// discard removes every attachment file of the submission.
+func (s submission) discard(store attachmentStore) {
+	for _, m := range s.Messages {
+		discardAttachments(store, m.Attachments)
+	}
+}
+
+// sendToListTx sends one message per member of sub.List and records the
+// expansion. Members whose copy is suppressed as a duplicate still count
+// as recipients, but no new message is listed for them.
+func sendToListTx(tx *sql.Tx, sender string, sub submission) (ListExpansion, []Message, error) {
+	exp := ListExpansion{ListID: &sub.List.ID, List: sub.List.Name, Sender: sender, Recipients: []string{}, MessageIDs: []int64{}}
+	var sent []Message
+	for _, in := range sub.Messages {
+		msg, err := sendMessageTx(tx, sender, in)
+		if err != nil {
+			return exp, nil, err
+		}
+		exp.Recipients = append(exp.Recipients, in.Receiver)
+		if !msg.Suppressed {
+			exp.MessageIDs = append(exp.MessageIDs, msg.ID)
+			exp.Messages = append(exp.Messages, msg)
+		}
+		sent = append(sent, msg)
+	}
+	err := tx.QueryRow(
+		`INSERT INTO list_expansions(list_id, list_name, sender, recipients, message_ids)
+		 VALUES($1,$2,$3,$4,$5) RETURNING id, created_at`,
+		sub.List.ID, sub.List.Name, sender, pq.Array(exp.Recipients), pq.Array(exp.MessageIDs),
+	).Scan(&exp.ID, &exp.CreatedAt)
+	return exp, sent, err
+}
+
+// attachDistributions fills in Distribution for those of sender's messages
+// that were sent through a distribution list.
+func attachDistributions(db dbtx, sender string, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	rows, err := db.Query(
+		`SELECT `+listExpansionColumns+` FROM list_expansions WHERE sender=$1 AND message_ids && $2`,
+		sender, pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	byMessage := map[int64]*ListExpansion{}
+	for rows.Next() {
+		e, err := scanListExpansion(rows)
+		if err != nil {
+			return err
+		}
+		for _, id := range e.MessageIDs {
+			byMessage[id] = &e
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Distribution = byMessage[messages[i].ID]
+	}
+	return nil
+}
+
+// distributionListsHandler serves GET and POST /api/distribution-lists.
+// GET lists the caller's own lists followed by the global ones.
+func distributionListsHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query(
+				`SELECT `+distributionListColumns+` FROM distribution_lists
+				 WHERE owner=$1 OR owner IS NULL
+				 ORDER BY owner IS NULL, lower(name)`,
+				username,
+			)
+			if err != nil {
+				log.Println("select distribution lists error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			lists := []DistributionList{}
+			for rows.Next() {
+				l, err := scanDistributionList(rows)
+				if err != nil {
+					log.Println("scan error:", err)
+					continue
+				}
+				lists = append(lists, l)
+			}
+			writeJSON(w, lists)
+
+		case http.MethodPost:
+			var in distributionListInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			if err := in.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			owner := sql.NullString{String: username, Valid: true}
+			if in.Global {
+				if getRole(r.Context()) != roleAdmin {
+					http.Error(w, "only admins can manage global lists", http.StatusForbidden)
+					return
+				}
+				owner = sql.NullString{}
+			}
+			l, err := scanDistributionList(db.QueryRow(
+				`INSERT INTO distribution_lists(name, owner, description, members)
+				 VALUES($1,$2,$3,$4)
+				 RETURNING `+distributionListColumns,
+				in.Name, owner, in.Description, pq.Array(in.Members),
+			))
+			if err != nil {
+				if strings.Contains(strings.ToLower(err.Error()), "unique") {
+					http.Error(w, "a list with that name already exists", http.StatusConflict)
+					return
+				}
+				log.Println("insert distribution list error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, l)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// loadDistributionList loads the list named by the {id} path value if the
+// caller can see it, answering the request itself otherwise.
+func loadDistributionList(db *sql.DB, w http.ResponseWriter, r *http.Request) (DistributionList, string, bool) {
+	username, ok := getUsername(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return DistributionList{}, "", false
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "invalid list id", http.StatusBadRequest)
+		return DistributionList{}, "", false
+	}
+	l, err := scanDistributionList(db.QueryRow(
+		`SELECT `+distributionListColumns+` FROM distribution_lists WHERE id=$1 AND (owner=$2 OR owner IS NULL)`,
+		id, username,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "list not found", http.StatusNotFound)
+		return l, "", false
+	}
+	if err != nil {
+		log.Println("select distribution list error:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return l, "", false
+	}
+	return l, username, true
+}
+
+// getDistributionListHandler serves GET /api/distribution-lists/{id}.
+func getDistributionListHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, _, ok := loadDistributionList(db, w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, l)
+	})
+}
+
+// updateDistributionListHandler serves PUT /api/distribution-lists/{id},
+// replacing the name, description and members.
+func updateDistributionListHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, username, ok := loadDistributionList(db, w, r)
+		if !ok {
+			return
+		}
+		if !canManageList(l, username, getRole(r.Context())) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var in distributionListInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if err := in.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l, err := scanDistributionList(db.QueryRow(
+			`UPDATE distribution_lists SET name=$1, description=$2, members=$3, updated_at=NOW()
+			 WHERE id=$4
+			 RETURNING `+distributionListColumns,
+			in.Name, in.Description, pq.Array(in.Members), l.ID,
+		))
+		if err == sql.ErrNoRows {
+			http.Error(w, "list not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			if strings.Contains(strings.ToLower(err.Error()), "unique") {
+				http.Error(w, "a list with that name already exists", http.StatusConflict)
+				return
+			}
+			log.Println("update distribution list error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, l)
+	})
+}
+
+// deleteDistributionListHandler serves DELETE /api/distribution-lists/{id}.
+// Recorded expansions keep the list's name and members.
+func deleteDistributionListHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, username, ok := loadDistributionList(db, w, r)
+		if !ok {
+			return
+		}
+		if !canManageList(l, username, getRole(r.Context())) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM distribution_lists WHERE id=$1`, l.ID); err != nil {
+			log.Println("delete distribution list error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var distributionListColumnNames = []string{"id", "name", "owner", "description", "members", "created_at", "updated_at"}
+
+var listExpansionColumnNames = []string{"id", "list_id", "list_name", "sender", "recipients", "message_ids", "created_at"}
+
+func TestDistributionListInput_Validate(t *testing.T) {
+	in := distributionListInput{Name: " met-offices ", Members: []string{"bob", " carol", "bob", ""}}
+	assert.NoError(t, in.validate())
+	assert.Equal(t, "met-offices", in.Name)
+	assert.Equal(t, []string{"bob", "carol"}, in.Members)
+
+	in = distributionListInput{Name: "met offices", Members: []string{"bob"}}
+	assert.Error(t, in.validate())
+
+	in = distributionListInput{Name: "all", Members: []string{"bob", "@met-offices"}}
+	assert.EqualError(t, in.validate(), "lists cannot contain other lists")
+
+	in = distributionListInput{Name: "empty"}
+	assert.EqualError(t, in.validate(), "members are required")
+}
+
+func TestMessagesHandler_DistributionList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	handler := messagesHandler(db, nil)
+	now := time.Now()
+
+	mock.ExpectQuery(`SELECT .* FROM distribution_lists WHERE lower\(name\)=lower\(\$1\)`).
+		WithArgs("met-offices", "alice").
+		WillReturnRows(sqlmock.NewRows(distributionListColumnNames).AddRow(2, "met-offices", nil, "", "{bob,carol}", now, now))
+	mock.ExpectBegin()
+	for i, member := range []string{"bob", "carol"} {
+		id := int64(10 + i)
+		mock.ExpectQuery(`INSERT INTO messages`).
+			WithArgs("alice", member, "METAR", "EGLL 011020Z", "GG", nil, nil, nil, nil, "", "", "", false, nil, "", "").
+			WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(id, "alice", member, "METAR", "EGLL 011020Z", "GG", false, false, false, nil, nil, nil, id, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+		expectAudit(mock, auditMessageSend)
+	}
+	mock.ExpectQuery(`INSERT INTO list_expansions`).
+		WithArgs(int64(2), "met-offices", "alice", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(4, now))
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/messages", strings.NewReader(`{"receiver":"@met-offices","subject":"METAR","body":"EGLL 011020Z"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, "alice"))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var exp ListExpansion
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &exp))
+	assert.Equal(t, "met-offices", exp.List)
+	assert.Equal(t, []string{"bob", "carol"}, exp.Recipients)
+	assert.Equal(t, []int64{10, 11}, exp.MessageIDs)
+	assert.Len(t, exp.Messages, 2)
+
+	// Unknown lists are the client's mistake.
+	mock.ExpectQuery(`SELECT .* FROM distribution_lists`).
+		WithArgs("nobody", "alice").
+		WillReturnRows(sqlmock.NewRows(distributionListColumnNames))
+	req, _ = http.NewRequest(http.MethodPost, "/api/messages", strings.NewReader(`{"receiver":"@nobody","subject":"METAR","body":"EGLL 011020Z"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, "alice"))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "unknown distribution list: \"nobody\"\n", rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSendToListTx_SuppressedCopy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	defer func(mode string) { appConfig.Dedup.Mode = mode }(appConfig.Dedup.Mode)
+	appConfig.Dedup.Mode = dedupSuppress
+	now := time.Now()
+
+	l := DistributionList{ID: 2, Name: "met-offices", Members: []string{"bob", "carol"}}
+	in := newMessage{Subject: "METAR", Body: "EGLL 011020Z", Priority: "GG", Originator: "EGLLYMYX", FilingTime: "011020", ChannelSeq: "MET001"}
+	sub := submission{List: &l}
+	for _, member := range l.Members {
+		m := in
+		m.Receiver = member
+		sub.Messages = append(sub.Messages, m)
+	}
+
+	mock.ExpectBegin()
+	// bob already has this transmission from alice.
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE originator=\$1`).
+		WithArgs("EGLLYMYX", "011020", "MET001", "alice", "bob", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "METAR", "EGLL 011020Z", "GG", false, false, false, nil, nil, nil, 7, now, nil, now, nil, false, "EGLLYMYX", "011020", "MET001", false, nil, "", ""))
+	expectAudit(mock, auditMessageDuplicate)
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE originator=\$1`).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(11, "alice", "carol", "METAR", "EGLL 011020Z", "GG", false, false, false, nil, nil, nil, 11, now, nil, now, nil, false, "EGLLYMYX", "011020", "MET001", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectQuery(`INSERT INTO list_expansions`).
+		WithArgs(int64(2), "met-offices", "alice", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, now))
+	mock.ExpectCommit()
+
+	var exp ListExpansion
+	var sent []Message
+	err = withTx(db, func(tx *sql.Tx) error {
+		var err error
+		exp, sent, err = sendToListTx(tx, "alice", sub)
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob", "carol"}, exp.Recipients)
+	assert.Equal(t, []int64{11}, exp.MessageIDs)
+	// The suppressed original is not part of the response.
+	require.Len(t, exp.Messages, 1)
+	assert.Equal(t, "carol", exp.Messages[0].Receiver)
+	assert.Len(t, sent, 2)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDistributionListsHandler_GlobalNeedsAdmin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	handler := distributionListsHandler(db)
+	body := `{"name":"met-offices","members":["bob","carol"],"global":true}`
+	now := time.Now()
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/distribution-lists", strings.NewReader(body))
+	req = req.WithContext(withIdentity(req.Context(), "alice", roleUser))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	mock.ExpectQuery(`INSERT INTO distribution_lists`).
+		WithArgs("met-offices", sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(distributionListColumnNames).AddRow(2, "met-offices", nil, "", "{bob,carol}", now, now))
+	req, _ = http.NewRequest(http.MethodPost, "/api/distribution-lists", strings.NewReader(body))
+	req = req.WithContext(withIdentity(req.Context(), "root", roleAdmin))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var l DistributionList
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &l))
+	assert.True(t, l.Global)
+	assert.Equal(t, []string{"bob", "carol"}, l.Members)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateDistributionListHandler_Forbidden(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+
+	// Everyone can see a global list, but only admins can change it.
+	mock.ExpectQuery(`SELECT .* FROM distribution_lists WHERE id=\$1`).
+		WithArgs(int64(2), "alice").
+		WillReturnRows(sqlmock.NewRows(distributionListColumnNames).AddRow(2, "met-offices", nil, "", "{bob,carol}", now, now))
+	req, _ := http.NewRequest(http.MethodPut, "/api/distribution-lists/2", strings.NewReader(`{"name":"met-offices","members":["alice"]}`))
+	req.SetPathValue("id", "2")
+	req = req.WithContext(withIdentity(req.Context(), "alice", roleUser))
+	rr := httptest.NewRecorder()
+	updateDistributionListHandler(db).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
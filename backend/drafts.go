@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const draftColumns = `id, owner, receiver, subject, body, priority, version, created_at, updated_at`
+
+var errDraftConflict = errors.New("draft version conflict")
+
+func scanDraft(row rowScanner) (Draft, error) {
+	var d Draft
+	err := row.Scan(&d.ID, &d.Owner, &d.Receiver, &d.Subject, &d.Body, &d.Priority, &d.Version, &d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+// draftInput is the body of draft create, update and send requests.
+// Version is the version the client last saw; it is required on update.
+type draftInput struct {
+	Receiver string `json:"receiver"`
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+	Priority string `json:"priority"`
+	Version  int    `json:"version"`
+}
+
+// validate checks only what a half-written message must already satisfy:
+// drafts may have empty fields, but not oversized ones. The full checks run
+// when the draft is sent.
+func (in *draftInput) validate() error {
+	in.Priority = strings.ToUpper(strings.TrimSpace(in.Priority))
+	if in.Priority != "" && !slices.Contains(messagePriorities, in.Priority) {
+		return fmt.Errorf("priority must be one of %s", strings.Join(messagePriorities, ", "))
+	}
+	limits := appConfig.Limits
+	if len(in.Subject) > limits.MaxSubjectLen {
+		return fmt.Errorf("subject exceeds maximum length of %d characters", limits.MaxSubjectLen)
+	}
+	if len(in.Body) > limits.MaxBodyLen {
+		return fmt.Errorf("body exceeds maximum length of %d characters", limits.MaxBodyLen)
+	}
+	return nil
+}
+
+// draftsHandler serves GET and POST /api/drafts for the caller's drafts.
+func draftsHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query(`SELECT `+draftColumns+` FROM drafts WHERE owner=$1 ORDER BY updated_at DESC`, username)
+			if err != nil {
+				log.Println("select drafts error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			drafts := []Draft{}
+			for rows.Next() {
+				d, err := scanDraft(rows)
+				if err != nil {
+					log.Println("scan error:", err)
+					continue
+				}
+				drafts = append(drafts, d)
+			}
+			writeJSON(w, drafts)
+
+		case http.MethodPost:
+			var in draftInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			if err := in.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			d, err := scanDraft(db.QueryRow(
+				`INSERT INTO drafts(owner, receiver, subject, body, priority)
+				 VALUES($1,$2,$3,$4,$5)
+				 RETURNING `+draftColumns,
+				username, in.Receiver, in.Subject, in.Body, in.Priority,
+			))
+			if err != nil {
+				log.Println("insert draft error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, d)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// draftID parses the {id} path value, answering 400 when it is invalid.
+func draftID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "invalid draft id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// getDraftHandler serves GET /api/drafts/{id}.
+func getDraftHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, ok := draftID(w, r)
+		if !ok {
+			return
+		}
+		d, err := scanDraft(db.QueryRow(`SELECT `+draftColumns+` FROM drafts WHERE id=$1 AND owner=$2`, id, username))
+		if err == sql.ErrNoRows {
+			http.Error(w, "draft not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("select draft error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, d)
+	})
+}
+
+// updateDraftHandler serves PUT /api/drafts/{id}. The save only applies if
+// version matches the stored one; otherwise the client gets 409 and must
+// reload the draft before saving again.
+func updateDraftHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, ok := draftID(w, r)
+		if !ok {
+			return
+		}
+		var in draftInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if in.Version < 1 {
+			http.Error(w, "version is required", http.StatusBadRequest)
+			return
+		}
+		if err := in.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		d, err := scanDraft(db.QueryRow(
+			`UPDATE drafts SET receiver=$1, subject=$2, body=$3, priority=$4, version=version+1, updated_at=NOW()
+			 WHERE id=$5 AND owner=$6 AND version=$7
+			 RETURNING `+draftColumns,
+			in.Receiver, in.Subject, in.Body, in.Priority, id, username, in.Version,
+		))
+		if err == sql.ErrNoRows {
+			draftMissOrConflict(db, w, id, username)
+			return
+		}
+		if err != nil {
+			log.Println("update draft error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, d)
+	})
+}
+
+// draftMissOrConflict explains why a versioned write matched no row.
+func draftMissOrConflict(db *sql.DB, w http.ResponseWriter, id int64, username string) {
+	var version int
+	err := db.QueryRow(`SELECT version FROM drafts WHERE id=$1 AND owner=$2`, id, username).Scan(&version)
+	if err == sql.ErrNoRows {
+		http.Error(w, "draft not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("select draft error:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, fmt.Sprintf("draft was changed elsewhere; current version is %d", version), http.StatusConflict)
+}
+
+// deleteDraftHandler serves DELETE /api/drafts/{id}.
+func deleteDraftHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, ok := draftID(w, r)
+		if !ok {
+			return
+		}
+		res, err := db.Exec(`DELETE FROM drafts WHERE id=$1 AND owner=$2`, id, username)
+		if err != nil {
+			log.Println("delete draft error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "draft not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// sendDraftHandler serves POST /api/drafts/{id}/send. The draft goes
+// through the same validation, list expansion and routing as POST
+// /api/messages, and the message is stored and the draft removed in one
+// transaction. An optional version in the body guards against sending a
+// copy older than the one on screen.
+func sendDraftHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, ok := draftID(w, r)
+		if !ok {
+			return
+		}
+		var in struct {
+			Version int `json:"version"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+		}
+
+		d, err := scanDraft(db.QueryRow(`SELECT `+draftColumns+` FROM drafts WHERE id=$1 AND owner=$2`, id, username))
+		if err == sql.ErrNoRows {
+			http.Error(w, "draft not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("load draft error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if in.Version != 0 && in.Version != d.Version {
+			http.Error(w, "draft was changed elsewhere; reload before sending", http.StatusConflict)
+			return
+		}
+		nm := newMessage{Receiver: d.Receiver, Subject: d.Subject, Body: d.Body, Priority: d.Priority}
+		if err := nm.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub, err := prepareSubmission(db, nil, username, nm)
+		if errors.Is(err, errUnknownList) || errors.Is(err, errEmptyList) || errors.Is(err, errUnknownRecipient) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("resolve receiver error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		var resp any
+		var sent []Message
+		err = withTx(db, func(tx *sql.Tx) error {
+			// Removing the version that was expanded also keeps a
+			// concurrent send or edit from going through twice.
+			res, err := tx.Exec(`DELETE FROM drafts WHERE id=$1 AND version=$2`, d.ID, d.Version)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return errDraftConflict
+			}
+			resp, sent, err = submitTx(tx, username, sub)
+			return err
+		})
+		switch {
+		case err == errDraftConflict:
+			http.Error(w, "draft was changed elsewhere; reload before sending", http.StatusConflict)
+		case err != nil:
+			log.Println("send draft error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+		default:
+			notifySent(sent)
+			writeJSON(w, resp)
+		}
+	})
+}
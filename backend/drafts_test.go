@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var draftColumnNames = []string{"id", "owner", "receiver", "subject", "body", "priority", "version", "created_at", "updated_at"}
+
+func TestUpdateDraftHandler_VersionConflict(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Another tab already saved version 3.
+	mock.ExpectQuery(`UPDATE drafts SET .* WHERE id=\$5 AND owner=\$6 AND version=\$7`).
+		WithArgs("bob", "Long NOTAM", "draft text", "GG", int64(4), "alice", 2).
+		WillReturnRows(sqlmock.NewRows(draftColumnNames))
+	mock.ExpectQuery(`SELECT version FROM drafts WHERE id=\$1 AND owner=\$2`).
+		WithArgs(int64(4), "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(3))
+
+	rr := httptest.NewRecorder()
+	req := newMessageRequest("PUT", "alice", "4", `{"receiver":"bob","subject":"Long NOTAM","body":"draft text","priority":"gg","version":2}`)
+	updateDraftHandler(db).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "current version is 3")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSendDraftHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+
+	mock.ExpectQuery(`SELECT .* FROM drafts WHERE id=\$1 AND owner=\$2`).
+		WithArgs(int64(4), "alice").
+		WillReturnRows(sqlmock.NewRows(draftColumnNames).AddRow(4, "alice", "bob", " Long NOTAM ", "draft text", "", 3, now, now))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM drafts WHERE id=\$1 AND version=\$2`).
+		WithArgs(int64(4), 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("alice", "bob", "Long NOTAM", "draft text", "GG", nil, nil, nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(9, "alice", "bob", "Long NOTAM", "draft text", "GG", false, false, false, nil, nil, nil, 9, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	sendDraftHandler(db).ServeHTTP(rr, newMessageRequest("POST", "alice", "4", `{"version":3}`))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"id": 9`)
+
+	// An incomplete draft fails validation and stays a draft.
+	mock.ExpectQuery(`SELECT .* FROM drafts WHERE id=\$1 AND owner=\$2`).
+		WithArgs(int64(5), "alice").
+		WillReturnRows(sqlmock.NewRows(draftColumnNames).AddRow(5, "alice", "", "half", "", "", 1, now, now))
+
+	rr = httptest.NewRecorder()
+	sendDraftHandler(db).ServeHTTP(rr, newMessageRequest("POST", "alice", "5", ""))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Edited in another tab after it was loaded.
+	mock.ExpectQuery(`SELECT .* FROM drafts WHERE id=\$1 AND owner=\$2`).
+		WithArgs(int64(4), "alice").
+		WillReturnRows(sqlmock.NewRows(draftColumnNames).AddRow(4, "alice", "bob", "Long NOTAM", "draft text", "", 3, now, now))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM drafts WHERE id=\$1 AND version=\$2`).
+		WithArgs(int64(4), 3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	rr = httptest.NewRecorder()
+	sendDraftHandler(db).ServeHTTP(rr, newMessageRequest("POST", "alice", "4", ""))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSendDraftHandler_DistributionList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+
+	mock.ExpectQuery(`SELECT .* FROM drafts WHERE id=\$1 AND owner=\$2`).
+		WithArgs(int64(6), "alice").
+		WillReturnRows(sqlmock.NewRows(draftColumnNames).AddRow(6, "alice", "@met-offices", "METAR", "EGLL 011020Z", "", 1, now, now))
+	mock.ExpectQuery(`SELECT .* FROM distribution_lists WHERE lower\(name\)=lower\(\$1\)`).
+		WithArgs("met-offices", "alice").
+		WillReturnRows(sqlmock.NewRows(distributionListColumnNames).AddRow(2, "met-offices", nil, "", "{bob,carol}", now, now))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM drafts WHERE id=\$1 AND version=\$2`).
+		WithArgs(int64(6), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for i, member := range []string{"bob", "carol"} {
+		id := int64(10 + i)
+		mock.ExpectQuery(`INSERT INTO messages`).
+			WithArgs("alice", member, "METAR", "EGLL 011020Z", "GG", nil, nil, nil, nil, "", "", "", false, nil, "", "").
+			WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(id, "alice", member, "METAR", "EGLL 011020Z", "GG", false, false, false, nil, nil, nil, id, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+		expectAudit(mock, auditMessageSend)
+	}
+	mock.ExpectQuery(`INSERT INTO list_expansions`).
+		WithArgs(int64(2), "met-offices", "alice", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(4, now))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	sendDraftHandler(db).ServeHTTP(rr, newMessageRequest("POST", "alice", "6", ""))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var exp ListExpansion
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &exp))
+	assert.Equal(t, []int64{10, 11}, exp.MessageIDs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types pushed to /api/events subscribers.
+const (
+	eventMessageCreated   = "message.created"
+	eventMessageDelivered = "message.delivered"
+	eventMessageRead      = "message.read"
+	eventReportNDR        = "report.ndr"
+)
+
+// Event is one server-sent event for a single user.
+type Event struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// eventHub fans events out to the open event streams of each user. Slow
+// subscribers miss events rather than block the publisher. Observers see
+// every event, whoever it is for.
+type eventHub struct {
+	mu        sync.Mutex
+	subs      map[string]map[chan Event]struct{}
+	observers []func(username string, ev Event)
+	closed    bool
+}
+
+var events = newEventHub()
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[string]map[chan Event]struct{}{}}
+}
+
+// subscribe registers a stream for username. The returned func must be
+// called when the stream ends.
+func (h *eventHub) subscribe(username string) (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subs[username] == nil {
+		h.subs[username] = map[chan Event]struct{}{}
+	}
+	h.subs[username][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[username], ch)
+		if len(h.subs[username]) == 0 {
+			delete(h.subs, username)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// close ends every open stream so that server shutdown is not held up by
+// long-lived event connections.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, chans := range h.subs {
+		for ch := range chans {
+			close(ch)
+		}
+	}
+	h.subs = map[string]map[chan Event]struct{}{}
+}
+
+// observe registers fn to be called with every published event. fn is
+// called with the hub locked and must not block.
+func (h *eventHub) observe(fn func(username string, ev Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observers = append(h.observers, fn)
+}
+
+func (h *eventHub) publish(username string, ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, fn := range h.observers {
+		fn(username, ev)
+	}
+	for ch := range h.subs[username] {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("event stream for %s is full, dropping %s", username, ev.Type)
+		}
+	}
+}
+
+// notifyDelivered tells the receiver about a message that just became
+// visible to them.
+func notifyDelivered(msg Message) {
+	if msg.DeliveredAt == nil {
+		return
+	}
+	events.publish(msg.Receiver, Event{Type: eventMessageCreated, Data: msg})
+}
+
+// notifyRead tells senders that their messages have been read.
+func notifyRead(msgs ...Message) {
+	for _, msg := range msgs {
+		events.publish(msg.Sender, Event{Type: eventMessageRead, Data: msg})
+	}
+}
+
+// eventsHandler serves GET /api/events, a server-sent event stream of the
+// caller's events.
+func eventsHandler(hub *eventHub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rc := http.NewResponseController(w)
+
+		ch, cancel := hub.subscribe(username)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			log.Println("event stream error:", err)
+			return
+		}
+
+		heartbeat := time.NewTicker(30 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case ev, ok := <-ch:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(ev.Data)
+				if err != nil {
+					log.Println("event encode error:", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
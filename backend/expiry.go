@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// systemMailbox is the sender of notices generated by the server itself.
+const systemMailbox = "system"
+
+// nonDeliveryBody explains to the sender why msg was not delivered.
+func nonDeliveryBody(msg Message) string {
+	return fmt.Sprintf("Your message to %s was not read before its latest delivery time (%s) and has expired.\n\nSubject: %s\nSent: %s",
+		msg.Receiver, msg.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"), msg.Subject, msg.CreatedAt.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+// sendNonDeliveryTx sends the sender of msg a non-delivery notice from
+// system, threaded under msg. It goes back the way msg came: a relayed
+// sender or an AFTN originator is routed like any receiver, and a sender
+// the directory does not list still gets it in their local mailbox.
+func sendNonDeliveryTx(tx *sql.Tx, msg Message, body string) (Message, error) {
+	receiver, rt, err := resolveRecipient(tx, msg.Sender)
+	if errors.Is(err, errUnknownRecipient) {
+		receiver, rt = msg.Sender, nil
+	} else if err != nil {
+		return Message{}, err
+	}
+	return sendMessageTx(tx, systemMailbox, newMessage{
+		Receiver:  receiver,
+		Subject:   prefixSubject("Non-delivery:", msg.Subject),
+		Body:      body,
+		Priority:  msg.Priority,
+		InReplyTo: &msg.ID,
+		ThreadID:  &msg.ThreadID,
+		Route:     rt,
+	})
+}
+
+// sendNonDeliveryReports finds messages that expired unread and sends each
+// sender one non-delivery notice, threaded under the original. Each message
+// is reported at most once. Messages already relayed to another server are
+// that server's to report.
+func sendNonDeliveryReports(db *sql.DB, now time.Time) ([]Message, error) {
+	var expired, notices []Message
+	err := withTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`UPDATE messages SET ndn_sent_at=NOW()
+			 WHERE expires_at <= $1 AND NOT is_read AND ndn_sent_at IS NULL AND (next_hop = '' OR delivered_at IS NULL)
+			 RETURNING `+messageColumns,
+			now,
+		)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			m, err := scanMessage(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			expired = append(expired, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, m := range expired {
+			notice, err := sendNonDeliveryTx(tx, m, nonDeliveryBody(m))
+			if err != nil {
+				return err
+			}
+			notices = append(notices, notice)
+			if err := appendAudit(tx, auditSystemActor, auditMessageExpire, m.ID, map[string]any{"notice_id": notice.ID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range expired {
+		notifyDelivered(notices[i])
+		events.publish(m.Sender, Event{Type: eventReportNDR, Data: m})
+	}
+	return expired, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendNonDeliveryReports(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	sentAt := now.Add(-time.Hour)
+	expiresAt := now.Add(-time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE messages SET ndn_sent_at=NOW\(\) WHERE expires_at <= \$1 AND NOT is_read AND ndn_sent_at IS NULL AND \(next_hop = '' OR delivered_at IS NULL\) RETURNING`).
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "Slot", "CTOT 1030", "FF", false, false, false, nil, nil, nil, 7, sentAt, nil, sentAt, expiresAt, true, "", "", "", false, nil, "", ""))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs(systemMailbox, "alice", "Non-delivery: Slot", sqlmock.AnyArg(), "FF", int64(7), int64(7), nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(8, systemMailbox, "alice", "Non-delivery: Slot", "...", "FF", false, false, false, nil, nil, 7, 7, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	expectAudit(mock, auditMessageExpire)
+	mock.ExpectCommit()
+
+	aliceEvents, stop := events.subscribe("alice")
+	defer stop()
+
+	expired, err := sendNonDeliveryReports(db, now)
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, eventMessageCreated, (<-aliceEvents).Type)
+	assert.Equal(t, eventReportNDR, (<-aliceEvents).Type)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSendNonDeliveryReports_RelayedSender(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	asRelayServer(t)
+
+	now := time.Now()
+	sentAt := now.Add(-time.Hour)
+	expiresAt := now.Add(-time.Minute)
+
+	// The notice goes back to the server the message came from.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE messages SET ndn_sent_at=NOW\(\)`).
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice@paris-mta", "bob", "Slot", "CTOT 1030", "FF", false, false, false, nil, nil, nil, 7, sentAt, nil, sentAt, expiresAt, true, "", "", "", false, nil, "", ""))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs(systemMailbox, "alice@paris-mta", "Non-delivery: Slot", sqlmock.AnyArg(), "FF", int64(7), int64(7), nil, nil, "", "", "", false, nil, "@paris-mta", "paris-mta").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(8, systemMailbox, "alice@paris-mta", "Non-delivery: Slot", "...", "FF", false, false, false, nil, nil, 7, 7, now, nil, nil, nil, false, "", "", "", false, nil, "@paris-mta", "paris-mta"))
+	mock.ExpectExec(`INSERT INTO outbound_queue`).
+		WithArgs(int64(8), "paris-mta", nil, []byte("[]")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectAudit(mock, auditMessageSend)
+	expectAudit(mock, auditMessageExpire)
+	mock.ExpectCommit()
+
+	expired, err := sendNonDeliveryReports(db, now)
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -3,29 +3,254 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
 	"math"
+	"mime"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lib/pq"
 )
 
+// messageColumns lists the columns scanned by scanMessage, in order. A
+// message that starts a conversation is its own thread.
+const messageColumns = `id, sender, receiver, subject, body, priority, is_read, receiver_archived, sender_archived, receiver_deleted_at, sender_deleted_at, in_reply_to, COALESCE(thread_id, id), created_at, deliver_at, delivered_at, expires_at, COALESCE(NOT is_read AND expires_at <= NOW(), FALSE), originator, filing_time, channel_seq, possible_duplicate, duplicate_of, route, next_hop`
+
+// receiverVisible is true for messages the receiver may see: deferred
+// messages stay hidden until the scheduler delivers them.
+const receiverVisible = `delivered_at IS NOT NULL`
+
+// notExpiredUnread is true unless a message expired before it was read;
+// those are left out of the inbox unless asked for.
+const notExpiredUnread = `(is_read OR expires_at IS NULL OR expires_at > NOW())`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row rowScanner) (Message, error) {
+	var m Message
+	err := row.Scan(&m.ID, &m.Sender, &m.Receiver, &m.Subject, &m.Body, &m.Priority, &m.IsRead, &m.ReceiverArchived, &m.SenderArchived, &m.ReceiverDeletedAt, &m.SenderDeletedAt, &m.InReplyTo, &m.ThreadID, &m.CreatedAt, &m.DeliverAt, &m.DeliveredAt, &m.ExpiresAt, &m.Expired, &m.Originator, &m.FilingTime, &m.ChannelSeq, &m.PossibleDuplicate, &m.DuplicateOf, &m.Route, &m.NextHop)
+	return m, err
+}
+
+// newMessage is a message being composed, before it is stored.
+type newMessage struct {
+	Receiver string `json:"receiver"`
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+	Priority string `json:"priority"`
+	// DeliverAt defers delivery to the receiver until the given time.
+	DeliverAt *time.Time `json:"deliver_at"`
+	// ExpiresAt is the latest delivery time; unread by then, the sender
+	// gets a non-delivery notice.
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Transmission identifier supplied by gateways, used to spot
+	// redelivered telegrams.
+	Originator string `json:"originator"`
+	FilingTime string `json:"filing_time"`
+	ChannelSeq string `json:"channel_seq"`
+
+	// Set by reply and forward, never taken from client JSON.
+	InReplyTo *int64 `json:"-"`
+	ThreadID  *int64 `json:"-"`
+	// Set by the duplicate check.
+	DuplicateOf *int64 `json:"-"`
+	// Set when the message is one copy of a distribution list submission.
+	DistributionList string `json:"-"`
+	// Set by routing; nil for local delivery without a matching route.
+	Route *Route `json:"-"`
+	// Set for messages received from a peer: the servers it came through.
+	Trace []relayHop `json:"-"`
+
+	// Already written to the attachment store by a multipart upload.
+	Attachments []Attachment `json:"-"`
+}
+
+// validate normalises the fields and checks them against the configured
+// limits. The error text is meant for the client.
+func (in *newMessage) validate() error {
+	in.Receiver = strings.TrimSpace(in.Receiver)
+	in.Subject = strings.TrimSpace(in.Subject)
+	in.Body = strings.TrimSpace(in.Body)
+	if in.Receiver == "" || in.Subject == "" || in.Body == "" {
+		return errors.New("missing fields")
+	}
+	in.Priority = strings.ToUpper(strings.TrimSpace(in.Priority))
+	if in.Priority == "" {
+		in.Priority = defaultPriority
+	}
+	if !slices.Contains(messagePriorities, in.Priority) {
+		return fmt.Errorf("priority must be one of %s", strings.Join(messagePriorities, ", "))
+	}
+
+	limits := appConfig.Limits
+	if len(in.Subject) > limits.MaxSubjectLen {
+		return fmt.Errorf("subject exceeds maximum length of %d characters", limits.MaxSubjectLen)
+	}
+	if len(in.Body) > limits.MaxBodyLen {
+		return fmt.Errorf("body exceeds maximum length of %d characters", limits.MaxBodyLen)
+	}
+	if in.DeliverAt != nil && !in.DeliverAt.After(time.Now()) {
+		return errors.New("deliver_at must be in the future")
+	}
+	if in.ExpiresAt != nil {
+		if !in.ExpiresAt.After(time.Now()) {
+			return errors.New("expires_at must be in the future")
+		}
+		if in.DeliverAt != nil && !in.ExpiresAt.After(*in.DeliverAt) {
+			return errors.New("expires_at must be after deliver_at")
+		}
+	}
+	return in.validateTransmissionID()
+}
+
+func insertMessage(db dbtx, sender string, in newMessage) (Message, error) {
+	var route, nextHop string
+	if in.Route != nil {
+		route, nextHop = in.Route.Pattern, in.Route.NextHop
+	}
+	// Traffic for another MTA is not delivered here; it waits for relay.
+	return scanMessage(db.QueryRow(
+		`INSERT INTO messages(sender, receiver, subject, body, priority, in_reply_to, thread_id, deliver_at, delivered_at, expires_at,
+		                      originator, filing_time, channel_seq, possible_duplicate, duplicate_of, route, next_hop)
+		 VALUES($1,$2,$3,$4,$5,$6,$7,$8, CASE WHEN $8::timestamptz IS NULL AND $16 = '' THEN NOW() END, $9, $10,$11,$12,$13,$14,$15,$16)
+		 RETURNING `+messageColumns,
+		sender, in.Receiver, in.Subject, in.Body, in.Priority, in.InReplyTo, in.ThreadID, in.DeliverAt, in.ExpiresAt,
+		in.Originator, in.FilingTime, in.ChannelSeq, in.DuplicateOf != nil, in.DuplicateOf, route, nextHop,
+	))
+}
+
+// sendMessage stores a validated message and records it in the audit log
+// in one transaction.
+func sendMessage(db *sql.DB, sender string, in newMessage) (Message, error) {
+	var msg Message
+	err := withTx(db, func(tx *sql.Tx) error {
+		var err error
+		msg, err = sendMessageTx(tx, sender, in)
+		return err
+	})
+	if err == nil && !msg.Suppressed {
+		notifyDelivered(msg)
+	}
+	return msg, err
+}
+
+// sendMessageTx is sendMessage inside a caller's transaction, for callers
+// that must change other rows atomically with the send. A message that
+// repeats an earlier transmission of the same sender is flagged, or in
+// suppress mode not stored at all: the sender's earlier message is
+// returned with Suppressed set.
+func sendMessageTx(tx *sql.Tx, sender string, in newMessage) (Message, error) {
+	if in.Originator != "" {
+		orig, found, err := findDuplicate(tx, sender, in)
+		if err != nil {
+			return Message{}, err
+		}
+		if found {
+			if appConfig.Dedup.Mode == dedupSuppress {
+				orig.Suppressed = true
+				return orig, appendAudit(tx, sender, auditMessageDuplicate, orig.ID, transmissionDetails(in))
+			}
+			in.DuplicateOf = &orig.ID
+		}
+	}
+
+	msg, err := insertMessage(tx, sender, in)
+	if err != nil {
+		return msg, err
+	}
+	if msg.NextHop != "" {
+		if err := enqueueRelay(tx, msg, in.Trace); err != nil {
+			return msg, err
+		}
+	}
+	details := map[string]any{
+		"receiver": msg.Receiver,
+		"subject":  msg.Subject,
+		"priority": msg.Priority,
+	}
+	if msg.DeliverAt != nil {
+		details["deliver_at"] = msg.DeliverAt
+	}
+	if msg.ExpiresAt != nil {
+		details["expires_at"] = msg.ExpiresAt
+	}
+	if msg.Originator != "" {
+		maps.Copy(details, transmissionDetails(in))
+	}
+	if msg.DuplicateOf != nil {
+		details["duplicate_of"] = *msg.DuplicateOf
+	}
+	if in.DistributionList != "" {
+		details["distribution_list"] = in.DistributionList
+	}
+	if msg.Route != "" {
+		details["route"] = msg.Route
+		details["next_hop"] = msg.NextHop
+	}
+	if len(in.Attachments) > 0 {
+		var files []map[string]any
+		for _, a := range in.Attachments {
+			att, err := insertAttachment(tx, msg.ID, a)
+			if err != nil {
+				return msg, err
+			}
+			msg.Attachments = append(msg.Attachments, att)
+			files = append(files, map[string]any{"filename": att.Filename, "size": att.Size, "sha256": att.SHA256})
+		}
+		details["attachments"] = files
+	}
+	return msg, appendAudit(tx, sender, auditMessageSend, msg.ID, details)
+}
+
+// submitTx sends a submission inside tx. The response is the message, or
+// for a distribution list the recorded expansion; sent holds the messages
+// in the order of sub.Messages.
+func submitTx(tx *sql.Tx, sender string, sub submission) (response any, sent []Message, err error) {
+	if sub.List != nil {
+		return sendToListTx(tx, sender, sub)
+	}
+	msg, err := sendMessageTx(tx, sender, sub.Messages[0])
+	return msg, []Message{msg}, err
+}
+
+// submit is submitTx in a transaction of its own.
+func submit(db *sql.DB, sender string, sub submission) (response any, sent []Message, err error) {
+	err = withTx(db, func(tx *sql.Tx) error {
+		var err error
+		response, sent, err = submitTx(tx, sender, sub)
+		return err
+	})
+	if err == nil {
+		notifySent(sent)
+	}
+	return response, sent, err
+}
+
+// notifySent announces the messages a submission actually stored.
+func notifySent(sent []Message) {
+	for _, msg := range sent {
+		if !msg.Suppressed {
+			notifyDelivered(msg)
+		}
+	}
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-	setCORS(w, r)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
 
-func messagesHandler(db *sql.DB) http.Handler {
+func messagesHandler(db *sql.DB, store attachmentStore) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			setCORS(w, r)
-			if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
 		username, ok := getUsername(r.Context())
 		if !ok {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
@@ -34,49 +259,99 @@ func messagesHandler(db *sql.DB) http.Handler {
 
 		switch r.Method {
 		case http.MethodPost:
-			var in struct {
-				Receiver string `json:"receiver"`
-				Subject  string `json:"subject"`
-				Body     string `json:"body"`
+			key, err := idempotencyKey(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			var in newMessage
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType == "multipart/form-data" {
+				limits := appConfig.Attachments
+				r.Body = http.MaxBytesReader(w, r.Body, int64(limits.MaxSize)*int64(limits.MaxCount+1)+maxFormFieldLen*4)
+				in, err = readMultipartMessage(r, store)
+				var uerr *uploadError
+				if errors.As(err, &uerr) {
+					http.Error(w, uerr.Msg, uerr.Status)
+					return
+				}
+				if err != nil {
+					log.Println("attachment upload error:", err)
+					http.Error(w, "storage error", http.StatusInternalServerError)
+					return
+				}
+			} else if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 				http.Error(w, "invalid json", http.StatusBadRequest)
 				return
 			}
-
-			in.Receiver = strings.TrimSpace(in.Receiver)
-			in.Subject = strings.TrimSpace(in.Subject)
-			in.Body = strings.TrimSpace(in.Body)
-			if in.Receiver == "" || in.Subject == "" || in.Body == "" {
-				http.Error(w, "missing fields", http.StatusBadRequest)
+			if err := in.validate(); err != nil {
+				discardAttachments(store, in.Attachments)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			// Add length validation
-			const maxSubjectLen = 255
-			const maxBodyLen = 10000
-			if len(in.Subject) > maxSubjectLen {
-				http.Error(w, "subject exceeds maximum length of 255 characters", http.StatusBadRequest)
+			// A retried submission gets the original response instead of
+			// a second message.
+			hash := requestHash(in)
+			if key != "" {
+				rec, found, err := lookupIdempotent(db, username, key, appConfig.Idempotency.Window)
+				if err != nil {
+					discardAttachments(store, in.Attachments)
+					log.Println("idempotency lookup error:", err)
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				if found {
+					discardAttachments(store, in.Attachments)
+					replayIdempotent(w, rec, hash)
+					return
+				}
+			}
+
+			sub, err := prepareSubmission(db, store, username, in)
+			if errors.Is(err, errUnknownList) || errors.Is(err, errEmptyList) || errors.Is(err, errUnknownRecipient) {
+				discardAttachments(store, in.Attachments)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			if len(in.Body) > maxBodyLen {
-				http.Error(w, "body exceeds maximum length of 10000 characters", http.StatusBadRequest)
+			if err != nil {
+				discardAttachments(store, in.Attachments)
+				log.Println("resolve receiver error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
 
-			var msg Message
-			err := db.QueryRow(
-				`INSERT INTO messages(sender, receiver, subject, body)
-				 VALUES($1,$2,$3,$4)
-				 RETURNING id, sender, receiver, subject, body, is_read, receiver_archived, sender_archived, created_at`,
-				username, in.Receiver, in.Subject, in.Body,
-			).Scan(&msg.ID, &msg.Sender, &msg.Receiver, &msg.Subject, &msg.Body, &msg.IsRead, &msg.ReceiverArchived, &msg.SenderArchived, &msg.CreatedAt)
+			var resp any
+			var sent []Message
+			var replay *idempotencyRecord
+			if key != "" {
+				resp, sent, replay, err = submitIdempotent(db, username, key, hash, sub)
+			} else {
+				resp, sent, err = submit(db, username, sub)
+			}
+			if err != nil || replay != nil {
+				sub.discard(store)
+			}
 			if err != nil {
 				log.Println("insert error:", err)
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
-			writeJSON(w, msg)
+			if replay != nil {
+				replayIdempotent(w, *replay, hash)
+				return
+			}
+			// A suppressed duplicate stored nothing, so its files are not
+			// referenced by any message.
+			for i, msg := range sent {
+				if msg.Suppressed {
+					discardAttachments(store, sub.Messages[i].Attachments)
+					if sub.List == nil {
+						w.Header().Set("Duplicate-Of", strconv.FormatInt(msg.ID, 10))
+					}
+				}
+			}
+			writeJSON(w, resp)
 
 		case http.MethodGet:
 			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
@@ -84,20 +359,35 @@ func messagesHandler(db *sql.DB) http.Handler {
 				page = 1
 			}
 			pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
-			if pageSize < 1 || pageSize > 100 {
-				pageSize = 25
+			if pageSize < 1 || pageSize > appConfig.Limits.MaxPageSize {
+				pageSize = appConfig.Limits.DefaultPageSize
 			}
 			archived := r.URL.Query().Get("archived") == "true"
 			sent := r.URL.Query().Get("sent") == "true"
+			trash := r.URL.Query().Get("trash") == "true"
+			expired := r.URL.Query().Get("expired") == "true"
 
-			var totalItems int64
-			var countQuery string
+			side := "receiver"
 			if sent {
-				countQuery = `SELECT COUNT(*) FROM messages WHERE sender=$1 AND sender_archived=$2`
-			} else {
-				countQuery = `SELECT COUNT(*) FROM messages WHERE receiver=$1 AND receiver_archived=$2`
+				side = "sender"
+			}
+			// The trash holds the caller's deleted copies regardless of
+			// their archive state; other folders never show them.
+			filter := side + "=$1 AND " + side + "_archived=$2 AND " + side + "_deleted_at IS NULL"
+			args := []any{username, archived}
+			if trash {
+				filter = side + "=$1 AND " + side + "_deleted_at IS NOT NULL"
+				args = []any{username}
 			}
-			if err := db.QueryRow(countQuery, username, archived).Scan(&totalItems); err != nil {
+			if !sent {
+				filter += " AND " + receiverVisible
+				if !trash && !expired {
+					filter += " AND " + notExpiredUnread
+				}
+			}
+
+			var totalItems int64
+			if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE `+filter, args...).Scan(&totalItems); err != nil {
 				log.Println("count query error:", err)
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
@@ -106,23 +396,12 @@ func messagesHandler(db *sql.DB) http.Handler {
 			totalPages := int(math.Ceil(float64(totalItems) / float64(pageSize)))
 			offset := (page - 1) * pageSize
 
-			var rows *sql.Rows
-			var err error
-			var selectQuery string
-			if sent {
-				selectQuery = `SELECT id, sender, receiver, subject, body, is_read, receiver_archived, sender_archived, created_at
-					 FROM messages
-					 WHERE sender=$1 AND sender_archived=$2
-					 ORDER BY created_at DESC
-					 LIMIT $3 OFFSET $4`
-			} else {
-				selectQuery = `SELECT id, sender, receiver, subject, body, is_read, receiver_archived, sender_archived, created_at
-					 FROM messages
-					 WHERE receiver=$1 AND receiver_archived=$2
-					 ORDER BY created_at DESC
-					 LIMIT $3 OFFSET $4`
-			}
-			rows, err = db.Query(selectQuery, username, archived, pageSize, offset)
+			selectQuery := `SELECT ` + messageColumns + `
+				 FROM messages
+				 WHERE ` + filter + `
+				 ORDER BY created_at DESC
+				 LIMIT $` + strconv.Itoa(len(args)+1) + ` OFFSET $` + strconv.Itoa(len(args)+2)
+			rows, err := db.Query(selectQuery, append(args, pageSize, offset)...)
 			if err != nil {
 				log.Println("select query error:", err)
 				http.Error(w, "db error", http.StatusInternalServerError)
@@ -132,13 +411,20 @@ func messagesHandler(db *sql.DB) http.Handler {
 
 			var messages []Message
 			for rows.Next() {
-				var m Message
-				if err := rows.Scan(&m.ID, &m.Sender, &m.Receiver, &m.Subject, &m.Body, &m.IsRead, &m.ReceiverArchived, &m.SenderArchived, &m.CreatedAt); err != nil {
+				m, err := scanMessage(rows)
+				if err != nil {
 					log.Println("scan error:", err)
 					continue
 				}
 				messages = append(messages, m)
 			}
+			if sent {
+				if err := attachDistributions(db, username, messages); err != nil {
+					log.Println("select list expansions error:", err)
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+			}
 
 			response := PaginatedMessagesResponse{
 				Data: messages,
@@ -202,16 +488,50 @@ func messagesHandler(db *sql.DB) http.Handler {
 				userColumn = "sender"
 			}
 			q += " WHERE " + userColumn + "=$" + strconv.Itoa(idx) + " AND id = ANY($" + strconv.Itoa(idx+1) + ")"
+			if !in.Sent {
+				q += " AND " + receiverVisible
+			}
+			q += " RETURNING id"
 			args = append(args, username, pq.Array(in.IDs))
 
-			res, err := db.Exec(q, args...)
+			var ids, unread []int64
+			err := withTx(db, func(tx *sql.Tx) error {
+				var err error
+				// Only messages read for the first time are announced.
+				if in.IsRead != nil && *in.IsRead {
+					unread, err = queryIDs(tx,
+						`SELECT id FROM messages WHERE receiver=$1 AND id = ANY($2) AND NOT is_read AND `+receiverVisible+` FOR UPDATE`,
+						username, pq.Array(in.IDs))
+					if err != nil {
+						return err
+					}
+				}
+				ids, err = queryIDs(tx, q, args...)
+				if err != nil {
+					return err
+				}
+				for _, id := range ids {
+					if err := auditFlagChanges(tx, username, id, in.IsRead, in.IsArchived); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
 			if err != nil {
 				log.Println("update error:", err)
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
-			n, _ := res.RowsAffected()
-			writeJSON(w, map[string]any{"updated": n})
+			if len(unread) > 0 {
+				read, err := queryMessages(db, `SELECT `+messageColumns+` FROM messages WHERE id = ANY($1)`, pq.Array(unread))
+				if err != nil {
+					log.Println("read notification error:", err)
+				}
+				for _, msg := range read {
+					notifyRead(msg)
+				}
+			}
+			writeJSON(w, map[string]any{"updated": len(ids)})
 
 		case http.MethodDelete:
 			var in struct {
@@ -232,14 +552,32 @@ func messagesHandler(db *sql.DB) http.Handler {
 				userColumn = "sender"
 			}
 
-			query := "DELETE FROM messages WHERE " + userColumn + "=$1 AND id = ANY($2)"
-			res, err := db.Exec(query, username, pq.Array(in.IDs))
+			// Only the caller's copy goes to the trash; the other party's
+			// view of the shared row is untouched.
+			query := "UPDATE messages SET " + userColumn + "_deleted_at=NOW() WHERE " + userColumn + "=$1 AND id = ANY($2) AND " + userColumn + "_deleted_at IS NULL"
+			if !in.Sent {
+				query += " AND " + receiverVisible
+			}
+			query += " RETURNING id"
+			var n int
+			err := withTx(db, func(tx *sql.Tx) error {
+				ids, err := queryIDs(tx, query, username, pq.Array(in.IDs))
+				if err != nil {
+					return err
+				}
+				n = len(ids)
+				for _, id := range ids {
+					if err := appendAudit(tx, username, auditMessageDelete, id, nil); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
 			if err != nil {
 				log.Println("delete error:", err)
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
-			n, _ := res.RowsAffected()
 			writeJSON(w, map[string]any{"deleted": n})
 
 		default:
@@ -247,3 +585,246 @@ func messagesHandler(db *sql.DB) http.Handler {
 		}
 	})
 }
+
+// loadOwnedMessage fetches the message named by the {id} path value and
+// checks that the caller is its sender or receiver. On failure it writes
+// the error response and returns ok=false.
+func loadOwnedMessage(db *sql.DB, w http.ResponseWriter, r *http.Request) (msg Message, username string, ok bool) {
+	username, ok = getUsername(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return Message{}, "", false
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return Message{}, "", false
+	}
+
+	msg, err = scanMessage(db.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return Message{}, "", false
+	}
+	if err != nil {
+		log.Println("select message error:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return Message{}, "", false
+	}
+	if msg.Sender != username && msg.Receiver != username {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return Message{}, "", false
+	}
+	// A deferred message does not exist for its receiver yet.
+	if msg.Sender != username && msg.DeliveredAt == nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return Message{}, "", false
+	}
+	return msg, username, true
+}
+
+// getMessageHandler serves GET /api/messages/{id}.
+func getMessageHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, username, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+		atts, err := loadAttachments(db, msg.ID)
+		if err != nil {
+			log.Println("select attachments error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		msg.Attachments = atts
+		if msg.Sender == username {
+			messages := []Message{msg}
+			if err := attachDistributions(db, username, messages); err != nil {
+				log.Println("select list expansions error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			msg = messages[0]
+		}
+		writeJSON(w, msg)
+	})
+}
+
+// updateMessageHandler serves PATCH /api/messages/{id}. Archiving applies
+// to the caller's own copy; only the receiver may change the read flag.
+func updateMessageHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, username, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+
+		var in struct {
+			IsRead     *bool `json:"is_read"`
+			IsArchived *bool `json:"is_archived"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if in.IsRead == nil && in.IsArchived == nil {
+			http.Error(w, "no update fields provided", http.StatusBadRequest)
+			return
+		}
+		isReceiver := msg.Receiver == username
+		isSender := msg.Sender == username
+		if in.IsRead != nil && !isReceiver {
+			http.Error(w, "only the receiver can change read status", http.StatusForbidden)
+			return
+		}
+
+		sets := []string{}
+		args := []any{}
+		if in.IsRead != nil {
+			args = append(args, *in.IsRead)
+			sets = append(sets, "is_read=$"+strconv.Itoa(len(args)))
+		}
+		if in.IsArchived != nil {
+			if isReceiver {
+				args = append(args, *in.IsArchived)
+				sets = append(sets, "receiver_archived=$"+strconv.Itoa(len(args)))
+			}
+			if isSender {
+				args = append(args, *in.IsArchived)
+				sets = append(sets, "sender_archived=$"+strconv.Itoa(len(args)))
+			}
+		}
+		args = append(args, msg.ID)
+		q := "UPDATE messages SET " + strings.Join(sets, ", ") + " WHERE id=$" + strconv.Itoa(len(args)) + " RETURNING " + messageColumns
+
+		var updated Message
+		err := withTx(db, func(tx *sql.Tx) error {
+			var err error
+			updated, err = scanMessage(tx.QueryRow(q, args...))
+			if err != nil {
+				return err
+			}
+			return auditFlagChanges(tx, username, msg.ID, in.IsRead, in.IsArchived)
+		})
+		if err != nil {
+			log.Println("update message error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !msg.IsRead && updated.IsRead {
+			notifyRead(updated)
+		}
+		writeJSON(w, updated)
+	})
+}
+
+// deleteMessageHandler serves DELETE /api/messages/{id}. It moves the
+// caller's copy to the trash.
+func deleteMessageHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, username, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+		if err := setDeleted(db, msg, username, true); err != nil {
+			log.Println("delete message error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// restoreMessageHandler serves POST /api/messages/{id}/restore, taking the
+// caller's copy back out of the trash.
+func restoreMessageHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, username, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+		if err := setDeleted(db, msg, username, false); err != nil {
+			log.Println("restore message error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// partySides returns the sides ("receiver", "sender") of msg that belong
+// to username; both when a user messaged themselves.
+func partySides(msg Message, username string) []string {
+	var sides []string
+	if msg.Receiver == username {
+		sides = append(sides, "receiver")
+	}
+	if msg.Sender == username {
+		sides = append(sides, "sender")
+	}
+	return sides
+}
+
+// setDeleted marks or clears the deletion timestamp on every side of msg
+// that belongs to username, and audits the change.
+func setDeleted(db *sql.DB, msg Message, username string, deleted bool) error {
+	sets := []string{}
+	for _, side := range partySides(msg, username) {
+		if deleted {
+			sets = append(sets, side+"_deleted_at=COALESCE("+side+"_deleted_at, NOW())")
+		} else {
+			sets = append(sets, side+"_deleted_at=NULL")
+		}
+	}
+	action := auditMessageRestore
+	if deleted {
+		action = auditMessageDelete
+	}
+	return withTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE messages SET "+strings.Join(sets, ", ")+" WHERE id=$1", msg.ID); err != nil {
+			return err
+		}
+		return appendAudit(tx, username, action, msg.ID, nil)
+	})
+}
+
+// queryIDs runs a statement ending in RETURNING id and collects the ids.
+func queryIDs(db dbtx, query string, args ...any) ([]int64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// auditFlagChanges records read and archive changes to one message.
+func auditFlagChanges(tx *sql.Tx, username string, id int64, isRead, isArchived *bool) error {
+	if isRead != nil {
+		action := auditMessageUnread
+		if *isRead {
+			action = auditMessageRead
+		}
+		if err := appendAudit(tx, username, action, id, nil); err != nil {
+			return err
+		}
+	}
+	if isArchived != nil {
+		action := auditMessageUnarchive
+		if *isArchived {
+			action = auditMessageArchive
+		}
+		if err := appendAudit(tx, username, action, id, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +14,9 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// messageColumnNames matches the columns selected by messageColumns.
+var messageColumnNames = []string{"id", "sender", "receiver", "subject", "body", "priority", "is_read", "receiver_archived", "sender_archived", "receiver_deleted_at", "sender_deleted_at", "in_reply_to", "thread_id", "created_at", "deliver_at", "delivered_at", "expires_at", "expired", "originator", "filing_time", "channel_seq", "possible_duplicate", "duplicate_of", "route", "next_hop"}
+
 // Helper function to create a request with an authenticated user in the context
 func newAuthenticatedRequest(username string) *http.Request {
 	req, _ := http.NewRequest("GET", "/", nil)
@@ -34,7 +39,7 @@ func TestMessagesHandler_GetMessages_Success(t *testing.T) {
 	req.URL.RawQuery = q.Encode()
 
 	rr := httptest.NewRecorder()
-	handler := messagesHandler(db)
+	handler := messagesHandler(db, nil)
 
 	// Mock for the COUNT query for inbox
 	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM messages WHERE receiver=\$1 AND receiver_archived=\$2`).
@@ -42,10 +47,10 @@ func TestMessagesHandler_GetMessages_Success(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
 
 	// Mock for the SELECT query for inbox
-	rows := sqlmock.NewRows([]string{"id", "sender", "receiver", "subject", "body", "is_read", "receiver_archived", "sender_archived", "created_at"}).
-		AddRow(1, "sender1", "testuser", "Test Subject", "Test Body", false, false, false, time.Now())
+	rows := sqlmock.NewRows(messageColumnNames).
+		AddRow(1, "sender1", "testuser", "Test Subject", "Test Body", "GG", false, false, false, nil, nil, nil, 1, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", "")
 
-	mock.ExpectQuery(`SELECT id, sender, receiver, subject, body, is_read, receiver_archived, sender_archived, created_at FROM messages WHERE receiver=\$1 AND receiver_archived=\$2`).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT `+messageColumns+` FROM messages WHERE receiver=$1 AND receiver_archived=$2`)).
 		WithArgs("testuser", false, 10, 0). // username, archived, pageSize, offset
 		WillReturnRows(rows)
 
@@ -62,3 +67,331 @@ func TestMessagesHandler_GetMessages_Success(t *testing.T) {
 
 	assert.NoError(t, mock.ExpectationsWereMet(), "Mock expectations not met")
 }
+
+func newMessageRequest(method, username, id string, body string) *http.Request {
+	req, _ := http.NewRequest(method, "/api/messages/"+id, strings.NewReader(body))
+	req.SetPathValue("id", id)
+	ctx := context.WithValue(req.Context(), userContextKey, username)
+	return req.WithContext(ctx)
+}
+
+func TestGetMessageHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	handler := getMessageHandler(db)
+
+	// Sender can read their own message.
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "Hi", "Body", "GG", false, false, false, nil, nil, nil, 7, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", ""))
+	mock.ExpectQuery(`SELECT .* FROM attachments WHERE message_id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "message_id", "filename", "content_type", "size", "sha256", "storage_key", "created_at"}))
+	mock.ExpectQuery(`SELECT .* FROM list_expansions WHERE sender=\$1`).
+		WithArgs("alice", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(listExpansionColumnNames))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newMessageRequest("GET", "alice", "7", ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// A third party gets 403, not the message.
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "Hi", "Body", "GG", false, false, false, nil, nil, nil, 7, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", ""))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newMessageRequest("GET", "mallory", "7", ""))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Unknown ids are 404.
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(8)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newMessageRequest("GET", "alice", "8", ""))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newMessageRequest("GET", "alice", "abc", ""))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateMessageHandler_SenderCannotMarkRead(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "Hi", "Body", "GG", false, false, false, nil, nil, nil, 7, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", ""))
+
+	rr := httptest.NewRecorder()
+	updateMessageHandler(db).ServeHTTP(rr, newMessageRequest("PATCH", "alice", "7", `{"is_read":true}`))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateMessageHandler_ArchiveOwnCopy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "Hi", "Body", "GG", false, false, false, nil, nil, nil, 7, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", ""))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE messages SET sender_archived=\$1 WHERE id=\$2 RETURNING`).
+		WithArgs(true, int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "Hi", "Body", "GG", false, false, true, nil, nil, nil, 7, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageArchive)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	updateMessageHandler(db).ServeHTTP(rr, newMessageRequest("PATCH", "alice", "7", `{"is_archived":true}`))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var msg Message
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &msg))
+	assert.True(t, msg.SenderArchived)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHealthHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	healthHandler(rr, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "ok", rr.Body.String())
+}
+
+func TestReplyHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	sentAt := time.Date(2025, 9, 1, 10, 30, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "Slot", "CTOT 1030", "FF", false, false, false, nil, nil, nil, 3, sentAt, nil, sentAt, nil, false, "", "", "", false, nil, "", ""))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("bob", "alice", "Re: Slot", "Accepted\n\nOn 2025-09-01 10:30 UTC, alice wrote:\n> CTOT 1030", "FF", int64(7), int64(3), nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(8, "bob", "alice", "Re: Slot", "...", "FF", false, false, false, nil, nil, 7, 3, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	replyHandler(db).ServeHTTP(rr, newMessageRequest("POST", "bob", "7", `{"body":"Accepted"}`))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var msg Message
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &msg))
+	assert.Equal(t, int64(3), msg.ThreadID)
+	assert.Equal(t, int64(7), *msg.InReplyTo)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplyHandler_RoutesToAFTNSender(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// A reply to a message that came in over AFTN goes back the way of
+	// its originator, not to a local mailbox of that name.
+	sentAt := time.Date(2025, 9, 1, 10, 30, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "LFPGZTZX", "bob", "Slot", "CTOT 1030", "FF", false, false, false, nil, nil, nil, 3, sentAt, nil, sentAt, nil, false, "", "", "", false, nil, "", ""))
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("LFPGZTZX", "LFPGZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE username=\$1\)`).
+		WithArgs("LFPGZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`SELECT .* FROM routes`).
+		WithArgs("LFPGZTZX", defaultRoutePattern).
+		WillReturnRows(sqlmock.NewRows(routeColumnNames).AddRow(1, defaultRoutePattern, "aftn", "", sentAt, sentAt))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("bob", "LFPGZTZX", "Re: Slot", "Roger\n\nOn 2025-09-01 10:30 UTC, LFPGZTZX wrote:\n> CTOT 1030", "FF", int64(7), int64(3), nil, nil, "", "", "", false, nil, defaultRoutePattern, "aftn").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(8, "bob", "LFPGZTZX", "Re: Slot", "...", "FF", false, false, false, nil, nil, 7, 3, time.Now(), nil, nil, nil, false, "", "", "", false, nil, defaultRoutePattern, "aftn"))
+	mock.ExpectExec(`INSERT INTO outbound_queue`).
+		WithArgs(int64(8), "aftn", nil, []byte("[]")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	replyHandler(db).ServeHTTP(rr, newMessageRequest("POST", "bob", "7", `{"body":"Roger"}`))
+
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var msg Message
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &msg))
+	assert.Equal(t, "aftn", msg.NextHop)
+	assert.Nil(t, msg.DeliveredAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplyHandler_RoutesToRelayedSender(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	asRelayServer(t)
+
+	sentAt := time.Date(2025, 9, 1, 10, 30, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice@paris-mta", "bob", "Slot", "CTOT 1030", "FF", false, false, false, nil, nil, nil, 3, sentAt, nil, sentAt, nil, false, "", "", "", false, nil, "", ""))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("bob", "alice@paris-mta", "Re: Slot", "Roger\n\nOn 2025-09-01 10:30 UTC, alice@paris-mta wrote:\n> CTOT 1030", "FF", int64(7), int64(3), nil, nil, "", "", "", false, nil, "@paris-mta", "paris-mta").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(8, "bob", "alice@paris-mta", "Re: Slot", "...", "FF", false, false, false, nil, nil, 7, 3, time.Now(), nil, nil, nil, false, "", "", "", false, nil, "@paris-mta", "paris-mta"))
+	mock.ExpectExec(`INSERT INTO outbound_queue`).
+		WithArgs(int64(8), "paris-mta", nil, []byte("[]")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	replyHandler(db).ServeHTTP(rr, newMessageRequest("POST", "bob", "7", `{"body":"Roger"}`))
+
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var msg Message
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &msg))
+	assert.Equal(t, "paris-mta", msg.NextHop)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestForwardHandler_MaximumLengthOriginal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// The original fills the body limit, so the forward has to be cut.
+	max := appConfig.Limits.MaxBodyLen
+	line := "RWY 27L CLSD\n"
+	original := strings.Repeat(line, max/len(line)) + strings.Repeat("x", max%len(line))
+	sentAt := time.Date(2025, 9, 1, 10, 30, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(7, "alice", "bob", "NOTAM", original, "GG", false, false, false, nil, nil, nil, 3, sentAt, nil, sentAt, nil, false, "", "", "", false, nil, "", ""))
+	body := &captureArg{}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("bob", "carol", "Fwd: NOTAM", body, "GG", int64(7), int64(3), nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(8, "bob", "carol", "Fwd: NOTAM", "...", "GG", false, false, false, nil, nil, 7, 3, time.Now(), nil, time.Now(), nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	forwardHandler(db).ServeHTTP(rr, newMessageRequest("POST", "bob", "7", `{"receiver":"carol","body":"FYI"}`))
+
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	sent := body.v.(string)
+	assert.LessOrEqual(t, len(sent), max)
+	assert.True(t, strings.HasPrefix(sent, "FYI\n\n---------- Forwarded message ----------\nFrom: alice\n"), sent[:80])
+	assert.True(t, strings.HasSuffix(sent, "RWY 27L CLSD\n[...]"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplyBody_TruncatesQuote(t *testing.T) {
+	orig := Message{Sender: "alice", Body: "line one\nline two\nline three", CreatedAt: time.Date(2025, 9, 1, 10, 30, 0, 0, time.UTC)}
+	full := "Accepted\n\nOn 2025-09-01 10:30 UTC, alice wrote:\n> line one\n> line two\n> line three\n"
+	assert.Equal(t, full, replyBody(" Accepted ", orig, 200))
+
+	body := replyBody("Accepted", orig, 70)
+	assert.Equal(t, "Accepted\n\nOn 2025-09-01 10:30 UTC, alice wrote:\n> line one\n> [...]\n", body)
+	assert.LessOrEqual(t, len(body), 70)
+
+	// With no room for any of the quote, only the reply is kept.
+	assert.Equal(t, "Accepted", replyBody("Accepted", orig, 20))
+}
+
+func TestMessagesHandler_BulkReadNotifiesNewlyRead(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+
+	req, _ := http.NewRequest("PUT", "/api/messages", strings.NewReader(`{"ids":[1,2],"is_read":true}`))
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, "bob"))
+
+	// Message 1 was read already; only 2 is announced.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM messages WHERE receiver=\$1 AND id = ANY\(\$2\) AND NOT is_read AND delivered_at IS NOT NULL FOR UPDATE`).
+		WithArgs("bob", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(`UPDATE messages SET is_read=\$1 WHERE receiver=\$2 AND id = ANY\(\$3\) AND delivered_at IS NOT NULL RETURNING id`).
+		WithArgs(true, "bob", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	expectAudit(mock, auditMessageRead)
+	expectAudit(mock, auditMessageRead)
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id = ANY\(\$1\)`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(2, "alice", "bob", "Slot", "CTOT 1030", "GG", true, false, false, nil, nil, nil, 2, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+
+	aliceEvents, stop := events.subscribe("alice")
+	defer stop()
+
+	rr := httptest.NewRecorder()
+	messagesHandler(db, nil).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.JSONEq(t, `{"updated": 2}`, rr.Body.String())
+	ev := <-aliceEvents
+	assert.Equal(t, eventMessageRead, ev.Type)
+	assert.Equal(t, int64(2), ev.Data.(Message).ID)
+	select {
+	case ev := <-aliceEvents:
+		t.Errorf("unexpected %s event", ev.Type)
+	default:
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMessagesHandler_DeleteMovesOwnCopyToTrash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	req, _ := http.NewRequest("DELETE", "/api/messages", strings.NewReader(`{"ids":[1,2]}`))
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, "bob"))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE messages SET receiver_deleted_at=NOW\(\) WHERE receiver=\$1 AND id = ANY\(\$2\) AND receiver_deleted_at IS NULL AND delivered_at IS NOT NULL RETURNING id`).
+		WithArgs("bob", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	expectAudit(mock, auditMessageDelete)
+	expectAudit(mock, auditMessageDelete)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	messagesHandler(db, nil).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"deleted": 2}`, rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
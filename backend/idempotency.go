@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxIdempotencyKeyLen bounds the Idempotency-Key header.
+const maxIdempotencyKeyLen = 255
+
+// errIdempotencyKeyTaken means another request already claimed the key.
+var errIdempotencyKeyTaken = errors.New("idempotency key already used")
+
+// idempotencyRecord is what is remembered about a keyed submission.
+type idempotencyRecord struct {
+	RequestHash string
+	MessageID   int64
+	Response    []byte
+}
+
+// idempotencyKey returns the request's Idempotency-Key header, if any.
+func idempotencyKey(r *http.Request) (string, error) {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > maxIdempotencyKeyLen {
+		return "", fmt.Errorf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLen)
+	}
+	return key, nil
+}
+
+// requestHash fingerprints a validated submission so that a replayed key
+// can be told apart from a different message reusing it. Attachments count
+// by content.
+func requestHash(in newMessage) string {
+	fp := struct {
+		Receiver, Subject, Body, Priority  string
+		DeliverAt, ExpiresAt               *time.Time
+		Originator, FilingTime, ChannelSeq string
+		Attachments                        []string
+	}{in.Receiver, in.Subject, in.Body, in.Priority, in.DeliverAt, in.ExpiresAt, in.Originator, in.FilingTime, in.ChannelSeq, nil}
+	for _, a := range in.Attachments {
+		fp.Attachments = append(fp.Attachments, a.Filename+":"+a.SHA256)
+	}
+	b, _ := json.Marshal(fp)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupIdempotent returns the stored result for key if it was used by
+// username within window.
+func lookupIdempotent(db dbtx, username, key string, window time.Duration) (idempotencyRecord, bool, error) {
+	var rec idempotencyRecord
+	err := db.QueryRow(
+		`SELECT request_hash, message_id, response FROM idempotency_keys
+		 WHERE username=$1 AND key=$2 AND created_at > NOW() - make_interval(secs => $3)`,
+		username, key, window.Seconds(),
+	).Scan(&rec.RequestHash, &rec.MessageID, &rec.Response)
+	if err == sql.ErrNoRows {
+		return rec, false, nil
+	}
+	return rec, err == nil, err
+}
+
+// submitIdempotent is submit that also claims key for sender and stores
+// the response under it, all in one transaction. If a concurrent request
+// claimed the key first, its record is returned instead.
+func submitIdempotent(db *sql.DB, sender, key, hash string, sub submission) (any, []Message, *idempotencyRecord, error) {
+	window := appConfig.Idempotency.Window
+	var resp any
+	var sent []Message
+	err := withTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			`DELETE FROM idempotency_keys
+			 WHERE username=$1 AND key=$2 AND created_at <= NOW() - make_interval(secs => $3)`,
+			sender, key, window.Seconds(),
+		); err != nil {
+			return err
+		}
+		// Waits for a concurrent holder of the key to finish.
+		res, err := tx.Exec(
+			`INSERT INTO idempotency_keys(username, key, request_hash)
+			 VALUES($1,$2,$3) ON CONFLICT (username, key) DO NOTHING`,
+			sender, key, hash,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errIdempotencyKeyTaken
+		}
+
+		resp, sent, err = submitTx(tx, sender, sub)
+		if err != nil {
+			return err
+		}
+		response, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`UPDATE idempotency_keys SET message_id=$1, response=$2 WHERE username=$3 AND key=$4`,
+			sent[0].ID, response, sender, key,
+		)
+		return err
+	})
+	if err == errIdempotencyKeyTaken {
+		rec, found, err := lookupIdempotent(db, sender, key, window)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !found {
+			return nil, nil, nil, errIdempotencyKeyTaken
+		}
+		return nil, nil, &rec, nil
+	}
+	if err == nil {
+		notifySent(sent)
+	}
+	return resp, sent, nil, err
+}
+
+// replayIdempotent answers a request whose key was already used: the
+// original response if the payload matches, 422 otherwise.
+func replayIdempotent(w http.ResponseWriter, rec idempotencyRecord, hash string) {
+	if rec.RequestHash != hash {
+		http.Error(w, "Idempotency-Key was already used for a different message", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Write(rec.Response)
+	w.Write([]byte("\n"))
+}
+
+// pruneIdempotencyKeys forgets keys older than window.
+func pruneIdempotencyKeys(db *sql.DB, window time.Duration) (int64, error) {
+	res, err := db.Exec(`DELETE FROM idempotency_keys WHERE created_at <= NOW() - make_interval(secs => $1)`, window.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newKeyedPost(username, key, body string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/api/messages", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	return req.WithContext(context.WithValue(req.Context(), userContextKey, username))
+}
+
+func TestMessagesHandler_IdempotencyKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	handler := messagesHandler(db, nil)
+	body := `{"receiver":"bob","subject":"Slot","body":"CTOT 1030"}`
+	now := time.Now()
+
+	// First submission claims the key and stores the response with it.
+	mock.ExpectQuery(`SELECT request_hash, message_id, response FROM idempotency_keys`).
+		WithArgs("alice", "k-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "message_id", "response"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM idempotency_keys`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO idempotency_keys`).
+		WithArgs("alice", "k-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(3, "alice", "bob", "Slot", "CTOT 1030", "GG", false, false, false, nil, nil, nil, 3, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectExec(`UPDATE idempotency_keys SET message_id=\$1, response=\$2`).
+		WithArgs(int64(3), sqlmock.AnyArg(), "alice", "k-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newKeyedPost("alice", "k-1", body))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Empty(t, rr.Header().Get("Idempotent-Replayed"))
+
+	// A retry gets the stored response back without a new insert.
+	in := newMessage{Receiver: "bob", Subject: "Slot", Body: "CTOT 1030"}
+	assert.NoError(t, in.validate())
+	mock.ExpectQuery(`SELECT request_hash, message_id, response FROM idempotency_keys`).
+		WithArgs("alice", "k-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "message_id", "response"}).AddRow(requestHash(in), 3, []byte(`{"id": 3}`)))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newKeyedPost("alice", "k-1", body))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+	assert.JSONEq(t, `{"id": 3}`, rr.Body.String())
+
+	// Reusing the key for another message is refused.
+	mock.ExpectQuery(`SELECT request_hash, message_id, response FROM idempotency_keys`).
+		WithArgs("alice", "k-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "message_id", "response"}).AddRow(requestHash(in), 3, []byte(`{"id": 3}`)))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newKeyedPost("alice", "k-1", `{"receiver":"bob","subject":"Slot","body":"CTOT 1045"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
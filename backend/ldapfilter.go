@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bounds on directory filters, which come straight from the query string.
+const (
+	maxFilterLen   = 1024
+	maxFilterDepth = 16
+)
+
+// directoryAttributes maps the attribute names accepted in filters, in
+// lower case, to directory_entries columns. The LDAP short names are
+// accepted alongside the column names.
+var directoryAttributes = map[string]string{
+	"uid":                "username",
+	"username":           "username",
+	"aftn":               "aftn_address",
+	"aftnaddress":        "aftn_address",
+	"aftn_address":       "aftn_address",
+	"o":                  "organisation",
+	"org":                "organisation",
+	"organisation":       "organisation",
+	"organization":       "organisation",
+	"l":                  "location_indicator",
+	"loc":                "location_indicator",
+	"locationindicator":  "location_indicator",
+	"location_indicator": "location_indicator",
+	"cn":                 "display_name",
+	"displayname":        "display_name",
+	"display_name":       "display_name",
+}
+
+// compileFilter turns an LDAP-style search filter (RFC 4515 subset) into a
+// SQL condition on directory_entries. Placeholders are numbered from
+// argBase+1. Supported are &, | and !, equality, presence (attr=*) and
+// substrings (attr=EG*); matching ignores case, as LDAP's does for these
+// attributes. For example:
+//
+//	(&(o=NATS)(|(l=EGLL)(l=EGKK))(!(cn=*test*)))
+func compileFilter(filter string, argBase int) (string, []any, error) {
+	if len(filter) > maxFilterLen {
+		return "", nil, fmt.Errorf("filter exceeds %d characters", maxFilterLen)
+	}
+	p := &filterParser{s: strings.TrimSpace(filter), argBase: argBase}
+	cond, err := p.filter(0)
+	if err != nil {
+		return "", nil, err
+	}
+	if p.pos != len(p.s) {
+		return "", nil, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos:], p.pos)
+	}
+	return cond, p.args, nil
+}
+
+type filterParser struct {
+	s       string
+	pos     int
+	argBase int
+	args    []any
+}
+
+func (p *filterParser) expect(c byte) error {
+	if p.pos >= len(p.s) || p.s[p.pos] != c {
+		return fmt.Errorf("expected %q at offset %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) arg(v any) string {
+	p.args = append(p.args, v)
+	return "$" + strconv.Itoa(p.argBase+len(p.args))
+}
+
+// filter parses one parenthesised filter.
+func (p *filterParser) filter(depth int) (string, error) {
+	if depth >= maxFilterDepth {
+		return "", fmt.Errorf("filter nested deeper than %d", maxFilterDepth)
+	}
+	if err := p.expect('('); err != nil {
+		return "", err
+	}
+	if p.pos >= len(p.s) {
+		return "", errors.New("unterminated filter")
+	}
+	var cond string
+	var err error
+	switch op := p.s[p.pos]; op {
+	case '&', '|':
+		p.pos++
+		var parts []string
+		for p.pos < len(p.s) && p.s[p.pos] == '(' {
+			part, err := p.filter(depth + 1)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) == 0 {
+			return "", fmt.Errorf("%q needs at least one filter", op)
+		}
+		join := " AND "
+		if op == '|' {
+			join = " OR "
+		}
+		cond = "(" + strings.Join(parts, join) + ")"
+	case '!':
+		p.pos++
+		cond, err = p.filter(depth + 1)
+		cond = "NOT " + cond
+	default:
+		cond, err = p.item()
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := p.expect(')'); err != nil {
+		return "", err
+	}
+	return cond, nil
+}
+
+// item parses attr=value up to the closing parenthesis.
+func (p *filterParser) item() (string, error) {
+	end := strings.IndexByte(p.s[p.pos:], ')')
+	if end < 0 {
+		return "", errors.New("unterminated filter")
+	}
+	raw := p.s[p.pos : p.pos+end]
+	attr, value, ok := strings.Cut(raw, "=")
+	if !ok {
+		return "", fmt.Errorf("expected attr=value, got %q", raw)
+	}
+	if strings.ContainsAny(attr, "~<>:") {
+		return "", fmt.Errorf("only equality matches are supported, got %q", raw)
+	}
+	column, ok := directoryAttributes[strings.ToLower(strings.TrimSpace(attr))]
+	if !ok {
+		return "", fmt.Errorf("unknown attribute %q", attr)
+	}
+	p.pos += end
+
+	if value == "*" {
+		return "(" + column + " <> '')", nil
+	}
+	// Wildcards split the value; escapes are decoded per part so that
+	// an escaped \2a is a literal asterisk.
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		decoded, err := unescapeFilterValue(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = decoded
+	}
+	if len(parts) == 1 {
+		return "(lower(" + column + ") = lower(" + p.arg(parts[0]) + "))", nil
+	}
+	for i, part := range parts {
+		parts[i] = escapeLike(part)
+	}
+	return "(" + column + " ILIKE " + p.arg(strings.Join(parts, "%")) + ")", nil
+}
+
+// unescapeFilterValue decodes RFC 4515 \XX escapes.
+func unescapeFilterValue(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '(' || c == ')' {
+			return "", fmt.Errorf("unescaped parenthesis in %q", s)
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("bad escape in %q", s)
+		}
+		v, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("bad escape in %q", s)
+		}
+		b.Write(v)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// escapeLike quotes LIKE metacharacters so s matches only itself.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"mini-amhs/config"
+)
+
+// Mail headers that carry the message priority.
+const (
+	aftnPriorityHeader = "X-AFTN-Priority"
+	xPriorityHeader    = "X-Priority"
+	importanceHeader   = "Importance"
+)
+
+// mailContent is what an incoming mail becomes: the text of a message and
+// its attachments.
+type mailContent struct {
+	From        string
+	Subject     string
+	Text        string
+	Priority    string
+	Attachments []mailAttachment
+}
+
+type mailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+var htmlTagPattern = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// parseMail reads an RFC 5322 mail. The text is the first text/plain
+// part, or failing that the first text/html part with its markup removed;
+// every other leaf part, and any part marked as an attachment, becomes an
+// attachment.
+func parseMail(data []byte) (mailContent, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return mailContent{}, fmt.Errorf("malformed mail: %w", err)
+	}
+	dec := new(mime.WordDecoder)
+	var m mailContent
+	if m.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+	if from, err := msg.Header.AddressList("From"); err == nil && len(from) > 0 {
+		m.From = strings.ToLower(from[0].Address)
+	}
+	m.Priority = mailPriority(msg.Header)
+
+	var htmlText string
+	err = walkMailPart(msg.Header, msg.Body, func(h mimeHeader, mediaType string, params map[string]string, data []byte) {
+		disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+		filename := dparams["filename"]
+		if filename == "" {
+			filename = params["name"]
+		}
+		if f, err := dec.DecodeHeader(filename); err == nil {
+			filename = f
+		}
+		switch {
+		case disposition != "attachment" && mediaType == "text/plain" && m.Text == "":
+			m.Text = decodeCharset(data, params["charset"])
+		case disposition != "attachment" && mediaType == "text/html" && htmlText == "":
+			htmlText = decodeCharset(data, params["charset"])
+		default:
+			ct := mediaType
+			if ct == "text/plain" || ct == "text/html" {
+				ct += "; charset=utf-8"
+				data = []byte(decodeCharset(data, params["charset"]))
+			}
+			if filename == "" {
+				filename = "attachment"
+			}
+			m.Attachments = append(m.Attachments, mailAttachment{Filename: filename, ContentType: ct, Data: data})
+		}
+	})
+	if err != nil {
+		return mailContent{}, err
+	}
+	if m.Text == "" && htmlText != "" {
+		m.Text = html.UnescapeString(htmlTagPattern.ReplaceAllString(htmlText, ""))
+	}
+	m.Text = strings.ReplaceAll(m.Text, "\r\n", "\n")
+	return m, nil
+}
+
+// mimeHeader is the part of textproto.MIMEHeader and mail.Header that
+// walkMailPart needs.
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// walkMailPart calls leaf for every non-multipart part below h and body,
+// with its transfer encoding undone.
+func walkMailPart(h mimeHeader, body io.Reader, leaf func(h mimeHeader, mediaType string, params map[string]string, data []byte)) error {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("malformed multipart body: %w", err)
+			}
+			if err := walkMailPart(p.Header, p, leaf); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("malformed %s part: %w", mediaType, err)
+	}
+	leaf(h, mediaType, params, data)
+	return nil
+}
+
+// decodeCharset converts text in charset to UTF-8. Latin-1 is converted;
+// anything else is taken as UTF-8 with invalid bytes dropped.
+func decodeCharset(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		var sb strings.Builder
+		for _, b := range data {
+			sb.WriteRune(rune(b))
+		}
+		return sb.String()
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return strings.ToValidUTF8(string(data), "")
+}
+
+// mailPriority maps the priority headers of a mail to a message priority:
+// X-AFTN-Priority as set on forwarded messages, else FF for mail marked
+// urgent, else the default.
+func mailPriority(h mail.Header) string {
+	if p := strings.ToUpper(strings.TrimSpace(h.Get(aftnPriorityHeader))); slices.Contains(messagePriorities, p) {
+		return p
+	}
+	xp := strings.TrimSpace(h.Get(xPriorityHeader))
+	if strings.HasPrefix(xp, "1") || strings.HasPrefix(xp, "2") || strings.EqualFold(strings.TrimSpace(h.Get(importanceHeader)), "high") {
+		return prioritySafety
+	}
+	return defaultPriority
+}
+
+// mailIngress turns mail received by the SMTP listener into messages.
+type mailIngress struct {
+	db    *sql.DB
+	store attachmentStore
+	cfg   config.SMTPConfig
+}
+
+// localPart returns the mailbox of addr if its domain is one this server
+// accepts mail for.
+func (b *mailIngress) localPart(addr string) (string, bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i <= 0 {
+		return "", false
+	}
+	domain := addr[i+1:]
+	for _, d := range b.cfg.Domains {
+		if strings.EqualFold(d, domain) {
+			return addr[:i], true
+		}
+	}
+	return "", false
+}
+
+// foreignAddress reports whether addr is a full address outside this
+// server, so that mail from it cannot pass for a local user or, as
+// name@server, for a user of this or a peer relay server.
+func (b *mailIngress) foreignAddress(addr string) bool {
+	i := strings.LastIndexByte(addr, '@')
+	if i <= 0 || i == len(addr)-1 {
+		return false
+	}
+	if _, ok := b.localPart(addr); ok {
+		return false
+	}
+	domain := addr[i+1:]
+	if _, ok := appConfig.Relay.Peers[domain]; ok {
+		return false
+	}
+	return appConfig.Relay.Name == "" || !strings.EqualFold(domain, appConfig.Relay.Name)
+}
+
+// resolve maps a recipient address to a receiver and its route. Mail is
+// accepted for local users and for addresses routed to another server.
+func (b *mailIngress) resolve(addr string) (string, *Route, error) {
+	local, ok := b.localPart(addr)
+	if !ok {
+		return "", nil, &smtpReply{550, "5.7.1 relaying denied"}
+	}
+	receiver, route, err := resolveRecipient(b.db, local)
+	if errors.Is(err, errUnknownRecipient) {
+		return "", nil, &smtpReply{550, "5.1.1 mailbox unavailable"}
+	}
+	if err != nil || route != nil {
+		return receiver, route, err
+	}
+	var exists bool
+	if err := b.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username=$1)`, receiver).Scan(&exists); err != nil {
+		return "", nil, err
+	}
+	if !exists {
+		return "", nil, &smtpReply{550, "5.1.1 mailbox unavailable"}
+	}
+	return receiver, nil, nil
+}
+
+func (b *mailIngress) checkRecipient(addr string) error {
+	_, _, err := b.resolve(addr)
+	return err
+}
+
+// deliver stores one message per recipient, in one transaction so that a
+// refused mail leaves none of them behind. A mail the client sends again
+// after losing the reply to an accepted one is stored again.
+func (b *mailIngress) deliver(from string, to []string, data []byte) error {
+	m, err := parseMail(data)
+	if err != nil {
+		return &smtpReply{554, "5.6.0 " + err.Error()}
+	}
+	sender := m.From
+	if sender == "" {
+		sender = strings.ToLower(from)
+	}
+	if from == "" || sender == "" {
+		return &smtpReply{550, "5.1.7 a sender address is required"}
+	}
+	if !b.foreignAddress(from) || !b.foreignAddress(sender) {
+		return &smtpReply{550, "5.7.1 sender address not accepted"}
+	}
+	if len(m.Attachments) > appConfig.Attachments.MaxCount {
+		return &smtpReply{552, fmt.Sprintf("5.3.4 at most %d attachments allowed", appConfig.Attachments.MaxCount)}
+	}
+	if strings.TrimSpace(m.Subject) == "" {
+		m.Subject = "(no subject)"
+	}
+	if strings.TrimSpace(m.Text) == "" {
+		m.Text = "(no text)"
+	}
+
+	var msgs []newMessage
+	var stored []Attachment
+	fail := func(err error) error {
+		discardAttachments(b.store, stored)
+		var uerr *uploadError
+		if errors.As(err, &uerr) {
+			return &smtpReply{552, "5.3.4 " + uerr.Msg}
+		}
+		return err
+	}
+	for _, rcpt := range to {
+		in := newMessage{Subject: m.Subject, Body: m.Text, Priority: m.Priority}
+		if in.Receiver, in.Route, err = b.resolve(rcpt); err != nil {
+			return fail(err)
+		}
+		if err := in.validate(); err != nil {
+			return fail(&smtpReply{554, "5.6.0 " + err.Error()})
+		}
+		for _, a := range m.Attachments {
+			att, err := storeAttachmentData(b.store, a.Filename, a.ContentType, a.Data)
+			if err != nil {
+				return fail(err)
+			}
+			stored = append(stored, att)
+			in.Attachments = append(in.Attachments, att)
+		}
+		msgs = append(msgs, in)
+	}
+	var sent []Message
+	err = withTx(b.db, func(tx *sql.Tx) error {
+		for _, in := range msgs {
+			msg, err := sendMessageTx(tx, sender, in)
+			if err != nil {
+				return err
+			}
+			sent = append(sent, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	notifySent(sent)
+	return nil
+}
+
+// runMailIngress runs the SMTP listener until ctx is done.
+func runMailIngress(ctx context.Context, db *sql.DB, store attachmentStore, cfg config.SMTPConfig) {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		log.Printf("smtp listener error: %v", err)
+		return
+	}
+	log.Printf("SMTP listening on %s for %s", ln.Addr(), strings.Join(cfg.Domains, ", "))
+	srv := &smtpServer{
+		hostname: cfg.Hostname,
+		maxSize:  cfg.MaxMessageSize,
+		timeout:  5 * time.Minute,
+		backend:  &mailIngress{db: db, store: store, cfg: cfg},
+	}
+	if err := srv.serve(ctx, ln); err != nil {
+		log.Printf("smtp listener error: %v", err)
+	}
+}
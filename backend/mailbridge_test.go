@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"mini-amhs/config"
+)
+
+const multipartMail = `From: =?utf-8?q?Ops_D=C3=A9sk?= <OPS@Partner.example>
+To: alice@amhs.local
+Subject: =?utf-8?q?Cr=C3=A9neau?= revised
+X-Priority: 1
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+CTOT 1130 pour l'=E9quipe
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>CTOT 1130</p>
+--inner--
+
+--outer
+Content-Type: text/plain; name="slot.txt"
+Content-Disposition: attachment; filename="slot.txt"
+Content-Transfer-Encoding: base64
+
+U0xPVCAxMTMw
+--outer--
+`
+
+func TestParseMail(t *testing.T) {
+	m, err := parseMail([]byte(multipartMail))
+	require.NoError(t, err)
+	assert.Equal(t, "ops@partner.example", m.From)
+	assert.Equal(t, "Créneau revised", m.Subject)
+	assert.Equal(t, "CTOT 1130 pour l'équipe", m.Text)
+	assert.Equal(t, prioritySafety, m.Priority)
+	assert.Equal(t, []mailAttachment{{Filename: "slot.txt", ContentType: "text/plain; charset=utf-8", Data: []byte("SLOT 1130")}}, m.Attachments)
+
+	// HTML only: the markup is stripped.
+	m, err = parseMail([]byte("Subject: x\nContent-Type: text/html\n\n<b>RWY&nbsp;27L</b> CLSD"))
+	require.NoError(t, err)
+	assert.Equal(t, "RWY 27L CLSD", m.Text)
+	assert.Equal(t, defaultPriority, m.Priority)
+
+	_, err = parseMail([]byte("no headers here"))
+	assert.Error(t, err)
+}
+
+func TestMailPriority(t *testing.T) {
+	header := func(k, v string) mail.Header { return mail.Header{k: {v}} }
+	assert.Equal(t, priorityUrgency, mailPriority(header("X-Aftn-Priority", "dd")))
+	assert.Equal(t, prioritySafety, mailPriority(header("Importance", "High")))
+	assert.Equal(t, prioritySafety, mailPriority(header("X-Priority", "2 (High)")))
+	assert.Equal(t, defaultPriority, mailPriority(header("X-Priority", "3")))
+	assert.Equal(t, defaultPriority, mailPriority(header("X-Aftn-Priority", "ZZ")))
+}
+
+func TestMailIngress_Deliver(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	store, err := newLocalStore(t.TempDir())
+	require.NoError(t, err)
+	b := &mailIngress{db: db, store: store, cfg: config.SMTPConfig{Domains: []string{"amhs.local"}}}
+	now := time.Now()
+
+	assert.EqualError(t, b.checkRecipient("alice@elsewhere.example"), "550 5.7.1 relaying denied")
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE username=\$1\)`).
+		WithArgs("mallory").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	assert.EqualError(t, b.checkRecipient("mallory@AMHS.local"), "550 5.1.1 mailbox unavailable")
+
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("ops@partner.example", "alice", "Créneau revised", "CTOT 1130 pour l'équipe", prioritySafety, nil, nil, nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(40, "ops@partner.example", "alice", "Créneau revised", "CTOT 1130 pour l'équipe", prioritySafety, false, false, false, nil, nil, nil, 40, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+	mock.ExpectQuery(`INSERT INTO attachments`).
+		WithArgs(int64(40), "slot.txt", "text/plain; charset=utf-8", int64(9), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(attachmentColumnNames).AddRow(1, 40, "slot.txt", "text/plain; charset=utf-8", 9, "sum", "key", now))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	aliceEvents, stop := events.subscribe("alice")
+	defer stop()
+
+	require.NoError(t, b.deliver("bounce@partner.example", []string{"alice@amhs.local"}, []byte(multipartMail)))
+	assert.Equal(t, eventMessageCreated, (<-aliceEvents).Type)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMailIngress_DeliverRefusals(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dir := t.TempDir()
+	store, err := newLocalStore(dir)
+	require.NoError(t, err)
+	b := &mailIngress{db: db, store: store, cfg: config.SMTPConfig{Domains: []string{"amhs.local"}}}
+
+	err = b.deliver("", []string{"alice@amhs.local"}, []byte("Subject: x\n\nhello"))
+	assert.EqualError(t, err, "550 5.1.7 a sender address is required")
+
+	// Mail cannot pass for a local user, whether by a bare name or an
+	// address here, in the envelope or in From.
+	asRelayServer(t)
+	for _, tc := range []struct{ from, header string }{
+		{"alice", ""},
+		{"system", ""},
+		{"system", "From: ops@partner.example\n"},
+		{"ops@partner.example", "From: alice@amhs.local\n"},
+		{"ops@partner.example", "From: alice@paris-mta\n"},
+		{"bob@london-mta", ""},
+	} {
+		err = b.deliver(tc.from, []string{"alice@amhs.local"}, []byte(tc.header+"Subject: x\n\nhello"))
+		assert.EqualError(t, err, "550 5.7.1 sender address not accepted", tc.from+" "+tc.header)
+	}
+
+	// A disallowed attachment refuses the mail and leaves nothing behind.
+	saved := appConfig.Attachments.AllowedTypes
+	defer func() { appConfig.Attachments.AllowedTypes = saved }()
+	appConfig.Attachments.AllowedTypes = []string{"application/pdf"}
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	err = b.deliver("ops@partner.example", []string{"alice@amhs.local"}, []byte(multipartMail))
+	assert.EqualError(t, err, `552 5.3.4 attachment "slot.txt": type text/plain; charset=utf-8 not allowed`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, storedFiles(t, dir))
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"mini-amhs/config"
+)
+
+const (
+	// forwardBatchSize bounds the messages forwarded per interval.
+	forwardBatchSize = 20
+	// forwardLease keeps a claimed forward from being picked up again
+	// while it is being sent.
+	forwardLease = 5 * time.Minute
+	// forwardLookback limits forwarding to recent messages, so that a
+	// forwarder that was down does not flood the user's mailbox.
+	forwardLookback = 24 * time.Hour
+)
+
+// forwardItem is one message due to be forwarded by email.
+type forwardItem struct {
+	ID        int64
+	MessageID int64
+	Address   string
+	Attempts  int
+}
+
+// mailForwarder sends delivered messages to the external addresses of the
+// users who asked for it.
+type mailForwarder struct {
+	db    *sql.DB
+	store attachmentStore
+	cfg   config.SMTPConfig
+	// send submits one mail; submit unless replaced in tests.
+	send func(to string, data []byte) error
+}
+
+func newMailForwarder(db *sql.DB, store attachmentStore, cfg config.SMTPConfig) *mailForwarder {
+	f := &mailForwarder{db: db, store: store, cfg: cfg}
+	f.send = f.submit
+	return f
+}
+
+// runMailForwarder forwards messages every cfg.ForwardInterval until ctx
+// is done.
+func runMailForwarder(ctx context.Context, db *sql.DB, store attachmentStore, cfg config.SMTPConfig) {
+	f := newMailForwarder(db, store, cfg)
+	ticker := time.NewTicker(cfg.ForwardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.run(); err != nil {
+				log.Println("email forwarding error:", err)
+			}
+		}
+	}
+}
+
+// run queues newly delivered messages and sends those that are due.
+func (f *mailForwarder) run() error {
+	if err := f.enqueue(); err != nil {
+		return err
+	}
+	items, err := f.claim()
+	if err != nil {
+		return err
+	}
+	for _, it := range items {
+		f.forward(it)
+	}
+	return nil
+}
+
+// enqueue records a forward for every message delivered to a user since
+// they turned forwarding on. Messages that came from the forwarding
+// address itself are skipped, so that mail does not loop.
+func (f *mailForwarder) enqueue() error {
+	_, err := f.db.Exec(
+		`INSERT INTO email_forwards(message_id, address)
+		 SELECT m.id, u.forward_email FROM messages m JOIN users u ON u.username = m.receiver
+		 WHERE u.forward_since IS NOT NULL AND u.forward_email <> ''
+		   AND m.delivered_at >= u.forward_since AND m.delivered_at > $1
+		   AND m.next_hop = '' AND m.receiver_deleted_at IS NULL
+		   AND LOWER(m.sender) <> LOWER(u.forward_email)
+		 ON CONFLICT (message_id) DO NOTHING`,
+		time.Now().Add(-forwardLookback),
+	)
+	return err
+}
+
+// claim takes the forwards that are due and leases them for the attempt.
+func (f *mailForwarder) claim() ([]forwardItem, error) {
+	rows, err := f.db.Query(
+		`UPDATE email_forwards SET attempts=attempts+1, next_attempt_at=$1, updated_at=NOW()
+		 WHERE id IN (
+		   SELECT id FROM email_forwards WHERE status=$2 AND next_attempt_at <= NOW()
+		   ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED)
+		 RETURNING id, message_id, address, attempts`,
+		time.Now().Add(forwardLease), queuePending, forwardBatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []forwardItem
+	for rows.Next() {
+		var it forwardItem
+		if err := rows.Scan(&it.ID, &it.MessageID, &it.Address, &it.Attempts); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// forward sends one message and settles its forward by the outcome.
+func (f *mailForwarder) forward(it forwardItem) {
+	msg, err := scanMessage(f.db.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id=$1`, it.MessageID))
+	if err != nil {
+		// The forward is tried again once its lease lapses.
+		log.Printf("email forwarding load error for message %d: %v", it.MessageID, err)
+		return
+	}
+	atts, err := loadAttachments(f.db, msg.ID)
+	if err != nil {
+		log.Printf("email forwarding load error for message %d: %v", it.MessageID, err)
+		return
+	}
+	data, err := buildForwardMail(f.cfg, f.store, msg, atts, it.Address)
+	if err == nil {
+		err = f.send(it.Address, data)
+	}
+	if err == nil {
+		f.settle(it, queueSent, "", auditMessageEmailForward)
+		return
+	}
+	log.Printf("email forwarding of message %d to %s failed: %v", msg.ID, it.Address, err)
+	// A 5xx reply is permanent: the relay will not take the mail.
+	var perr *textproto.Error
+	if errors.As(err, &perr) && perr.Code >= 500 || it.Attempts >= f.cfg.MaxAttempts {
+		f.settle(it, queueDead, err.Error(), auditMessageEmailForwardFailed)
+		return
+	}
+	reason := err.Error()
+	if _, err := f.db.Exec(
+		`UPDATE email_forwards SET next_attempt_at=$1, last_error=$2, updated_at=NOW() WHERE id=$3`,
+		time.Now().Add(backoff(f.cfg.ForwardInterval, time.Hour, it.Attempts)), reason, it.ID,
+	); err != nil {
+		log.Printf("email forwarding requeue error for item %d: %v", it.ID, err)
+	}
+}
+
+// settle marks the forward sent or dead and records the outcome.
+func (f *mailForwarder) settle(it forwardItem, status, reason, action string) {
+	err := withTx(f.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			`UPDATE email_forwards SET status=$1, last_error=$2, updated_at=NOW(),
+			        sent_at=CASE WHEN $1 = 'sent' THEN NOW() END
+			 WHERE id=$3`,
+			status, reason, it.ID,
+		); err != nil {
+			return err
+		}
+		details := map[string]any{"address": it.Address, "attempts": it.Attempts}
+		if reason != "" {
+			details["error"] = reason
+		}
+		return appendAudit(tx, auditSystemActor, action, it.MessageID, details)
+	})
+	if err != nil {
+		log.Printf("email forwarding bookkeeping error for item %d: %v", it.ID, err)
+	}
+}
+
+// submit hands one mail to the configured relay, upgrading to TLS when
+// the relay offers it.
+func (f *mailForwarder) submit(to string, data []byte) error {
+	host, _, err := net.SplitHostPort(f.cfg.Relay)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", f.cfg.Relay, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello(f.cfg.Hostname); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if f.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", f.cfg.Username, f.cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(f.cfg.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildForwardMail renders msg as a MIME mail to the address to. The
+// message text goes first, after a short header naming its parties;
+// attachments follow as base64 parts.
+func buildForwardMail(cfg config.SMTPConfig, store attachmentStore, msg Message, atts []Attachment, to string) ([]byte, error) {
+	from := mail.Address{Name: msg.Sender + " via AMHS", Address: cfg.From}
+	var head bytes.Buffer
+	header := func(key, value string) { fmt.Fprintf(&head, "%s: %s\r\n", key, value) }
+	header("From", from.String())
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", msg.CreatedAt.Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<amhs.%d@%s>", msg.ID, cfg.Hostname))
+	header("Auto-Submitted", "auto-forwarded")
+	header(aftnPriorityHeader, msg.Priority)
+	switch msg.Priority {
+	case priorityDistress, priorityUrgency, prioritySafety:
+		header(xPriorityHeader, "1")
+	}
+	header("MIME-Version", "1.0")
+
+	text := fmt.Sprintf("From: %s\nTo: %s\nPriority: %s\n\n%s\n", msg.Sender, msg.Receiver, msg.Priority, msg.Body)
+	if len(atts) == 0 {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		head.WriteString("\r\n")
+		if err := writeQuotedPrintable(&head, text); err != nil {
+			return nil, err
+		}
+		return head.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(part, text); err != nil {
+		return nil, err
+	}
+	for _, a := range atts {
+		f, err := store.Open(a.StorageKey)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %q: %w", a.Filename, err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("attachment %q: %w", a.Filename, err)
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		enc := base64.StdEncoding.EncodeToString(data)
+		for len(enc) > 76 {
+			io.WriteString(part, enc[:76]+"\r\n")
+			enc = enc[76:]
+		}
+		io.WriteString(part, enc+"\r\n")
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	head.WriteString("\r\n")
+	head.Write(body.Bytes())
+	return head.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, text); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// emailForwardingHandler serves GET and PUT /api/account/email-forwarding,
+// where users choose whether their messages are also sent to an external
+// email address.
+func emailForwardingHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var fwd EmailForwarding
+		switch r.Method {
+		case http.MethodGet:
+			err := db.QueryRow(`SELECT forward_email, forward_since FROM users WHERE username=$1`, username).
+				Scan(&fwd.Address, &fwd.Since)
+			if err != nil {
+				log.Println("db query email forwarding error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+		case http.MethodPut:
+			var in struct {
+				Address string `json:"address"`
+				Enabled bool   `json:"enabled"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			in.Address = strings.TrimSpace(in.Address)
+			if in.Address != "" {
+				if a, err := mail.ParseAddress(in.Address); err != nil || a.Address != in.Address {
+					http.Error(w, "address must be a plain email address", http.StatusBadRequest)
+					return
+				}
+			}
+			if in.Enabled && in.Address == "" {
+				http.Error(w, "address is required to enable forwarding", http.StatusBadRequest)
+				return
+			}
+			if in.Enabled && appConfig.SMTP.Relay == "" {
+				http.Error(w, "email forwarding is not available on this server", http.StatusBadRequest)
+				return
+			}
+			err := withTx(db, func(tx *sql.Tx) error {
+				if err := tx.QueryRow(
+					`UPDATE users SET forward_email=$1, forward_since=CASE WHEN $2 THEN COALESCE(forward_since, NOW()) END
+					 WHERE username=$3 RETURNING forward_email, forward_since`,
+					in.Address, in.Enabled, username,
+				).Scan(&fwd.Address, &fwd.Since); err != nil {
+					return err
+				}
+				return appendAudit(tx, username, auditAccountEmailForwarding, 0, map[string]any{
+					"address": in.Address, "enabled": in.Enabled,
+				})
+			})
+			if err != nil {
+				log.Println("db update email forwarding error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fwd.Enabled = fwd.Since != nil
+		writeJSON(w, fwd)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"mini-amhs/config"
+)
+
+var forwardConfig = config.SMTPConfig{Hostname: "amhs.test", From: "amhs@amhs.test", ForwardInterval: time.Minute, MaxAttempts: 3}
+
+func TestBuildForwardMail_RoundTrip(t *testing.T) {
+	store, err := newLocalStore(t.TempDir())
+	require.NoError(t, err)
+	key, err := newStorageKey()
+	require.NoError(t, err)
+	require.NoError(t, store.Put(key, strings.NewReader("%PDF-1.4 slot list")))
+	now := time.Date(2026, 10, 19, 10, 29, 0, 0, time.UTC)
+	msg := Message{ID: 7, Sender: "EGLLZPZX", Receiver: "alice", Subject: "Créneau", Body: "CTOT 1130", Priority: prioritySafety, CreatedAt: now}
+
+	data, err := buildForwardMail(forwardConfig, store, msg, []Attachment{{Filename: "slots.pdf", ContentType: "application/pdf", StorageKey: key}}, "alice@partner.example")
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "From: \"EGLLZPZX via AMHS\" <amhs@amhs.test>\r\n")
+	assert.Contains(t, string(data), "Message-ID: <amhs.7@amhs.test>\r\n")
+	assert.Contains(t, string(data), "Auto-Submitted: auto-forwarded\r\n")
+
+	m, err := parseMail(data)
+	require.NoError(t, err)
+	assert.Equal(t, "amhs@amhs.test", m.From)
+	assert.Equal(t, "Créneau", m.Subject)
+	assert.Equal(t, prioritySafety, m.Priority)
+	assert.Equal(t, "From: EGLLZPZX\nTo: alice\nPriority: FF\n\nCTOT 1130\n", m.Text)
+	assert.Equal(t, []mailAttachment{{Filename: "slots.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4 slot list")}}, m.Attachments)
+
+	// Without attachments the mail is a single text part.
+	data, err = buildForwardMail(forwardConfig, store, msg, nil, "alice@partner.example")
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Content-Type: text/plain; charset=utf-8\r\n")
+	assert.NotContains(t, string(data), "multipart")
+}
+
+func TestMailForwarder_Run(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	f := newMailForwarder(db, nil, forwardConfig)
+	var sent []string
+	f.send = func(to string, data []byte) error {
+		sent = append(sent, to)
+		switch {
+		case bytes.Contains(data, []byte("Subject: Bounce")):
+			return &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+		case bytes.Contains(data, []byte("Subject: Later")):
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	mock.ExpectExec(`INSERT INTO email_forwards\(message_id, address\)`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectQuery(`UPDATE email_forwards SET attempts=attempts\+1`).
+		WithArgs(sqlmock.AnyArg(), queuePending, forwardBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "message_id", "address", "attempts"}).
+			AddRow(1, 10, "alice@partner.example", 1).
+			AddRow(2, 11, "bob@partner.example", 1).
+			AddRow(3, 12, "carol@partner.example", 1))
+	for i, subject := range []string{"Hello", "Bounce", "Later"} {
+		id := int64(10 + i)
+		mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+			WithArgs(id).
+			WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(id, "EGLLZPZX", "alice", subject, "text", "GG", false, false, false, nil, nil, nil, id, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+		mock.ExpectQuery(`SELECT .* FROM attachments`).
+			WithArgs(id).
+			WillReturnRows(sqlmock.NewRows(attachmentColumnNames))
+		switch subject {
+		case "Hello":
+			mock.ExpectBegin()
+			mock.ExpectExec(`UPDATE email_forwards SET status=\$1`).
+				WithArgs(queueSent, "", int64(1)).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock, auditMessageEmailForward)
+			mock.ExpectCommit()
+		case "Bounce":
+			// Refused for good: no retry.
+			mock.ExpectBegin()
+			mock.ExpectExec(`UPDATE email_forwards SET status=\$1`).
+				WithArgs(queueDead, `550 "5.1.1 no such user"`, int64(2)).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock, auditMessageEmailForwardFailed)
+			mock.ExpectCommit()
+		case "Later":
+			mock.ExpectExec(`UPDATE email_forwards SET next_attempt_at=\$1, last_error=\$2`).
+				WithArgs(sqlmock.AnyArg(), "connection refused", int64(3)).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+	}
+
+	require.NoError(t, f.run())
+	assert.Equal(t, []string{"alice@partner.example", "bob@partner.example", "carol@partner.example"}, sent)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEmailForwardingHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	since := time.Now()
+	put := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPut, "/api/account/email-forwarding", strings.NewReader(body))
+		req = req.WithContext(withIdentity(req.Context(), "alice", roleUser))
+		rr := httptest.NewRecorder()
+		emailForwardingHandler(db).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := put(`{"address":"alice@partner.example","enabled":true}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "email forwarding is not available on this server\n", rr.Body.String())
+
+	saved := appConfig.SMTP
+	defer func() { appConfig.SMTP = saved }()
+	appConfig.SMTP.Relay = "127.0.0.1:2525"
+
+	assert.Equal(t, http.StatusBadRequest, put(`{"address":"Alice <alice@partner.example>","enabled":true}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put(`{"enabled":true}`).Code)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE users SET forward_email=\$1`).
+		WithArgs("alice@partner.example", true, "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"forward_email", "forward_since"}).AddRow("alice@partner.example", since))
+	expectAudit(mock, auditAccountEmailForwarding)
+	mock.ExpectCommit()
+	rr = put(`{"address":" alice@partner.example ","enabled":true}`)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.JSONEq(t, `{"address":"alice@partner.example","enabled":true,"since":"`+since.Format(time.RFC3339Nano)+`"}`, rr.Body.String())
+
+	mock.ExpectQuery(`SELECT forward_email, forward_since FROM users`).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"forward_email", "forward_since"}).AddRow("alice@partner.example", nil))
+	req, _ := http.NewRequest(http.MethodGet, "/api/account/email-forwarding", nil)
+	req = req.WithContext(withIdentity(req.Context(), "alice", roleUser))
+	rr = httptest.NewRecorder()
+	emailForwardingHandler(db).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"address":"alice@partner.example","enabled":false}`, rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
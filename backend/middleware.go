@@ -4,43 +4,78 @@ import (
 	"context"
 	"net/http"
 	"strings"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("username")
+const (
+	userContextKey = contextKey("username")
+	roleContextKey = contextKey("role")
+)
 
 func jwtAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		setCORS(w, r)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
+		if key, ok := apiKeyToken(r); ok {
+			serveWithAPIKey(w, r, key, next)
 			return
 		}
-
-		authHeader := r.Header.Get("Authorization")
-		if !strings.HasPrefix(authHeader, "Bearer ") {
+		tokenString, ok := bearerToken(r)
+		if !ok {
+			// Gateways authenticate with a client certificate instead of
+			// a bearer token.
+			if username, presented, mapped := clientCertIdentity(r); presented {
+				if !mapped {
+					http.Error(w, "unknown client certificate", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), username, roleUser)))
+				return
+			}
 			http.Error(w, "missing auth token", http.StatusUnauthorized)
 			return
 		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-		if err != nil || !token.Valid {
+		claims, err := parseToken(tokenString)
+		if err != nil {
 			http.Error(w, "invalid auth token", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), userContextKey, claims.Username)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), claims.Username, claims.Role)))
 	})
 }
 
+// requireRole rejects callers whose role is not one of roles. It must run
+// inside jwtAuthMiddleware.
+func requireRole(next http.Handler, roles ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := getRole(r.Context())
+		for _, allowed := range roles {
+			if role == allowed {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
+
+func withIdentity(ctx context.Context, username, role string) context.Context {
+	if role == "" {
+		role = roleUser
+	}
+	ctx = context.WithValue(ctx, userContextKey, username)
+	return context.WithValue(ctx, roleContextKey, role)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(authHeader, "Bearer "), true
+}
+
 func getUsername(ctx context.Context) (string, bool) {
 	v := ctx.Value(userContextKey)
 	if s, ok := v.(string); ok && s != "" {
@@ -48,3 +83,11 @@ func getUsername(ctx context.Context) (string, bool) {
 	}
 	return "", false
 }
+
+// getRole returns the caller's role, defaulting to roleUser.
+func getRole(ctx context.Context) string {
+	if s, ok := ctx.Value(roleContextKey).(string); ok && s != "" {
+		return s
+	}
+	return roleUser
+}
@@ -1,24 +1,252 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+// User roles. Supervisors manage legal holds and retention reports; admins
+// can do everything supervisors can.
+const (
+	roleUser       = "user"
+	roleSupervisor = "supervisor"
+	roleAdmin      = "admin"
+)
+
+// AFTN priority indicators, most urgent first.
+const (
+	priorityDistress = "SS"
+	priorityUrgency  = "DD"
+	prioritySafety   = "FF"
+	priorityRegular  = "GG"
+	priorityAdmin    = "KK"
+	defaultPriority  = priorityRegular
+)
+
+var messagePriorities = []string{priorityDistress, priorityUrgency, prioritySafety, priorityRegular, priorityAdmin}
 
 type User struct {
 	ID           int64     `json:"id"`
 	Username     string    `json:"username"`
 	PasswordHash string    `json:"-"`
+	Role         string    `json:"role"`
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// ServiceAccount is an account for scripts and gateways, which
+// authenticate with API keys instead of a password.
+type ServiceAccount struct {
+	ID          int64     `json:"id"`
+	Username    string    `json:"username"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// APIKey describes a service account's key. Key is only set in the
+// response that creates it; afterwards the key is known by Prefix.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Username   string     `json:"username"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	Key        string     `json:"key,omitempty"`
+}
+
 type Message struct {
-	ID               int64     `json:"id"`
-	Sender           string    `json:"sender"`
-	Receiver         string    `json:"receiver"`
-	Subject          string    `json:"subject"`
-	Body             string    `json:"body"`
-	IsRead           bool      `json:"is_read"`
-	ReceiverArchived bool      `json:"receiver_archived"`
-	SenderArchived   bool      `json:"sender_archived"`
-	CreatedAt        time.Time `json:"created_at"`
+	ID                int64          `json:"id"`
+	Sender            string         `json:"sender"`
+	Receiver          string         `json:"receiver"`
+	Subject           string         `json:"subject"`
+	Body              string         `json:"body"`
+	Priority          string         `json:"priority"`
+	IsRead            bool           `json:"is_read"`
+	ReceiverArchived  bool           `json:"receiver_archived"`
+	SenderArchived    bool           `json:"sender_archived"`
+	ReceiverDeletedAt *time.Time     `json:"receiver_deleted_at"`
+	SenderDeletedAt   *time.Time     `json:"sender_deleted_at"`
+	InReplyTo         *int64         `json:"in_reply_to"`
+	ThreadID          int64          `json:"thread_id"`
+	CreatedAt         time.Time      `json:"created_at"`
+	DeliverAt         *time.Time     `json:"deliver_at"`
+	DeliveredAt       *time.Time     `json:"delivered_at"`
+	ExpiresAt         *time.Time     `json:"expires_at"`
+	Expired           bool           `json:"expired"`
+	Originator        string         `json:"originator"`
+	FilingTime        string         `json:"filing_time"`
+	ChannelSeq        string         `json:"channel_seq"`
+	PossibleDuplicate bool           `json:"possible_duplicate"`
+	DuplicateOf       *int64         `json:"duplicate_of"`
+	Route             string         `json:"route"`
+	NextHop           string         `json:"next_hop"`
+	Suppressed        bool           `json:"-"`
+	Attachments       []Attachment   `json:"attachments,omitempty"`
+	Distribution      *ListExpansion `json:"distribution,omitempty"`
+}
+
+// Attachment is a body part of a message. The file itself lives in the
+// attachment store under StorageKey.
+type Attachment struct {
+	ID          int64     `json:"id"`
+	MessageID   int64     `json:"message_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	StorageKey  string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Draft is an unsent message. Version increases with every save so that
+// concurrent editors cannot silently overwrite each other.
+type Draft struct {
+	ID        int64     `json:"id"`
+	Owner     string    `json:"owner"`
+	Receiver  string    `json:"receiver"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	Priority  string    `json:"priority"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DistributionList is a named set of recipients. Global lists have no
+// owner and are managed by admins; personal lists shadow global ones of
+// the same name.
+type DistributionList struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Owner       string    `json:"owner,omitempty"`
+	Global      bool      `json:"global"`
+	Description string    `json:"description"`
+	Members     []string  `json:"members"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ListExpansion records a submission addressed to a distribution list:
+// the members it resolved to at the time and the messages sent to them.
+type ListExpansion struct {
+	ID         int64     `json:"id"`
+	ListID     *int64    `json:"list_id"`
+	List       string    `json:"list"`
+	Sender     string    `json:"sender"`
+	Recipients []string  `json:"recipients"`
+	MessageIDs []int64   `json:"message_ids"`
+	CreatedAt  time.Time `json:"created_at"`
+	Messages   []Message `json:"messages,omitempty"`
+}
+
+// DirectoryEntry lists a station in the address book under the username
+// that receives its traffic.
+type DirectoryEntry struct {
+	ID                int64     `json:"id"`
+	Username          string    `json:"username"`
+	AFTNAddress       string    `json:"aftn_address"`
+	Organisation      string    `json:"organisation"`
+	LocationIndicator string    `json:"location_indicator"`
+	DisplayName       string    `json:"display_name"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// Route sends traffic for AFTN addresses starting with Pattern to NextHop,
+// a neighbouring MTA, or to local delivery when NextHop is empty.
+type Route struct {
+	ID          int64     `json:"id"`
+	Pattern     string    `json:"pattern"`
+	NextHop     string    `json:"next_hop"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// OutboundItem is a message waiting in, or dead-lettered from, the
+// outbound queue of a next hop.
+type OutboundItem struct {
+	ID            int64      `json:"id"`
+	MessageID     int64      `json:"message_id"`
+	NextHop       string     `json:"next_hop"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	SentAt        *time.Time `json:"sent_at"`
+	Sender        string     `json:"sender"`
+	Receiver      string     `json:"receiver"`
+	Subject       string     `json:"subject"`
+}
+
+// RelayPeerStats is the outbound queue depth of one next hop. Configured
+// is false when neither a peer nor the AFTN gateway goes by that name, so
+// nothing is relayed.
+type RelayPeerStats struct {
+	NextHop       string     `json:"next_hop"`
+	Configured    bool       `json:"configured"`
+	Pending       int64      `json:"pending"`
+	Sending       int64      `json:"sending"`
+	Dead          int64      `json:"dead"`
+	OldestPending *time.Time `json:"oldest_pending"`
+}
+
+type RelayQueue struct {
+	Peers  []RelayPeerStats `json:"peers"`
+	Failed []OutboundItem   `json:"failed"`
+}
+
+// EmailForwarding is a user's choice to have their messages sent on to an
+// external email address. Since is when forwarding was turned on.
+type EmailForwarding struct {
+	Address string     `json:"address"`
+	Enabled bool       `json:"enabled"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// Webhook subscribes a URL to events: those of the user who created it,
+// or with AllUsers those of every user. Empty Priorities means any.
+type Webhook struct {
+	ID         int64     `json:"id"`
+	CreatedBy  string    `json:"created_by"`
+	URL        string    `json:"url"`
+	Events     []string  `json:"events"`
+	Priorities []string  `json:"priorities"`
+	AllUsers   bool      `json:"all_users"`
+	Active     bool      `json:"active"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID            int64            `json:"id"`
+	WebhookID     int64            `json:"webhook_id"`
+	Event         string           `json:"event"`
+	Username      string           `json:"username"`
+	Payload       json.RawMessage  `json:"payload"`
+	Status        string           `json:"status"`
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"`
+	LastError     string           `json:"last_error,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	DeliveredAt   *time.Time       `json:"delivered_at,omitempty"`
+	Log           []WebhookAttempt `json:"log,omitempty"`
+}
+
+// WebhookAttempt is one try at a delivery. StatusCode is 0 when no
+// response came back.
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
 }
 
 type PaginatedMessagesResponse struct {
@@ -32,3 +260,45 @@ type Pagination struct {
 	CurrentPage int   `json:"currentPage"`
 	PageSize    int   `json:"pageSize"`
 }
+
+// LegalHold keeps every message sent inside [From, To) — optionally only
+// those to or from Mailbox — from being purged until it is released.
+type LegalHold struct {
+	ID         int64      `json:"id"`
+	Reason     string     `json:"reason"`
+	Mailbox    *string    `json:"mailbox"`
+	From       time.Time  `json:"from"`
+	To         time.Time  `json:"to"`
+	PlacedBy   string     `json:"placed_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReleasedBy *string    `json:"released_by"`
+	ReleasedAt *time.Time `json:"released_at"`
+}
+
+type PurgeReport struct {
+	ID       int64           `json:"id"`
+	RanAt    time.Time       `json:"ran_at"`
+	Purged   []PurgedMessage `json:"purged"`
+	Held     int             `json:"held"`
+	Retained int             `json:"retained"`
+}
+
+type PurgedMessage struct {
+	ID        int64     `json:"id"`
+	Sender    string    `json:"sender"`
+	Receiver  string    `json:"receiver"`
+	Priority  string    `json:"priority"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuditEntry is one link in the hash-chained audit log.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	MessageID  *int64          `json:"message_id"`
+	Details    json.RawMessage `json:"details"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
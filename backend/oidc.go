@@ -0,0 +1,451 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"mini-amhs/config"
+)
+
+const (
+	// oidcLoginTTL is how long a started login may take to come back.
+	oidcLoginTTL = 10 * time.Minute
+	// oidcStateCookie binds a login to the browser that started it.
+	oidcStateCookie = "amhs_oidc_state"
+	// oidcKeyRefresh limits how often the provider's keys are refetched
+	// for an unknown kid.
+	oidcKeyRefresh = 30 * time.Second
+)
+
+// oidcSigningMethods are the ID token algorithms accepted.
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}
+
+// roleRank orders roles by privilege.
+var roleRank = map[string]int{roleUser: 0, roleSupervisor: 1, roleAdmin: 2}
+
+// oidcDiscovery holds the provider metadata used here.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider talks to the OpenID Connect provider. Its metadata and keys
+// are fetched on first use and cached.
+type oidcProvider struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+func newOIDCProvider(cfg config.OIDCConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *oidcProvider) getJSON(u string, v any) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider metadata.
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta oidcDiscovery
+	if err := p.getJSON(strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: endpoints missing")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// key returns the provider's signing key kid, refetching the key set when
+// the kid is unknown, as after a rotation at the provider.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeyRefresh {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	var set jwkSet
+	if err := p.getJSON(meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+	p.keys = map[string]crypto.PublicKey{}
+	p.keysFetched = time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("oidc: skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		p.keys[k.Kid] = pub
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// authCodeURL is where the browser is sent to log in.
+func (p *oidcProvider) authCodeURL(state, nonce, verifier string) (string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// exchange redeems an authorization code for an ID token.
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || out.Error != "" {
+		return "", fmt.Errorf("token endpoint answered %d: %s %s", resp.StatusCode, out.Error, out.ErrorDescription)
+	}
+	if out.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return out.IDToken, nil
+}
+
+// verifyIDToken checks an ID token's signature against the provider's
+// keys, its issuer, audience, expiry and nonce, and returns its claims.
+func (p *oidcProvider) verifyIDToken(raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+	// With several audiences, the token must have been issued to us.
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.cfg.ClientID {
+			return nil, errors.New("id token azp does not match")
+		}
+	}
+	return claims, nil
+}
+
+// oidcIdentity is what a verified ID token says about the user.
+type oidcIdentity struct {
+	Subject  string
+	Username string
+	Role     string
+}
+
+// identity reads the user's subject, username and role from claims.
+func (p *oidcProvider) identity(claims jwt.MapClaims) (oidcIdentity, error) {
+	var id oidcIdentity
+	id.Subject, _ = claims.GetSubject()
+	if id.Subject == "" {
+		return id, errors.New("id token has no subject")
+	}
+	id.Username, _ = claims[p.cfg.UsernameClaim].(string)
+	id.Username = strings.TrimSpace(id.Username)
+	if err := validateUsername(id.Username); err != nil {
+		return id, fmt.Errorf("claim %s: %w", p.cfg.UsernameClaim, err)
+	}
+	id.Role = p.cfg.DefaultRole
+	for _, g := range claimStrings(claims[p.cfg.GroupsClaim]) {
+		if role, ok := p.cfg.RoleMapping[g]; ok && roleRank[role] > roleRank[id.Role] {
+			id.Role = role
+		}
+	}
+	return id, nil
+}
+
+// claimStrings reads a claim that is a string or a list of strings.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// randomToken returns n random bytes, base64url encoded.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge is the S256 code challenge for verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// oidcLoginHandler serves GET /api/auth/oidc/login. It starts an
+// authorization code flow with PKCE and sends the browser to the provider.
+func oidcLoginHandler(db *sql.DB, p *oidcProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state, nonce, verifier string
+		var err error
+		for _, v := range []*string{&state, &nonce, &verifier} {
+			if *v, err = randomToken(32); err != nil {
+				log.Println("oidc random error:", err)
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		target, err := p.authCodeURL(state, nonce, verifier)
+		if err != nil {
+			log.Println("oidc login error:", err)
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+
+		if _, err := db.Exec(`DELETE FROM oidc_logins WHERE created_at < $1`, time.Now().Add(-oidcLoginTTL)); err != nil {
+			log.Println("delete oidc logins error:", err)
+		}
+		if _, err := db.Exec(
+			`INSERT INTO oidc_logins(state, nonce, code_verifier) VALUES($1,$2,$3)`,
+			state, nonce, verifier,
+		); err != nil {
+			log.Println("insert oidc login error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/api/auth/oidc",
+			MaxAge:   int(oidcLoginTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(p.cfg.RedirectURL, "https:"),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
+
+// oidcCallbackHandler serves GET /api/auth/oidc/callback, where the
+// provider sends the browser back. The user is created on first login and
+// their role follows their groups on every login. The browser is sent on
+// to the frontend with a token in the URL fragment.
+func oidcCallbackHandler(db *sql.DB, p *oidcProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			http.Error(w, "login failed at the identity provider: "+e, http.StatusUnauthorized)
+			return
+		}
+		state := query.Get("state")
+		cookie, err := r.Cookie(oidcStateCookie)
+		if state == "" || err != nil || cookie.Value != state {
+			http.Error(w, "login state mismatch; start again", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/auth/oidc", MaxAge: -1})
+
+		var nonce, verifier string
+		err = db.QueryRow(
+			`DELETE FROM oidc_logins WHERE state=$1 AND created_at >= $2 RETURNING nonce, code_verifier`,
+			state, time.Now().Add(-oidcLoginTTL),
+		).Scan(&nonce, &verifier)
+		if err == sql.ErrNoRows {
+			http.Error(w, "login expired; start again", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("select oidc login error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		rawIDToken, err := p.exchange(query.Get("code"), verifier)
+		if err != nil {
+			log.Println("oidc code exchange error:", err)
+			http.Error(w, "identity provider refused the login", http.StatusBadGateway)
+			return
+		}
+		claims, err := p.verifyIDToken(rawIDToken, nonce)
+		if err != nil {
+			log.Println("oidc id token error:", err)
+			http.Error(w, "invalid id token", http.StatusUnauthorized)
+			return
+		}
+		id, err := p.identity(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		user, err := provisionOIDCUser(db, id)
+		if errors.Is(err, errAccountTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println("oidc provisioning error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		token, err := issueToken(user)
+		if err != nil {
+			log.Println("jwt sign error:", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, p.cfg.PostLoginURL+"#"+url.Values{"token": {token}}.Encode(), http.StatusFound)
+	})
+}
+
+var errAccountTaken = errors.New("username belongs to another account")
+
+// provisionOIDCUser creates the user on first login and updates their
+// role afterwards. Accounts are linked by subject, so a single sign-on
+// user never takes over a local account of the same name.
+func provisionOIDCUser(db *sql.DB, id oidcIdentity) (User, error) {
+	var user User
+	err := withTx(db, func(tx *sql.Tx) error {
+		var created bool
+		err := tx.QueryRow(
+			`INSERT INTO users(username, password_hash, role, oidc_subject) VALUES($1, '', $2, $3)
+			 ON CONFLICT (username) DO UPDATE SET role=EXCLUDED.role WHERE users.oidc_subject = EXCLUDED.oidc_subject
+			 RETURNING id, username, created_at, role, xmax = 0`,
+			id.Username, id.Role, id.Subject,
+		).Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Role, &created)
+		if err == sql.ErrNoRows {
+			return errAccountTaken
+		}
+		if err != nil {
+			if strings.Contains(strings.ToLower(err.Error()), "unique") {
+				return errAccountTaken
+			}
+			return err
+		}
+		details := map[string]any{"via": "oidc", "role": user.Role}
+		if created {
+			if err := appendAudit(tx, user.Username, auditUserRegister, 0, details); err != nil {
+				return err
+			}
+		}
+		return appendAudit(tx, user.Username, auditUserLogin, 0, details)
+	})
+	return user, err
+}
+
+// localLoginDisabled answers 403 when password login is turned off.
+func localLoginDisabled(w http.ResponseWriter) bool {
+	if !appConfig.OIDC.DisableLocalLogin {
+		return false
+	}
+	http.Error(w, "password login is disabled; sign in with single sign-on", http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"mini-amhs/config"
+)
+
+// startMockOIDC runs the bundled mock provider and returns a client
+// configuration for it.
+func startMockOIDC(t *testing.T) (*mockOIDCProvider, config.OIDCConfig) {
+	var mock *mockOIDCProvider
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mock.handler().ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	mock, err := newMockOIDCProvider(srv.URL, "mini-amhs", "s3cret")
+	require.NoError(t, err)
+	return mock, config.OIDCConfig{
+		Issuer:        srv.URL,
+		ClientID:      "mini-amhs",
+		ClientSecret:  "s3cret",
+		RedirectURL:   "http://amhs.test/api/auth/oidc/callback",
+		PostLoginURL:  "http://app.test/login",
+		Scopes:        []string{"openid", "profile"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		RoleMapping:   map[string]string{"amhs-admins": roleAdmin, "ops-supervisors": roleSupervisor},
+		DefaultRole:   roleUser,
+	}
+}
+
+var noRedirects = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+// startOIDCLogin runs the login handler and signs in at the mock provider
+// as username, returning the callback request and the stored login.
+func startOIDCLogin(t *testing.T, db *sql.DB, mock sqlmock.Sqlmock, p *oidcProvider, username, groups string) (*http.Request, *captureArg, *captureArg) {
+	nonce, verifier := &captureArg{}, &captureArg{}
+	mock.ExpectExec(`DELETE FROM oidc_logins WHERE created_at < \$1`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO oidc_logins\(state, nonce, code_verifier\)`).
+		WithArgs(sqlmock.AnyArg(), nonce, verifier).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rr := httptest.NewRecorder()
+	oidcLoginHandler(db, p).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+	cookies := rr.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.True(t, cookies[0].HttpOnly)
+
+	authorize, err := url.Parse(rr.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "S256", authorize.Query().Get("code_challenge_method"))
+	assert.Equal(t, "openid profile", authorize.Query().Get("scope"))
+	q := authorize.Query()
+	q.Set("username", username)
+	q.Set("groups", groups)
+	authorize.RawQuery = q.Encode()
+	resp, err := noRedirects.Get(authorize.String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	callback := resp.Header.Get("Location")
+	require.True(t, strings.HasPrefix(callback, "http://amhs.test/api/auth/oidc/callback?"), callback)
+
+	req := httptest.NewRequest(http.MethodGet, callback, nil)
+	req.AddCookie(cookies[0])
+	return req, nonce, verifier
+}
+
+func TestOIDCLogin_Flow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	jwtKey = []byte("test-secret")
+	_, cfg := startMockOIDC(t)
+	p := newOIDCProvider(cfg)
+
+	req, nonce, verifier := startOIDCLogin(t, db, mock, p, "alice", "ops-supervisors, amhs-admins")
+	state := req.URL.Query().Get("state")
+	mock.ExpectQuery(`DELETE FROM oidc_logins WHERE state=\$1 AND created_at >= \$2 RETURNING nonce, code_verifier`).
+		WithArgs(state, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier"}).AddRow(nonce.v, verifier.v))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO users\(username, password_hash, role, oidc_subject\)`).
+		WithArgs("alice", roleAdmin, "mock|alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "created_at", "role", "created"}).AddRow(4, "alice", time.Now(), roleAdmin, true))
+	expectAudit(mock, auditUserRegister)
+	expectAudit(mock, auditUserLogin)
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	oidcCallbackHandler(db, p).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusFound, rr.Code, rr.Body.String())
+	location := rr.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, "http://app.test/login#token="), location)
+
+	fragment, err := url.ParseQuery(strings.SplitN(location, "#", 2)[1])
+	require.NoError(t, err)
+	claims, err := parseToken(fragment.Get("token"))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Username)
+	assert.Equal(t, roleAdmin, claims.Role)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOIDCCallback_Refusals(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	_, cfg := startMockOIDC(t)
+	p := newOIDCProvider(cfg)
+	callback := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		oidcCallbackHandler(db, p).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Without the browser's state cookie, as in a forged callback.
+	req, _, _ := startOIDCLogin(t, db, mock, p, "mallory", "")
+	forged := httptest.NewRequest(http.MethodGet, req.URL.String(), nil)
+	assert.Equal(t, http.StatusBadRequest, callback(forged).Code)
+
+	// A wrong PKCE verifier is refused by the provider.
+	req, nonce, _ := startOIDCLogin(t, db, mock, p, "bob", "")
+	mock.ExpectQuery(`DELETE FROM oidc_logins WHERE state=\$1`).
+		WithArgs(req.URL.Query().Get("state"), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier"}).AddRow(nonce.v, "not-the-verifier"))
+	assert.Equal(t, http.StatusBadGateway, callback(req).Code)
+
+	// A local account with the same name is not taken over.
+	req, nonce, verifier := startOIDCLogin(t, db, mock, p, "carol", "")
+	mock.ExpectQuery(`DELETE FROM oidc_logins WHERE state=\$1`).
+		WithArgs(req.URL.Query().Get("state"), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier"}).AddRow(nonce.v, verifier.v))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO users`).
+		WithArgs("carol", roleUser, "mock|carol").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	rr := callback(req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, "username belongs to another account\n", rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOIDCProvider_VerifyIDToken(t *testing.T) {
+	mock, cfg := startMockOIDC(t)
+	p := newOIDCProvider(cfg)
+	sign := func(method jwt.SigningMethod, key any, claims jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(method, claims)
+		tok.Header["kid"] = mock.kid
+		s, err := tok.SignedString(key)
+		require.NoError(t, err)
+		return s
+	}
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"iss": cfg.Issuer, "aud": "mini-amhs", "sub": "mock|dave", "nonce": "n1",
+			"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix(), "preferred_username": "dave"}
+	}
+
+	got, err := p.verifyIDToken(sign(jwt.SigningMethodRS256, mock.key, claims()), "n1")
+	require.NoError(t, err)
+	id, err := p.identity(got)
+	require.NoError(t, err)
+	assert.Equal(t, oidcIdentity{Subject: "mock|dave", Username: "dave", Role: roleUser}, id)
+
+	_, err = p.verifyIDToken(sign(jwt.SigningMethodRS256, mock.key, claims()), "n2")
+	assert.EqualError(t, err, "id token nonce does not match")
+
+	c := claims()
+	c["aud"] = "someone-else"
+	_, err = p.verifyIDToken(sign(jwt.SigningMethodRS256, mock.key, c), "n1")
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidAudience)
+
+	c = claims()
+	c["iss"] = "https://evil.example"
+	_, err = p.verifyIDToken(sign(jwt.SigningMethodRS256, mock.key, c), "n1")
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+
+	// An HMAC token "signed" with the public key must not pass.
+	_, err = p.verifyIDToken(sign(jwt.SigningMethodHS256, []byte("anything"), claims()), "n1")
+	assert.ErrorIs(t, err, jwt.ErrTokenSignatureInvalid)
+}
+
+func TestOIDCProvider_Identity(t *testing.T) {
+	p := newOIDCProvider(config.OIDCConfig{
+		UsernameClaim: "preferred_username", GroupsClaim: "groups", DefaultRole: roleUser,
+		RoleMapping: map[string]string{"amhs-admins": roleAdmin, "ops-supervisors": roleSupervisor},
+	})
+	id, err := p.identity(jwt.MapClaims{"sub": "s1", "preferred_username": "erin", "groups": "ops-supervisors"})
+	require.NoError(t, err)
+	assert.Equal(t, roleSupervisor, id.Role)
+
+	_, err = p.identity(jwt.MapClaims{"sub": "s2", "preferred_username": "erin@example.com"})
+	assert.EqualError(t, err, "claim preferred_username: username must not contain @")
+	_, err = p.identity(jwt.MapClaims{"preferred_username": "erin"})
+	assert.EqualError(t, err, "id token has no subject")
+}
+
+func TestLocalLoginDisabled(t *testing.T) {
+	saved := appConfig.OIDC
+	defer func() { appConfig.OIDC = saved }()
+	appConfig.OIDC.DisableLocalLogin = true
+
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"alice","password":"password1"}`))
+	rr := httptest.NewRecorder()
+	loginHandler(nil).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "password login is disabled; sign in with single sign-on\n", rr.Body.String())
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockOIDCCodeTTL is how long an authorization code of the mock provider
+// can be redeemed.
+const mockOIDCCodeTTL = time.Minute
+
+// mockOIDCProvider is a stand-in OpenID Connect provider for local testing
+// of single sign-on. Anyone can log in as any user with any groups.
+type mockOIDCProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+	kid          string
+
+	mu    sync.Mutex
+	codes map[string]mockOIDCCode
+}
+
+// mockOIDCCode is an issued authorization code.
+type mockOIDCCode struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	username    string
+	groups      []string
+	expires     time.Time
+}
+
+func newMockOIDCProvider(issuer, clientID, clientSecret string) (*mockOIDCProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomToken(8)
+	if err != nil {
+		return nil, err
+	}
+	return &mockOIDCProvider{
+		issuer: strings.TrimSuffix(issuer, "/"), clientID: clientID, clientSecret: clientSecret,
+		key: key, kid: kid, codes: map[string]mockOIDCCode{},
+	}, nil
+}
+
+// runOIDCMock implements the oidc-mock subcommand.
+func runOIDCMock(args []string) int {
+	fs := flag.NewFlagSet("oidc-mock", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:9400", "address to serve on")
+	issuer := fs.String("issuer", "", "issuer URL (default http://<listen>)")
+	clientID := fs.String("client-id", "mini-amhs", "client id to accept")
+	clientSecret := fs.String("client-secret", "", "client secret to require (empty for a public client)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Printf("oidc-mock: %v", err)
+		return 1
+	}
+	if *issuer == "" {
+		*issuer = "http://" + ln.Addr().String()
+	}
+	p, err := newMockOIDCProvider(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Printf("oidc-mock: %v", err)
+		return 1
+	}
+	log.Printf("oidc-mock serving issuer %s for client %s", p.issuer, p.clientID)
+	if err := http.Serve(ln, p.handler()); err != nil {
+		log.Printf("oidc-mock: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func (p *mockOIDCProvider) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                p.issuer,
+			"authorization_endpoint":                p.issuer + "/authorize",
+			"token_endpoint":                        p.issuer + "/token",
+			"jwks_uri":                              p.issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		k, _ := publicJWK(p.kid, "RS256", &p.key.PublicKey)
+		writeJSON(w, jwkSet{Keys: []jwk{k}})
+	})
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	return mux
+}
+
+var mockOIDCLoginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<title>Mock OIDC login</title>
+<h1>Mock OIDC login</h1>
+<p>Signing in to <b>{{.ClientID}}</b>. Any username is accepted.</p>
+<form method="get" action="/authorize">
+{{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}<p><label>Username <input name="username" required autofocus></label></p>
+<p><label>Groups (comma-separated) <input name="groups"></label></p>
+<p><button>Sign in</button></p>
+</form>
+`))
+
+// authorize serves the login page, and once a username is filled in
+// sends the browser back to the client with a code.
+func (p *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != p.clientID {
+		http.Error(w, "unsupported response_type or unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	username := strings.TrimSpace(q.Get("username"))
+	if username == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mockOIDCLoginPage.Execute(w, map[string]any{"ClientID": p.clientID, "Params": q})
+		return
+	}
+
+	var groups []string
+	for _, g := range strings.Split(q.Get("groups"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	code, err := randomToken(24)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	p.mu.Lock()
+	p.codes[code] = mockOIDCCode{
+		redirectURI: redirectURI.String(), challenge: q.Get("code_challenge"), nonce: q.Get("nonce"),
+		username: username, groups: groups, expires: time.Now().Add(mockOIDCCodeTTL),
+	}
+	p.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// tokenError answers a token request with an OAuth2 error.
+func tokenError(w http.ResponseWriter, code int, e, desc string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	writeJSON(w, map[string]string{"error": e, "error_description": desc})
+}
+
+// token redeems a code for an ID token, checking the client and the PKCE
+// verifier.
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID || (p.clientSecret != "" && secret != p.clientSecret) {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+
+	p.mu.Lock()
+	c, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	switch {
+	case !ok || time.Now().After(c.expires):
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	case r.PostForm.Get("redirect_uri") != c.redirectURI:
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match")
+		return
+	case pkceChallenge(r.PostForm.Get("code_verifier")) != c.challenge:
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                p.issuer,
+		"sub":                "mock|" + c.username,
+		"aud":                p.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"preferred_username": c.username,
+		"email":              c.username + "@example.test",
+		"groups":             append([]string{}, c.groups...),
+	}
+	if c.nonce != "" {
+		claims["nonce"] = c.nonce
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = p.kid
+	idToken, err := t.SignedString(p.key)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken, _ := randomToken(24)
+	writeJSON(w, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
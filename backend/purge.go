@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"mini-amhs/config"
+)
+
+// purgeDeletedMessages hard-deletes messages that both parties have moved
+// to the trash, once the later of the two deletions is older than
+// trashRetention. Messages still inside their regulatory retention period
+// or covered by a legal hold are kept. Runs that considered any message
+// are recorded in retention_reports. Attachment files of purged messages
+// are removed from store once the deletion has committed.
+func purgeDeletedMessages(db *sql.DB, store attachmentStore, trashRetention time.Duration, policy retentionPolicy, now time.Time) (PurgeReport, error) {
+	report := PurgeReport{RanAt: now, Purged: []PurgedMessage{}}
+
+	rows, err := db.Query(
+		`SELECT m.id, m.sender, m.receiver, m.priority, m.created_at, `+heldCondition+`
+		 FROM messages m
+		 WHERE m.receiver_deleted_at IS NOT NULL
+		   AND m.sender_deleted_at IS NOT NULL
+		   AND GREATEST(m.receiver_deleted_at, m.sender_deleted_at) < NOW() - make_interval(secs => $1)`,
+		trashRetention.Seconds(),
+	)
+	if err != nil {
+		return report, err
+	}
+	var expired []int64
+	for rows.Next() {
+		var m PurgedMessage
+		var held bool
+		if err := rows.Scan(&m.ID, &m.Sender, &m.Receiver, &m.Priority, &m.CreatedAt, &held); err != nil {
+			rows.Close()
+			return report, err
+		}
+		switch {
+		case held:
+			report.Held++
+		case now.Before(m.CreatedAt.Add(policy.periodFor(m.Sender, m.Receiver, m.Priority))):
+			report.Retained++
+		default:
+			expired = append(expired, m.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	if len(expired) == 0 && report.Held == 0 && report.Retained == 0 {
+		return report, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	// Re-check holds here: one may have been placed since the scan.
+	storageKeys := map[int64][]string{}
+	if len(expired) > 0 {
+		rows, err = tx.Query(`SELECT message_id, storage_key FROM attachments WHERE message_id = ANY($1)`, pq.Array(expired))
+		if err != nil {
+			return report, err
+		}
+		for rows.Next() {
+			var id int64
+			var key string
+			if err := rows.Scan(&id, &key); err != nil {
+				rows.Close()
+				return report, err
+			}
+			storageKeys[id] = append(storageKeys[id], key)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return report, err
+		}
+
+		rows, err = tx.Query(
+			`DELETE FROM messages m
+			 WHERE m.id = ANY($1) AND NOT `+heldCondition+`
+			 RETURNING m.id, m.sender, m.receiver, m.priority, m.created_at`,
+			pq.Array(expired),
+		)
+		if err != nil {
+			return report, err
+		}
+		for rows.Next() {
+			var m PurgedMessage
+			if err := rows.Scan(&m.ID, &m.Sender, &m.Receiver, &m.Priority, &m.CreatedAt); err != nil {
+				rows.Close()
+				return report, err
+			}
+			report.Purged = append(report.Purged, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return report, err
+		}
+		report.Held += len(expired) - len(report.Purged)
+		for _, m := range report.Purged {
+			if err := appendAudit(tx, auditSystemActor, auditMessagePurge, m.ID, nil); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	purged, err := json.Marshal(report.Purged)
+	if err != nil {
+		return report, err
+	}
+	err = tx.QueryRow(
+		`INSERT INTO retention_reports(ran_at, purged_count, held_count, retained_count, purged)
+		 VALUES($1,$2,$3,$4,$5) RETURNING id`,
+		report.RanAt, len(report.Purged), report.Held, report.Retained, purged,
+	).Scan(&report.ID)
+	if err != nil {
+		return report, err
+	}
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+
+	for _, m := range report.Purged {
+		for _, key := range storageKeys[m.ID] {
+			if err := store.Delete(key); err != nil {
+				log.Println("purge attachment error:", err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// runPurgeJob purges the trash, and forgets expired idempotency keys, every
+// cfg.PurgeInterval until ctx is done.
+func runPurgeJob(ctx context.Context, db *sql.DB, store attachmentStore, cfg config.TrashConfig, policy retentionPolicy) {
+	ticker := time.NewTicker(cfg.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := purgeDeletedMessages(db, store, cfg.Retention, policy, time.Now())
+			if err != nil {
+				log.Println("purge error:", err)
+				continue
+			}
+			if report.ID != 0 {
+				log.Printf("purge run %d: purged %d, held %d, inside retention %d",
+					report.ID, len(report.Purged), report.Held, report.Retained)
+			}
+			if _, err := pruneIdempotencyKeys(db, appConfig.Idempotency.Window); err != nil {
+				log.Println("idempotency key prune error:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"mini-amhs/config"
+)
+
+func TestPurgeDeletedMessages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+	policy := newRetentionPolicy(config.RetentionConfig{
+		Default: 30 * 24 * time.Hour,
+		Rules:   []config.RetentionRule{{Priority: "SS", Period: 365 * 24 * time.Hour}},
+	})
+	old := now.AddDate(0, 0, -60)
+
+	mock.ExpectQuery(`SELECT m.id, m.sender, m.receiver, m.priority, m.created_at, EXISTS \(SELECT 1 FROM legal_holds h .*\) FROM messages m WHERE m.receiver_deleted_at IS NOT NULL AND m.sender_deleted_at IS NOT NULL AND GREATEST\(m.receiver_deleted_at, m.sender_deleted_at\) < NOW\(\) - make_interval\(secs => \$1\)`).
+		WithArgs(float64(7 * 24 * 3600)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "sender", "receiver", "priority", "created_at", "held"}).
+			AddRow(1, "alice", "bob", "GG", old, false). // expired: purge
+			AddRow(2, "alice", "bob", "SS", old, false). // distress traffic kept a year
+			AddRow(3, "alice", "bob", "GG", old, true))  // under legal hold
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT message_id, storage_key FROM attachments WHERE message_id = ANY\(\$1\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"message_id", "storage_key"}).AddRow(1, "0123456789abcdef0123456789abcdef"))
+	mock.ExpectQuery(`DELETE FROM messages m WHERE m.id = ANY\(\$1\) AND NOT EXISTS`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "sender", "receiver", "priority", "created_at"}).
+			AddRow(1, "alice", "bob", "GG", old))
+	expectAudit(mock, auditMessagePurge)
+	mock.ExpectQuery(`INSERT INTO retention_reports`).
+		WithArgs(now, 1, 1, 1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectCommit()
+
+	store, err := newLocalStore(t.TempDir())
+	assert.NoError(t, err)
+	key := "0123456789abcdef0123456789abcdef"
+	assert.NoError(t, store.Put(key, strings.NewReader("attachment")))
+
+	report, err := purgeDeletedMessages(db, store, 7*24*time.Hour, policy, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), report.ID)
+	assert.Len(t, report.Purged, 1)
+	assert.Equal(t, int64(1), report.Purged[0].ID)
+	assert.Equal(t, 1, report.Held)
+	assert.Equal(t, 1, report.Retained)
+	_, err = store.Open(key)
+	assert.True(t, os.IsNotExist(err), "attachment file of purged message should be removed")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"mini-amhs/config"
+)
+
+// Outbound queue item states. Sending items whose lock has lapsed (the
+// worker died mid-request) are picked up again.
+const (
+	queuePending = "pending"
+	queueSending = "sending"
+	queueSent    = "sent"
+	queueDead    = "dead"
+)
+
+const outboundItemColumns = `q.id, q.message_id, q.next_hop, q.status, q.attempts, q.next_attempt_at, q.last_error, q.created_at, q.updated_at, q.sent_at, m.sender, m.receiver, m.subject`
+
+// Relay request headers. The signature is "sha256=" and the hex HMAC of
+// the timestamp, a dot and the body, keyed with the peer's secret.
+const (
+	relayPeerHeader      = "X-Relay-Peer"
+	relayTimestampHeader = "X-Relay-Timestamp"
+	relaySignatureHeader = "X-Relay-Signature"
+	relayInboundPath     = "/api/relay/inbound"
+)
+
+// relayHop is one server a relayed message passed through.
+type relayHop struct {
+	Server string    `json:"server"`
+	At     time.Time `json:"at"`
+}
+
+type relayAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	SHA256      string `json:"sha256"`
+	Data        []byte `json:"data"`
+}
+
+// relayEnvelope is a message as it travels between servers. ID is unique
+// per originating server ("name:message id").
+type relayEnvelope struct {
+	ID          string            `json:"id"`
+	Sender      string            `json:"sender"`
+	Receiver    string            `json:"receiver"`
+	Subject     string            `json:"subject"`
+	Body        string            `json:"body"`
+	Priority    string            `json:"priority"`
+	CreatedAt   time.Time         `json:"created_at"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Originator  string            `json:"originator,omitempty"`
+	FilingTime  string            `json:"filing_time,omitempty"`
+	ChannelSeq  string            `json:"channel_seq,omitempty"`
+	Trace       []relayHop        `json:"trace"`
+	Attachments []relayAttachment `json:"attachments,omitempty"`
+}
+
+type relayBatch struct {
+	From     string          `json:"from"`
+	Messages []relayEnvelope `json:"messages"`
+}
+
+type relayRejection struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// relayResult is a peer's answer to a batch. Messages it lists in neither
+// field are retried.
+type relayResult struct {
+	Accepted []string         `json:"accepted"`
+	Rejected []relayRejection `json:"rejected"`
+}
+
+// signRelayBody returns the X-Relay-Signature value for body.
+func signRelayBody(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// relayBackoff is the wait before retrying an item that has failed
+// attempts times.
+func relayBackoff(cfg config.RelayConfig, attempts int) time.Duration {
+	return backoff(cfg.BackoffBase, cfg.BackoffMax, attempts)
+}
+
+// backoff doubles base for every attempt after the first, up to max.
+func backoff(base, max time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	return min(d, max)
+}
+
+// enqueueRelay queues msg for its next hop. Deferred messages wait in the
+// queue until their delivery time. trace lists the servers a message
+// received from a peer has passed through so far.
+func enqueueRelay(tx *sql.Tx, msg Message, trace []relayHop) error {
+	raw, err := json.Marshal(append([]relayHop{}, trace...))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO outbound_queue(message_id, next_hop, next_attempt_at, trace) VALUES($1,$2,COALESCE($3, NOW()),$4)`,
+		msg.ID, msg.NextHop, msg.DeliverAt, raw,
+	)
+	return err
+}
+
+// relayItem is a claimed queue item.
+type relayItem struct {
+	ID        int64
+	MessageID int64
+	Attempts  int
+	Trace     []relayHop
+}
+
+type relayPeer struct {
+	name string
+	cfg  config.PeerConfig
+	// slots holds one token per batch in flight.
+	slots chan struct{}
+}
+
+// relayer moves queued messages to the peers their routes name.
+type relayer struct {
+	db     *sql.DB
+	store  attachmentStore
+	cfg    config.RelayConfig
+	client *http.Client
+	peers  map[string]*relayPeer
+}
+
+func newRelayer(db *sql.DB, store attachmentStore, cfg config.RelayConfig) *relayer {
+	r := &relayer{
+		db:     db,
+		store:  store,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		peers:  map[string]*relayPeer{},
+	}
+	for name, pc := range cfg.Peers {
+		r.peers[name] = &relayPeer{name: name, cfg: pc, slots: make(chan struct{}, max(pc.Concurrency, 1))}
+	}
+	return r
+}
+
+// runRelayWorkers polls the outbound queue every cfg.PollInterval until
+// ctx is done, then waits for batches in flight.
+func runRelayWorkers(ctx context.Context, db *sql.DB, store attachmentStore, cfg config.RelayConfig) {
+	r := newRelayer(db, store, cfg)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.poll(ctx, &wg)
+		}
+	}
+}
+
+// poll retires expired items and starts a batch for every peer with a free
+// slot until the peer's due items run out.
+func (r *relayer) poll(ctx context.Context, wg *sync.WaitGroup) {
+	if n, err := r.expireQueued(); err != nil {
+		log.Println("relay expiry error:", err)
+	} else if n > 0 {
+		log.Printf("dropped %d expired messages from the outbound queue", n)
+	}
+
+	for _, peer := range r.peers {
+	claim:
+		for {
+			select {
+			case peer.slots <- struct{}{}:
+			default:
+				break claim
+			}
+			items, err := r.claim(peer.name)
+			if err != nil || len(items) == 0 {
+				if err != nil {
+					log.Printf("relay claim error for %s: %v", peer.name, err)
+				}
+				<-peer.slots
+				break claim
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-peer.slots }()
+				r.deliver(ctx, peer, items)
+			}()
+		}
+	}
+}
+
+// expireQueued dead-letters items whose message expired while queued. The
+// non-delivery notice comes from the expiry job, as for local messages.
+func (r *relayer) expireQueued() (int64, error) {
+	res, err := r.db.Exec(
+		`UPDATE outbound_queue q SET status=$1, last_error='expired before relay', locked_until=NULL, updated_at=NOW()
+		 FROM messages m
+		 WHERE m.id = q.message_id AND q.status=$2 AND m.expires_at <= NOW()`,
+		queueDead, queuePending,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// claim locks the next batch of due items for peer, most urgent first.
+func (r *relayer) claim(peer string) ([]relayItem, error) {
+	rows, err := r.db.Query(
+		`UPDATE outbound_queue SET status=$1, attempts=attempts+1, locked_until=$2, updated_at=NOW()
+		 WHERE id IN (
+		   SELECT q.id FROM outbound_queue q JOIN messages m ON m.id = q.message_id
+		   WHERE q.next_hop=$3
+		     AND ((q.status=$4 AND q.next_attempt_at <= NOW()) OR (q.status=$1 AND q.locked_until <= NOW()))
+		     AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		   ORDER BY array_position($5::text[], m.priority), q.next_attempt_at, q.id
+		   LIMIT $6
+		   FOR UPDATE OF q SKIP LOCKED)
+		 RETURNING id, message_id, attempts, trace`,
+		queueSending, time.Now().Add(r.cfg.Timeout+r.cfg.PollInterval), peer, queuePending,
+		pq.Array(messagePriorities), r.cfg.BatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []relayItem
+	for rows.Next() {
+		var it relayItem
+		var trace []byte
+		if err := rows.Scan(&it.ID, &it.MessageID, &it.Attempts, &trace); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(trace, &it.Trace); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// envelope packs msg, with its attachment contents, for the wire, adding
+// this server to the trace.
+func (r *relayer) envelope(msg Message, trace []relayHop) (relayEnvelope, error) {
+	env := relayEnvelope{
+		ID:         r.cfg.Name + ":" + strconv.FormatInt(msg.ID, 10),
+		Sender:     msg.Sender,
+		Receiver:   msg.Receiver,
+		Subject:    msg.Subject,
+		Body:       msg.Body,
+		Priority:   msg.Priority,
+		CreatedAt:  msg.CreatedAt,
+		ExpiresAt:  msg.ExpiresAt,
+		Originator: msg.Originator,
+		FilingTime: msg.FilingTime,
+		ChannelSeq: msg.ChannelSeq,
+		Trace:      append(slices.Clone(trace), relayHop{Server: r.cfg.Name, At: time.Now().UTC()}),
+	}
+	atts, err := loadAttachments(r.db, msg.ID)
+	if err != nil {
+		return env, err
+	}
+	for _, a := range atts {
+		f, err := r.store.Open(a.StorageKey)
+		if err != nil {
+			return env, err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return env, err
+		}
+		env.Attachments = append(env.Attachments, relayAttachment{
+			Filename: a.Filename, ContentType: a.ContentType, SHA256: a.SHA256, Data: data,
+		})
+	}
+	return env, nil
+}
+
+// deliver sends one batch to peer and settles each item by the outcome.
+func (r *relayer) deliver(ctx context.Context, peer *relayPeer, items []relayItem) {
+	ids := make([]int64, len(items))
+	for i, it := range items {
+		ids[i] = it.MessageID
+	}
+	msgs, err := queryMessages(r.db, `SELECT `+messageColumns+` FROM messages WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		// The items are picked up again once their lock lapses.
+		log.Printf("relay load error for %s: %v", peer.name, err)
+		return
+	}
+
+	batch := relayBatch{From: r.cfg.Name}
+	envIDs := map[int64]string{}
+	for _, it := range items {
+		msg, ok := msgs[it.MessageID]
+		if !ok {
+			continue
+		}
+		env, err := r.envelope(msg, it.Trace)
+		if err != nil {
+			log.Printf("relay attachment error for message %d: %v", msg.ID, err)
+			r.retry(it, msg, err.Error())
+			continue
+		}
+		envIDs[it.ID] = env.ID
+		batch.Messages = append(batch.Messages, env)
+	}
+	if len(batch.Messages) == 0 {
+		return
+	}
+	pending := slices.DeleteFunc(slices.Clone(items), func(it relayItem) bool { return envIDs[it.ID] == "" })
+
+	result, retryable, err := r.post(ctx, peer, batch)
+	if err != nil {
+		log.Printf("relay to %s failed: %v", peer.name, err)
+		for _, it := range pending {
+			if retryable {
+				r.retry(it, msgs[it.MessageID], err.Error())
+			} else {
+				r.deadLetter(it, msgs[it.MessageID], err.Error())
+			}
+		}
+		return
+	}
+
+	rejected := map[string]string{}
+	for _, rej := range result.Rejected {
+		rejected[rej.ID] = rej.Error
+	}
+	for _, it := range pending {
+		id, msg := envIDs[it.ID], msgs[it.MessageID]
+		switch reason, isRejected := rejected[id]; {
+		case slices.Contains(result.Accepted, id):
+			r.markRelayed(it, msg, peer.name)
+		case isRejected:
+			r.deadLetter(it, msg, "rejected by "+peer.name+": "+reason)
+		default:
+			r.retry(it, msg, "not acknowledged by "+peer.name)
+		}
+	}
+}
+
+// post signs and sends batch. Transport errors, 5xx, 408 and 429 are worth
+// retrying; any other failure is final.
+func (r *relayer) post(ctx context.Context, peer *relayPeer, batch relayBatch) (relayResult, bool, error) {
+	var result relayResult
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return result, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(peer.cfg.URL, "/")+relayInboundPath, bytes.NewReader(body))
+	if err != nil {
+		return result, false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(relayPeerHeader, r.cfg.Name)
+	req.Header.Set(relayTimestampHeader, ts)
+	req.Header.Set(relaySignatureHeader, signRelayBody(peer.cfg.Secret, ts, body))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return result, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+		return result, retryable, fmt.Errorf("%s answered %d: %s", peer.name, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, true, fmt.Errorf("%s sent an invalid response: %w", peer.name, err)
+	}
+	return result, false, nil
+}
+
+// markRelayed records that the peer took the message: for the sender it
+// now counts as delivered.
+func (r *relayer) markRelayed(it relayItem, msg Message, peer string) {
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			`UPDATE outbound_queue SET status=$1, sent_at=NOW(), locked_until=NULL, last_error='', updated_at=NOW() WHERE id=$2`,
+			queueSent, it.ID,
+		); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(
+			`UPDATE messages SET delivered_at=NOW() WHERE id=$1 RETURNING delivered_at`, msg.ID,
+		).Scan(&msg.DeliveredAt); err != nil {
+			return err
+		}
+		return appendAudit(tx, auditSystemActor, auditMessageRelay, msg.ID, map[string]any{
+			"next_hop": peer, "attempts": it.Attempts,
+		})
+	})
+	if err != nil {
+		log.Printf("relay bookkeeping error for message %d: %v", msg.ID, err)
+		return
+	}
+	events.publish(msg.Sender, Event{Type: eventMessageDelivered, Data: msg})
+}
+
+// retry puts the item back in the queue after a backoff, or dead-letters
+// it once it has used up its attempts.
+func (r *relayer) retry(it relayItem, msg Message, reason string) {
+	if it.Attempts >= r.cfg.MaxAttempts {
+		r.deadLetter(it, msg, reason)
+		return
+	}
+	_, err := r.db.Exec(
+		`UPDATE outbound_queue SET status=$1, next_attempt_at=$2, last_error=$3, locked_until=NULL, updated_at=NOW() WHERE id=$4`,
+		queuePending, time.Now().Add(relayBackoff(r.cfg, it.Attempts)), reason, it.ID,
+	)
+	if err != nil {
+		log.Printf("relay requeue error for item %d: %v", it.ID, err)
+	}
+}
+
+// relayFailureBody explains to the sender why msg could not be relayed.
+func relayFailureBody(msg Message, reason string) string {
+	return fmt.Sprintf("Your message to %s could not be passed on to %s and will not be delivered.\n\nReason: %s\nSubject: %s\nSent: %s",
+		msg.Receiver, msg.NextHop, reason, msg.Subject, msg.CreatedAt.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+// deadLetter gives up on the item and sends the sender a non-delivery
+// notice, unless one was already sent for the message.
+func (r *relayer) deadLetter(it relayItem, msg Message, reason string) {
+	var notice *Message
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			`UPDATE outbound_queue SET status=$1, last_error=$2, locked_until=NULL, updated_at=NOW() WHERE id=$3`,
+			queueDead, reason, it.ID,
+		); err != nil {
+			return err
+		}
+		var id int64
+		err := tx.QueryRow(`UPDATE messages SET ndn_sent_at=NOW() WHERE id=$1 AND ndn_sent_at IS NULL RETURNING id`, it.MessageID).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n, err := sendNonDeliveryTx(tx, msg, relayFailureBody(msg, reason))
+		if err != nil {
+			return err
+		}
+		notice = &n
+		return appendAudit(tx, auditSystemActor, auditMessageRelayFailed, msg.ID, map[string]any{
+			"next_hop": msg.NextHop, "attempts": it.Attempts, "reason": reason, "notice_id": n.ID,
+		})
+	})
+	if err != nil {
+		log.Printf("relay dead-letter error for item %d: %v", it.ID, err)
+		return
+	}
+	if notice != nil {
+		notifyDelivered(*notice)
+		events.publish(msg.Sender, Event{Type: eventReportNDR, Data: msg})
+	}
+}
+
+// queryMessages runs a message query and indexes the result by id.
+func queryMessages(db dbtx, query string, args ...any) (map[int64]Message, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	msgs := map[int64]Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs[m.ID] = m
+	}
+	return msgs, rows.Err()
+}
+
+func scanOutboundItem(row rowScanner) (OutboundItem, error) {
+	var it OutboundItem
+	err := row.Scan(&it.ID, &it.MessageID, &it.NextHop, &it.Status, &it.Attempts, &it.NextAttemptAt, &it.LastError,
+		&it.CreatedAt, &it.UpdatedAt, &it.SentAt, &it.Sender, &it.Receiver, &it.Subject)
+	return it, err
+}
+
+// relayQueueHandler serves GET /api/relay/queue for admins: the depth of
+// the queue per next hop and the most recent dead-lettered items.
+func relayQueueHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(
+			`SELECT next_hop,
+			        count(*) FILTER (WHERE status=$1),
+			        count(*) FILTER (WHERE status=$2),
+			        count(*) FILTER (WHERE status=$3),
+			        min(created_at) FILTER (WHERE status=$1)
+			 FROM outbound_queue WHERE status <> $4
+			 GROUP BY next_hop ORDER BY next_hop`,
+			queuePending, queueSending, queueDead, queueSent,
+		)
+		if err != nil {
+			log.Println("relay queue query error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		view := RelayQueue{Peers: []RelayPeerStats{}, Failed: []OutboundItem{}}
+		for rows.Next() {
+			var s RelayPeerStats
+			if err := rows.Scan(&s.NextHop, &s.Pending, &s.Sending, &s.Dead, &s.OldestPending); err != nil {
+				log.Println("scan error:", err)
+				continue
+			}
+			s.Configured = servedNextHop(s.NextHop)
+			view.Peers = append(view.Peers, s)
+		}
+
+		failed, err := db.Query(
+			`SELECT `+outboundItemColumns+` FROM outbound_queue q JOIN messages m ON m.id = q.message_id
+			 WHERE q.status=$1 ORDER BY q.updated_at DESC, q.id DESC LIMIT 100`,
+			queueDead,
+		)
+		if err != nil {
+			log.Println("relay failed query error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer failed.Close()
+		for failed.Next() {
+			it, err := scanOutboundItem(failed)
+			if err != nil {
+				log.Println("scan error:", err)
+				continue
+			}
+			view.Failed = append(view.Failed, it)
+		}
+		writeJSON(w, view)
+	})
+}
+
+// retryRelayHandler serves POST /api/relay/queue/{id}/retry for admins,
+// giving a dead-lettered item a fresh set of attempts.
+func retryRelayHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := getUsername(r.Context())
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id < 1 {
+			http.Error(w, "invalid queue item id", http.StatusBadRequest)
+			return
+		}
+		var it OutboundItem
+		err = withTx(db, func(tx *sql.Tx) error {
+			var err error
+			it, err = scanOutboundItem(tx.QueryRow(
+				`UPDATE outbound_queue q SET status=$1, attempts=0, next_attempt_at=NOW(), last_error='', updated_at=NOW()
+				 FROM messages m
+				 WHERE m.id = q.message_id AND q.id=$2 AND q.status=$3
+				 RETURNING `+outboundItemColumns,
+				queuePending, id, queueDead,
+			))
+			if err != nil {
+				return err
+			}
+			return appendAudit(tx, username, auditMessageRelayRetry, it.MessageID, map[string]any{"next_hop": it.NextHop})
+		})
+		if err == sql.ErrNoRows {
+			http.Error(w, "failed queue item not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("relay retry error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, it)
+	})
+}
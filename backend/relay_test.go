@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"mini-amhs/config"
+)
+
+var outboundItemColumnNames = []string{"id", "message_id", "next_hop", "status", "attempts", "next_attempt_at", "last_error", "created_at", "updated_at", "sent_at", "sender", "receiver", "subject"}
+
+func testRelayConfig(url string) config.RelayConfig {
+	cfg := config.Default().Relay
+	cfg.Name = "paris-mta"
+	cfg.Peers = map[string]config.PeerConfig{"london-mta": {URL: url, Secret: "s3cret"}}
+	return cfg
+}
+
+func TestRelayBackoff(t *testing.T) {
+	cfg := config.RelayConfig{BackoffBase: 30 * time.Second, BackoffMax: 5 * time.Minute}
+	assert.Equal(t, 30*time.Second, relayBackoff(cfg, 1))
+	assert.Equal(t, time.Minute, relayBackoff(cfg, 2))
+	assert.Equal(t, 4*time.Minute, relayBackoff(cfg, 4))
+	assert.Equal(t, 5*time.Minute, relayBackoff(cfg, 5))
+	assert.Equal(t, 5*time.Minute, relayBackoff(cfg, 40))
+}
+
+func TestRelayer_Deliver(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	store, err := newLocalStore(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put("key", strings.NewReader("RWY 27L CLSD")))
+	now := time.Now()
+
+	var batch relayBatch
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, relayInboundPath, r.URL.Path)
+		assert.Equal(t, "paris-mta", r.Header.Get(relayPeerHeader))
+		assert.Equal(t, signRelayBody("s3cret", r.Header.Get(relayTimestampHeader), body), r.Header.Get(relaySignatureHeader))
+		assert.NoError(t, json.Unmarshal(body, &batch))
+		writeJSON(w, relayResult{
+			Accepted: []string{"paris-mta:9"},
+			Rejected: []relayRejection{{ID: "paris-mta:10", Error: "unknown recipient"}},
+		})
+	}))
+	defer peer.Close()
+	r := newRelayer(db, store, testRelayConfig(peer.URL))
+
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id = ANY\(\$1\)`).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).
+			AddRow(9, "alice", "EGKKZTZX", "NOTAM", "A0123/26", "GG", false, false, false, nil, nil, nil, 9, now, nil, nil, nil, false, "", "", "", false, nil, "EGKK", "london-mta").
+			AddRow(10, "alice", "EGKKZZZZ", "Slot", "CTOT 1030", "FF", false, false, false, nil, nil, nil, 10, now, nil, nil, nil, false, "", "", "", false, nil, "EGKK", "london-mta"))
+	mock.ExpectQuery(`SELECT .* FROM attachments WHERE message_id=\$1`).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(attachmentColumnNames).AddRow(1, 9, "notam.txt", "text/plain", 12, "abc", "key", now))
+	mock.ExpectQuery(`SELECT .* FROM attachments WHERE message_id=\$1`).
+		WithArgs(int64(10)).
+		WillReturnRows(sqlmock.NewRows(attachmentColumnNames))
+
+	// Accepted: the message counts as delivered.
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbound_queue SET status=\$1, sent_at=NOW\(\)`).
+		WithArgs(queueSent, int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`UPDATE messages SET delivered_at=NOW\(\) WHERE id=\$1`).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows([]string{"delivered_at"}).AddRow(now))
+	expectAudit(mock, auditMessageRelay)
+	mock.ExpectCommit()
+
+	// Rejected: dead-lettered, and the sender is told.
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbound_queue SET status=\$1, last_error=\$2`).
+		WithArgs(queueDead, "rejected by london-mta: unknown recipient", int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`UPDATE messages SET ndn_sent_at=NOW\(\) WHERE id=\$1 AND ndn_sent_at IS NULL`).
+		WithArgs(int64(10)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs(systemMailbox, "alice", "Non-delivery: Slot", sqlmock.AnyArg(), "FF", int64(10), int64(10), nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(11, systemMailbox, "alice", "Non-delivery: Slot", "...", "FF", false, false, false, nil, nil, 10, 10, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	expectAudit(mock, auditMessageRelayFailed)
+	mock.ExpectCommit()
+
+	aliceEvents, stop := events.subscribe("alice")
+	defer stop()
+
+	r.deliver(context.Background(), r.peers["london-mta"], []relayItem{{ID: 1, MessageID: 9, Attempts: 1}, {ID: 2, MessageID: 10, Attempts: 1}})
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, "paris-mta", batch.From)
+	assert.Len(t, batch.Messages, 2)
+	assert.Equal(t, "paris-mta:9", batch.Messages[0].ID)
+	assert.Equal(t, []relayHop{{Server: "paris-mta", At: batch.Messages[0].Trace[0].At}}, batch.Messages[0].Trace)
+	assert.Equal(t, []byte("RWY 27L CLSD"), batch.Messages[0].Attachments[0].Data)
+
+	assert.Equal(t, eventMessageDelivered, (<-aliceEvents).Type)
+	assert.Equal(t, eventMessageCreated, (<-aliceEvents).Type)
+	assert.Equal(t, eventReportNDR, (<-aliceEvents).Type)
+}
+
+func TestRelayer_DeadLetterRoutesNoticeToAFTNSender(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	r := newRelayer(db, nil, testRelayConfig("https://london.example.com"))
+	msg := Message{ID: 10, Sender: "LFPGZTZX", Receiver: "EGKKZZZZ", Subject: "Slot", Priority: "FF", ThreadID: 10, CreatedAt: now, Route: "EGKK", NextHop: "london-mta"}
+
+	// A message that came in over AFTN is reported back over AFTN.
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbound_queue SET status=\$1, last_error=\$2`).
+		WithArgs(queueDead, "rejected by london-mta: unknown recipient", int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`UPDATE messages SET ndn_sent_at=NOW\(\) WHERE id=\$1 AND ndn_sent_at IS NULL`).
+		WithArgs(int64(10)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("LFPGZTZX", "LFPGZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE username=\$1\)`).
+		WithArgs("LFPGZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`SELECT .* FROM routes`).
+		WithArgs("LFPGZTZX", defaultRoutePattern).
+		WillReturnRows(sqlmock.NewRows(routeColumnNames).AddRow(1, defaultRoutePattern, "aftn", "", now, now))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs(systemMailbox, "LFPGZTZX", "Non-delivery: Slot", sqlmock.AnyArg(), "FF", int64(10), int64(10), nil, nil, "", "", "", false, nil, defaultRoutePattern, "aftn").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(11, systemMailbox, "LFPGZTZX", "Non-delivery: Slot", "...", "FF", false, false, false, nil, nil, 10, 10, now, nil, nil, nil, false, "", "", "", false, nil, defaultRoutePattern, "aftn"))
+	mock.ExpectExec(`INSERT INTO outbound_queue`).
+		WithArgs(int64(11), "aftn", nil, []byte("[]")).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	expectAudit(mock, auditMessageSend)
+	expectAudit(mock, auditMessageRelayFailed)
+	mock.ExpectCommit()
+
+	r.deadLetter(relayItem{ID: 2, MessageID: 10, Attempts: 1}, msg, "rejected by london-mta: unknown recipient")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRelayer_DeliverRetriesServerErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+	}))
+	defer peer.Close()
+	r := newRelayer(db, nil, testRelayConfig(peer.URL))
+
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id = ANY\(\$1\)`).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).
+			AddRow(9, "alice", "EGKKZTZX", "NOTAM", "A0123/26", "GG", false, false, false, nil, nil, nil, 9, now, nil, nil, nil, false, "", "", "", false, nil, "EGKK", "london-mta"))
+	mock.ExpectQuery(`SELECT .* FROM attachments`).
+		WithArgs(int64(9)).
+		WillReturnRows(sqlmock.NewRows(attachmentColumnNames))
+	mock.ExpectExec(`UPDATE outbound_queue SET status=\$1, next_attempt_at=\$2, last_error=\$3`).
+		WithArgs(queuePending, sqlmock.AnyArg(), "london-mta answered 503: database unavailable", int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	r.deliver(context.Background(), r.peers["london-mta"], []relayItem{{ID: 1, MessageID: 9, Attempts: 2}})
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRelayQueueHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	defer func(peers map[string]config.PeerConfig) { appConfig.Relay.Peers = peers }(appConfig.Relay.Peers)
+	appConfig.Relay.Peers = map[string]config.PeerConfig{"london-mta": {URL: "https://london.example.com", Secret: "s"}}
+	now := time.Now()
+
+	mock.ExpectQuery(`SELECT next_hop, .* FROM outbound_queue WHERE status <> \$4 GROUP BY next_hop`).
+		WithArgs(queuePending, queueSending, queueDead, queueSent).
+		WillReturnRows(sqlmock.NewRows([]string{"next_hop", "pending", "sending", "dead", "oldest_pending"}).
+			AddRow("london-mta", 3, 1, 1, now).
+			AddRow("oslo-mta", 2, 0, 0, now))
+	mock.ExpectQuery(`SELECT .* FROM outbound_queue q JOIN messages m ON m.id = q.message_id WHERE q.status=\$1`).
+		WithArgs(queueDead).
+		WillReturnRows(sqlmock.NewRows(outboundItemColumnNames).
+			AddRow(4, 10, "london-mta", queueDead, 8, now, "london-mta answered 503: busy", now, now, nil, "alice", "EGKKZZZZ", "Slot"))
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/relay/queue", nil)
+	rr := httptest.NewRecorder()
+	relayQueueHandler(db).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var view RelayQueue
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &view))
+	assert.Len(t, view.Peers, 2)
+	assert.True(t, view.Peers[0].Configured)
+	assert.False(t, view.Peers[1].Configured)
+	assert.Equal(t, int64(3), view.Peers[0].Pending)
+	assert.Len(t, view.Failed, 1)
+	assert.Equal(t, "Slot", view.Failed[0].Subject)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRetryRelayHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	post := func(id string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/api/relay/queue/"+id+"/retry", nil)
+		req.SetPathValue("id", id)
+		req = req.WithContext(withIdentity(req.Context(), "root", roleAdmin))
+		rr := httptest.NewRecorder()
+		retryRelayHandler(db).ServeHTTP(rr, req)
+		return rr
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE outbound_queue q SET status=\$1, attempts=0`).
+		WithArgs(queuePending, int64(4), queueDead).
+		WillReturnRows(sqlmock.NewRows(outboundItemColumnNames).
+			AddRow(4, 10, "london-mta", queuePending, 0, now, "", now, now, nil, "alice", "EGKKZZZZ", "Slot"))
+	expectAudit(mock, auditMessageRelayRetry)
+	mock.ExpectCommit()
+	rr := post("4")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Only dead-lettered items can be retried.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE outbound_queue q SET status=\$1, attempts=0`).
+		WithArgs(queuePending, int64(5), queueDead).
+		WillReturnRows(sqlmock.NewRows(outboundItemColumnNames))
+	mock.ExpectRollback()
+	rr = post("5")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
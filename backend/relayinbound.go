@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRelayBatch is the most messages accepted in one inbound batch.
+	maxRelayBatch = 100
+	// maxRelayBody bounds an inbound batch, attachments included.
+	maxRelayBody = 256 << 20
+)
+
+var errRelayAuth = errors.New("relay authentication failed")
+
+// identifyRelayPeer returns the configured peer that sent r, before its
+// body is read: by its client certificate when it presents one mapped to a
+// peer, otherwise by the peer and timestamp headers of a signed request.
+// signed reports that the signature over the body is still to be checked
+// with verifyRelaySignature.
+func identifyRelayPeer(r *http.Request) (name string, signed bool, err error) {
+	cfg := appConfig.Relay
+	claimed := r.Header.Get(relayPeerHeader)
+	if subject, ok := clientCertSubject(r); ok {
+		for name, peer := range cfg.Peers {
+			if subjectMatches(subject, peer.CertSubject) {
+				if claimed != "" && claimed != name {
+					return "", false, fmt.Errorf("%w: certificate belongs to %s", errRelayAuth, name)
+				}
+				return name, false, nil
+			}
+		}
+	}
+
+	if _, ok := cfg.Peers[claimed]; claimed == "" || !ok {
+		return "", false, fmt.Errorf("%w: unknown peer", errRelayAuth)
+	}
+	sec, err := strconv.ParseInt(r.Header.Get(relayTimestampHeader), 10, 64)
+	if err != nil {
+		return "", false, fmt.Errorf("%w: invalid timestamp", errRelayAuth)
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > cfg.MaxClockSkew || skew < -cfg.MaxClockSkew {
+		return "", false, fmt.Errorf("%w: timestamp outside the allowed clock skew", errRelayAuth)
+	}
+	if r.Header.Get(relaySignatureHeader) == "" {
+		return "", false, fmt.Errorf("%w: missing signature", errRelayAuth)
+	}
+	return claimed, true, nil
+}
+
+// verifyRelaySignature checks the HMAC signature of r over body with the
+// secret of peer.
+func verifyRelaySignature(r *http.Request, peer string, body []byte) error {
+	want := signRelayBody(appConfig.Relay.Peers[peer].Secret, r.Header.Get(relayTimestampHeader), body)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(relaySignatureHeader))) {
+		return fmt.Errorf("%w: bad signature", errRelayAuth)
+	}
+	return nil
+}
+
+// checkTrace refuses messages that already passed through this server or
+// through too many servers. The last hop must be the peer that sent it.
+func checkTrace(trace []relayHop, peer string) error {
+	if len(trace) == 0 || trace[len(trace)-1].Server != peer {
+		return fmt.Errorf("trace must end with %s", peer)
+	}
+	for _, hop := range trace {
+		if hop.Server == appConfig.Relay.Name {
+			return fmt.Errorf("routing loop: already passed through %s", hop.Server)
+		}
+	}
+	if len(trace) >= appConfig.Relay.MaxHops {
+		return fmt.Errorf("too many hops (%d)", len(trace))
+	}
+	return nil
+}
+
+// relaySender is the sender recorded for a relayed message: qualified
+// with the originating server, so that it cannot pass for a local user or
+// an AFTN station, and so that replies go back to that server (see
+// resolveRecipient).
+func relaySender(env relayEnvelope) string {
+	origin := "@" + env.Trace[0].Server
+	if strings.HasSuffix(env.Sender, origin) {
+		// Qualified by an earlier hop.
+		return env.Sender
+	}
+	return env.Sender + origin
+}
+
+// storeRelayedAttachments checks the attachments of env against the
+// upload limits and their checksums, and writes them to store.
+func storeRelayedAttachments(store attachmentStore, env relayEnvelope) ([]Attachment, error) {
+	limits := appConfig.Attachments
+	if len(env.Attachments) > limits.MaxCount {
+		return nil, &uploadError{http.StatusBadRequest, fmt.Sprintf("at most %d attachments allowed", limits.MaxCount)}
+	}
+	var atts []Attachment
+	for _, ra := range env.Attachments {
+		sum := sha256.Sum256(ra.Data)
+		if hex.EncodeToString(sum[:]) != ra.SHA256 {
+			discardAttachments(store, atts)
+			return nil, &uploadError{http.StatusBadRequest, fmt.Sprintf("attachment %q: checksum mismatch", sanitizeFilename(ra.Filename))}
+		}
+		att, err := storeAttachmentData(store, ra.Filename, ra.ContentType, ra.Data)
+		if err != nil {
+			discardAttachments(store, atts)
+			return nil, err
+		}
+		atts = append(atts, att)
+	}
+	return atts, nil
+}
+
+// receiveRelayed stores one message pushed by peer, for local delivery or
+// for the next hop its receiver routes to. A non-empty rejection is the
+// reason the message is refused; err is a failure on this side. Messages
+// received before (the peer retried) are accepted again without a copy.
+func receiveRelayed(db *sql.DB, store attachmentStore, peer string, env relayEnvelope) (rejection string, err error) {
+	if env.ID == "" {
+		return "id is required", nil
+	}
+	if err := checkTrace(env.Trace, peer); err != nil {
+		return err.Error(), nil
+	}
+	in := newMessage{
+		Receiver:   env.Receiver,
+		Subject:    env.Subject,
+		Body:       env.Body,
+		Priority:   env.Priority,
+		ExpiresAt:  env.ExpiresAt,
+		Originator: env.Originator,
+		FilingTime: env.FilingTime,
+		ChannelSeq: env.ChannelSeq,
+		Trace:      env.Trace,
+	}
+	if err := in.validate(); err != nil {
+		return err.Error(), nil
+	}
+	in.Receiver, in.Route, err = resolveRecipient(db, in.Receiver)
+	if errors.Is(err, errUnknownRecipient) {
+		return err.Error(), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	in.Attachments, err = storeRelayedAttachments(store, env)
+	var uerr *uploadError
+	if errors.As(err, &uerr) {
+		return uerr.Msg, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var msg Message
+	stored := false
+	err = withTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`INSERT INTO relay_inbound(relay_id, peer) VALUES($1,$2) ON CONFLICT DO NOTHING`, env.ID, peer)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+		if msg, err = sendMessageTx(tx, relaySender(env), in); err != nil {
+			return err
+		}
+		stored = !msg.Suppressed
+		if _, err := tx.Exec(`UPDATE relay_inbound SET message_id=$1 WHERE peer=$2 AND relay_id=$3`, msg.ID, peer, env.ID); err != nil {
+			return err
+		}
+		return appendAudit(tx, auditSystemActor, auditMessageRelayReceive, msg.ID, map[string]any{
+			"peer": peer, "relay_id": env.ID, "trace": env.Trace,
+		})
+	})
+	if err != nil || !stored {
+		discardAttachments(store, in.Attachments)
+		return "", err
+	}
+	notifyDelivered(msg)
+	return "", nil
+}
+
+// relayInboundHandler serves POST /api/relay/inbound, where peer servers
+// push batches of messages. Each message is accepted or rejected on its
+// own; the batch fails as a whole only for errors worth retrying.
+func relayInboundHandler(db *sql.DB, store attachmentStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Nothing is read from a request that does not name a peer.
+		peer, signed, err := identifyRelayPeer(r)
+		if err != nil {
+			log.Println("relay inbound:", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRelayBody))
+		if err != nil {
+			http.Error(w, "batch too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if signed {
+			if err := verifyRelaySignature(r, peer, body); err != nil {
+				log.Println("relay inbound:", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		var batch relayBatch
+		if err := json.Unmarshal(body, &batch); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if batch.From != peer {
+			http.Error(w, "batch is not from the authenticated peer", http.StatusForbidden)
+			return
+		}
+		if len(batch.Messages) == 0 || len(batch.Messages) > maxRelayBatch {
+			http.Error(w, fmt.Sprintf("a batch holds 1 to %d messages", maxRelayBatch), http.StatusBadRequest)
+			return
+		}
+
+		result := relayResult{Accepted: []string{}, Rejected: []relayRejection{}}
+		for _, env := range batch.Messages {
+			rejection, err := receiveRelayed(db, store, peer, env)
+			if err != nil {
+				// Messages stored so far are recognised when the peer
+				// sends the batch again.
+				log.Printf("relay inbound error from %s: %v", peer, err)
+				http.Error(w, "db error", http.StatusServiceUnavailable)
+				return
+			}
+			if rejection != "" {
+				result.Rejected = append(result.Rejected, relayRejection{ID: env.ID, Error: rejection})
+				continue
+			}
+			result.Accepted = append(result.Accepted, env.ID)
+		}
+		writeJSON(w, result)
+	})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"mini-amhs/config"
+)
+
+// asRelayServer configures this server as london-mta with paris-mta as
+// its peer for the rest of the test.
+func asRelayServer(t *testing.T) {
+	saved := appConfig.Relay
+	t.Cleanup(func() { appConfig.Relay = saved })
+	appConfig.Relay.Name = "london-mta"
+	appConfig.Relay.Peers = map[string]config.PeerConfig{
+		"paris-mta": {URL: "https://paris.example.com", Secret: "s3cret", CertSubject: "amhs.paris.example.com"},
+	}
+}
+
+func signedRelayRequest(t *testing.T, body string, at time.Time) *http.Request {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	req, _ := http.NewRequest(http.MethodPost, relayInboundPath, strings.NewReader(body))
+	req.Header.Set(relayPeerHeader, "paris-mta")
+	req.Header.Set(relayTimestampHeader, ts)
+	req.Header.Set(relaySignatureHeader, signRelayBody("s3cret", ts, []byte(body)))
+	return req
+}
+
+func TestIdentifyRelayPeer(t *testing.T) {
+	asRelayServer(t)
+	body := []byte(`{"from":"paris-mta","messages":[]}`)
+
+	req := signedRelayRequest(t, string(body), time.Now())
+	peer, signed, err := identifyRelayPeer(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "paris-mta", peer)
+	assert.True(t, signed)
+	assert.NoError(t, verifyRelaySignature(req, peer, body))
+	assert.EqualError(t, verifyRelaySignature(req, peer, []byte(`{"from":"paris-mta","messages":[{}]}`)), "relay authentication failed: bad signature")
+
+	_, _, err = identifyRelayPeer(signedRelayRequest(t, string(body), time.Now().Add(-time.Hour)))
+	assert.EqualError(t, err, "relay authentication failed: timestamp outside the allowed clock skew")
+
+	req = signedRelayRequest(t, string(body), time.Now())
+	req.Header.Set(relayPeerHeader, "oslo-mta")
+	_, _, err = identifyRelayPeer(req)
+	assert.EqualError(t, err, "relay authentication failed: unknown peer")
+
+	req = signedRelayRequest(t, string(body), time.Now())
+	req.Header.Del(relaySignatureHeader)
+	_, _, err = identifyRelayPeer(req)
+	assert.EqualError(t, err, "relay authentication failed: missing signature")
+
+	// A mapped client certificate needs no signature.
+	req, _ = http.NewRequest(http.MethodPost, relayInboundPath, nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "amhs.paris.example.com"}}}}}
+	peer, signed, err = identifyRelayPeer(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "paris-mta", peer)
+	assert.False(t, signed)
+}
+
+// unreadBody fails the test if anything reads it.
+type unreadBody struct{ t *testing.T }
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("body read before the peer was identified")
+	return 0, io.EOF
+}
+
+func TestRelayInboundHandler_RefusesUnknownPeerUnread(t *testing.T) {
+	asRelayServer(t)
+	req := signedRelayRequest(t, "", time.Now())
+	req.Header.Set(relayPeerHeader, "oslo-mta")
+	req.Body = io.NopCloser(unreadBody{t})
+
+	rr := httptest.NewRecorder()
+	relayInboundHandler(nil, nil).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestCheckTrace(t *testing.T) {
+	asRelayServer(t)
+	now := time.Now()
+
+	assert.NoError(t, checkTrace([]relayHop{{"oslo-mta", now}, {"paris-mta", now}}, "paris-mta"))
+	assert.EqualError(t, checkTrace(nil, "paris-mta"), "trace must end with paris-mta")
+	assert.EqualError(t, checkTrace([]relayHop{{"paris-mta", now}, {"oslo-mta", now}}, "paris-mta"), "trace must end with paris-mta")
+	assert.EqualError(t, checkTrace([]relayHop{{"london-mta", now}, {"paris-mta", now}}, "paris-mta"), "routing loop: already passed through london-mta")
+
+	appConfig.Relay.MaxHops = 2
+	assert.EqualError(t, checkTrace([]relayHop{{"oslo-mta", now}, {"paris-mta", now}}, "paris-mta"), "too many hops (2)")
+}
+
+func TestRelayInboundHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	asRelayServer(t)
+	now := time.Now()
+
+	batch, _ := json.Marshal(relayBatch{From: "paris-mta", Messages: []relayEnvelope{
+		{ID: "paris-mta:9", Sender: "alice", Receiver: "bob", Subject: "NOTAM", Body: "A0123/26", Priority: "GG",
+			Trace: []relayHop{{"paris-mta", now}}},
+		{ID: "oslo-mta:4", Sender: "carol", Receiver: "bob", Subject: "Loop", Body: "x",
+			Trace: []relayHop{{"oslo-mta", now}, {"london-mta", now}, {"paris-mta", now}}},
+		{ID: "paris-mta:8", Sender: "alice", Receiver: "bob", Subject: "Again", Body: "y",
+			Trace: []relayHop{{"paris-mta", now}}},
+	}})
+
+	// The first is delivered to bob, the sender qualified by its origin.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO relay_inbound\(relay_id, peer\) VALUES\(\$1,\$2\) ON CONFLICT DO NOTHING`).
+		WithArgs("paris-mta:9", "paris-mta").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("alice@paris-mta", "bob", "NOTAM", "A0123/26", "GG", nil, nil, nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(20, "alice@paris-mta", "bob", "NOTAM", "A0123/26", "GG", false, false, false, nil, nil, nil, 20, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectExec(`UPDATE relay_inbound SET message_id=\$1 WHERE peer=\$2 AND relay_id=\$3`).
+		WithArgs(int64(20), "paris-mta", "paris-mta:9").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, auditMessageRelayReceive)
+	mock.ExpectCommit()
+	// The second has been here before; the third was received already.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO relay_inbound`).
+		WithArgs("paris-mta:8", "paris-mta").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	bobEvents, stop := events.subscribe("bob")
+	defer stop()
+
+	rr := httptest.NewRecorder()
+	relayInboundHandler(db, nil).ServeHTTP(rr, signedRelayRequest(t, string(batch), now))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.JSONEq(t, `{
+		"accepted": ["paris-mta:9", "paris-mta:8"],
+		"rejected": [{"id": "oslo-mta:4", "error": "routing loop: already passed through london-mta"}]
+	}`, rr.Body.String())
+	assert.Equal(t, eventMessageCreated, (<-bobEvents).Type)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Batches must come from the peer that signed them.
+	body := `{"from":"oslo-mta","messages":[]}`
+	rr = httptest.NewRecorder()
+	relayInboundHandler(db, nil).ServeHTTP(rr, signedRelayRequest(t, body, now))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestReceiveRelayed_Reroutes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	asRelayServer(t)
+	now := time.Now()
+	trace := []relayHop{{"paris-mta", now.UTC()}}
+
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("EKCHZTZX", "EKCHZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE username=\$1\)`).
+		WithArgs("EKCHZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`SELECT .* FROM routes`).
+		WithArgs("EKCHZTZX", defaultRoutePattern).
+		WillReturnRows(sqlmock.NewRows(routeColumnNames).AddRow(2, "EK", "copenhagen-mta", "", now, now))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO relay_inbound`).
+		WithArgs("paris-mta:9", "paris-mta").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("LFPGZTZX@paris-mta", "EKCHZTZX", "Slot", "CTOT 1030", "FF", nil, nil, nil, nil, "", "", "", false, nil, "EK", "copenhagen-mta").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(21, "LFPGZTZX@paris-mta", "EKCHZTZX", "Slot", "CTOT 1030", "FF", false, false, false, nil, nil, nil, 21, now, nil, nil, nil, false, "", "", "", false, nil, "EK", "copenhagen-mta"))
+	raw, _ := json.Marshal(trace)
+	mock.ExpectExec(`INSERT INTO outbound_queue`).
+		WithArgs(int64(21), "copenhagen-mta", nil, raw).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectExec(`UPDATE relay_inbound`).
+		WithArgs(int64(21), "paris-mta", "paris-mta:9").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, auditMessageRelayReceive)
+	mock.ExpectCommit()
+
+	rejection, err := receiveRelayed(db, nil, "paris-mta", relayEnvelope{
+		ID: "paris-mta:9", Sender: "LFPGZTZX", Receiver: "EKCHZTZX", Subject: "Slot", Body: "CTOT 1030", Priority: "FF", Trace: trace,
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, rejection)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReceiveRelayed_TwoHops(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	asRelayServer(t)
+	now := time.Now()
+
+	// paris-mta qualified the sender when it came in from oslo-mta; it is
+	// not qualified again here.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO relay_inbound`).
+		WithArgs("oslo-mta:5", "paris-mta").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("bob@oslo-mta", "carol", "Slot", "CTOT 1030", "GG", nil, nil, nil, nil, "", "", "", false, nil, "", "").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(22, "bob@oslo-mta", "carol", "Slot", "CTOT 1030", "GG", false, false, false, nil, nil, nil, 22, now, nil, now, nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectExec(`UPDATE relay_inbound`).
+		WithArgs(int64(22), "paris-mta", "oslo-mta:5").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, auditMessageRelayReceive)
+	mock.ExpectCommit()
+
+	rejection, err := receiveRelayed(db, nil, "paris-mta", relayEnvelope{
+		ID: "oslo-mta:5", Sender: "bob@oslo-mta", Receiver: "carol", Subject: "Slot", Body: "CTOT 1030", Priority: "GG",
+		Trace: []relayHop{{"oslo-mta", now}, {"paris-mta", now}},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, rejection)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStoreRelayedAttachments(t *testing.T) {
+	store, err := newLocalStore(t.TempDir())
+	assert.NoError(t, err)
+	data := []byte("RWY 27L CLSD")
+	env := relayEnvelope{Attachments: []relayAttachment{{Filename: "../notam.txt", ContentType: "text/plain", SHA256: "bad", Data: data}}}
+
+	_, err = storeRelayedAttachments(store, env)
+	assert.EqualError(t, err, `attachment "notam.txt": checksum mismatch`)
+
+	sum := sha256.Sum256(data)
+	env.Attachments[0].SHA256 = hex.EncodeToString(sum[:])
+	atts, err := storeRelayedAttachments(store, env)
+	assert.NoError(t, err)
+	assert.Len(t, atts, 1)
+	assert.Equal(t, "notam.txt", atts[0].Filename)
+	assert.Equal(t, int64(len(data)), atts[0].Size)
+	f, err := store.Open(atts[0].StorageKey)
+	assert.NoError(t, err)
+	got, _ := io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, data, got)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mini-amhs/config"
+)
+
+// heldCondition is true for a message row aliased m that falls inside an
+// active legal hold.
+const heldCondition = `EXISTS (SELECT 1 FROM legal_holds h
+	WHERE h.released_at IS NULL
+	  AND m.created_at >= h.starts_at AND m.created_at < h.ends_at
+	  AND (h.mailbox IS NULL OR h.mailbox IN (m.sender, m.receiver)))`
+
+// retentionPolicy resolves the regulatory retention period of a message.
+type retentionPolicy struct {
+	cfg config.RetentionConfig
+}
+
+func newRetentionPolicy(cfg config.RetentionConfig) retentionPolicy {
+	return retentionPolicy{cfg: cfg}
+}
+
+// periodFor returns how long a message must be kept after it was sent. A
+// message sits in two mailboxes, so both are resolved and the longer
+// period wins.
+func (p retentionPolicy) periodFor(sender, receiver, priority string) time.Duration {
+	return max(p.forMailbox(sender, priority), p.forMailbox(receiver, priority))
+}
+
+// forMailbox picks the most specific rule matching mailbox and priority:
+// mailbox and priority, then mailbox alone, then priority alone, then the
+// default. Equally specific rules resolve to the longer period.
+func (p retentionPolicy) forMailbox(mailbox, priority string) time.Duration {
+	period, best := p.cfg.Default, 0
+	for _, rule := range p.cfg.Rules {
+		score := 0
+		if rule.Mailbox != "" {
+			if rule.Mailbox != mailbox {
+				continue
+			}
+			score += 2
+		}
+		if rule.Priority != "" {
+			if !strings.EqualFold(rule.Priority, priority) {
+				continue
+			}
+			score++
+		}
+		if score > best || (score == best && score > 0 && rule.Period > period) {
+			period, best = rule.Period, score
+		}
+	}
+	return period
+}
+
+// legalHoldsHandler serves GET and POST /api/legal-holds for supervisors.
+func legalHoldsHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			q := `SELECT id, reason, mailbox, starts_at, ends_at, placed_by, created_at, released_by, released_at FROM legal_holds`
+			if r.URL.Query().Get("active") == "true" {
+				q += ` WHERE released_at IS NULL`
+			}
+			rows, err := db.Query(q + ` ORDER BY created_at DESC`)
+			if err != nil {
+				log.Println("legal hold query error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			holds := []LegalHold{}
+			for rows.Next() {
+				h, err := scanLegalHold(rows)
+				if err != nil {
+					log.Println("scan error:", err)
+					continue
+				}
+				holds = append(holds, h)
+			}
+			writeJSON(w, holds)
+
+		case http.MethodPost:
+			var in struct {
+				Reason  string    `json:"reason"`
+				Mailbox string    `json:"mailbox"`
+				From    time.Time `json:"from"`
+				To      time.Time `json:"to"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			in.Reason = strings.TrimSpace(in.Reason)
+			in.Mailbox = strings.TrimSpace(in.Mailbox)
+			if in.Reason == "" || in.From.IsZero() || in.To.IsZero() {
+				http.Error(w, "reason, from and to are required", http.StatusBadRequest)
+				return
+			}
+			if !in.To.After(in.From) {
+				http.Error(w, "to must be after from", http.StatusBadRequest)
+				return
+			}
+
+			var mailbox *string
+			if in.Mailbox != "" {
+				mailbox = &in.Mailbox
+			}
+			var hold LegalHold
+			err := withTx(db, func(tx *sql.Tx) error {
+				var err error
+				hold, err = scanLegalHold(tx.QueryRow(
+					`INSERT INTO legal_holds(reason, mailbox, starts_at, ends_at, placed_by)
+					 VALUES($1,$2,$3,$4,$5)
+					 RETURNING id, reason, mailbox, starts_at, ends_at, placed_by, created_at, released_by, released_at`,
+					in.Reason, mailbox, in.From, in.To, username,
+				))
+				if err != nil {
+					return err
+				}
+				return appendAudit(tx, username, auditHoldPlace, 0, map[string]any{
+					"hold_id": hold.ID, "reason": hold.Reason, "mailbox": hold.Mailbox, "from": hold.From, "to": hold.To,
+				})
+			})
+			if err != nil {
+				log.Println("insert legal hold error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusCreated)
+			writeJSON(w, hold)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// releaseLegalHoldHandler serves DELETE /api/legal-holds/{id}. Holds are
+// released rather than deleted so the record of them is kept.
+func releaseLegalHoldHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id < 1 {
+			http.Error(w, "invalid hold id", http.StatusBadRequest)
+			return
+		}
+
+		var hold LegalHold
+		err = withTx(db, func(tx *sql.Tx) error {
+			var err error
+			hold, err = scanLegalHold(tx.QueryRow(
+				`UPDATE legal_holds SET released_by=$1, released_at=NOW()
+				 WHERE id=$2 AND released_at IS NULL
+				 RETURNING id, reason, mailbox, starts_at, ends_at, placed_by, created_at, released_by, released_at`,
+				username, id,
+			))
+			if err != nil {
+				return err
+			}
+			return appendAudit(tx, username, auditHoldRelease, 0, map[string]any{"hold_id": hold.ID})
+		})
+		if err == sql.ErrNoRows {
+			http.Error(w, "active hold not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("release legal hold error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, hold)
+	})
+}
+
+func scanLegalHold(row rowScanner) (LegalHold, error) {
+	var h LegalHold
+	err := row.Scan(&h.ID, &h.Reason, &h.Mailbox, &h.From, &h.To, &h.PlacedBy, &h.CreatedAt, &h.ReleasedBy, &h.ReleasedAt)
+	return h, err
+}
+
+// retentionReportsHandler serves GET /api/retention/reports, the record of
+// what each purge run removed.
+func retentionReportsHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit < 1 || limit > appConfig.Limits.MaxPageSize {
+			limit = appConfig.Limits.DefaultPageSize
+		}
+		rows, err := db.Query(
+			`SELECT id, ran_at, held_count, retained_count, purged
+			 FROM retention_reports ORDER BY ran_at DESC LIMIT $1`, limit)
+		if err != nil {
+			log.Println("retention report query error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		reports := []PurgeReport{}
+		for rows.Next() {
+			var rep PurgeReport
+			var purged []byte
+			if err := rows.Scan(&rep.ID, &rep.RanAt, &rep.Held, &rep.Retained, &purged); err != nil {
+				log.Println("scan error:", err)
+				continue
+			}
+			if err := json.Unmarshal(purged, &rep.Purged); err != nil {
+				log.Println("retention report decode error:", err)
+				continue
+			}
+			reports = append(reports, rep)
+		}
+		writeJSON(w, reports)
+	})
+}
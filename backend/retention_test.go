@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"mini-amhs/config"
+)
+
+func TestRetentionPolicy_PeriodFor(t *testing.T) {
+	day := 24 * time.Hour
+	policy := newRetentionPolicy(config.RetentionConfig{
+		Default: 30 * day,
+		Rules: []config.RetentionRule{
+			{Priority: "SS", Period: 365 * day},
+			{Mailbox: "incident-desk", Period: 90 * day},
+			{Mailbox: "incident-desk", Priority: "KK", Period: 10 * day},
+		},
+	})
+
+	assert.Equal(t, 30*day, policy.periodFor("alice", "bob", "GG"))
+	assert.Equal(t, 365*day, policy.periodFor("alice", "bob", "ss"))
+	assert.Equal(t, 90*day, policy.periodFor("alice", "incident-desk", "GG"))
+	// The mailbox+priority rule is most specific for incident-desk, but
+	// alice's side still needs the default 30 days.
+	assert.Equal(t, 30*day, policy.periodFor("alice", "incident-desk", "KK"))
+}
+
+func TestLegalHoldsHandler_Place(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	from := time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(30 * 24 * time.Hour)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO legal_holds\(reason, mailbox, starts_at, ends_at, placed_by\)`).
+		WithArgs("incident 42", nil, from, to, "sup").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "reason", "mailbox", "starts_at", "ends_at", "placed_by", "created_at", "released_by", "released_at"}).
+			AddRow(1, "incident 42", nil, from, to, "sup", time.Now(), nil, nil))
+	expectAudit(mock, auditHoldPlace)
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/legal-holds",
+		strings.NewReader(`{"reason":"incident 42","from":"2025-09-01T00:00:00Z","to":"2025-10-01T00:00:00Z"}`))
+	req = req.WithContext(withIdentity(req.Context(), "sup", roleSupervisor))
+	rr := httptest.NewRecorder()
+	legalHoldsHandler(db).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Equal(t, "application/json; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), `"reason": "incident 42"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
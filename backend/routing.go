@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const routeColumns = `id, pattern, next_hop, description, created_at, updated_at`
+
+// defaultRoutePattern matches every AFTN address that no other pattern
+// matches.
+const defaultRoutePattern = "*"
+
+var (
+	// An address prefix: from a country or FIR indicator up to a full
+	// AFTN address.
+	routePatternPattern = regexp.MustCompile(`^[A-Z]{1,8}$`)
+	// A neighbouring MTA, as named in the channel configuration.
+	nextHopPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+)
+
+func scanRoute(row rowScanner) (Route, error) {
+	var rt Route
+	err := row.Scan(&rt.ID, &rt.Pattern, &rt.NextHop, &rt.Description, &rt.CreatedAt, &rt.UpdatedAt)
+	return rt, err
+}
+
+// routeInput is the body of route create and update requests. An empty
+// next_hop routes to local delivery.
+type routeInput struct {
+	Pattern     string `json:"pattern"`
+	NextHop     string `json:"next_hop"`
+	Description string `json:"description"`
+}
+
+func (in *routeInput) validate() error {
+	in.Pattern = strings.ToUpper(strings.TrimSpace(in.Pattern))
+	in.NextHop = strings.TrimSpace(in.NextHop)
+	in.Description = strings.TrimSpace(in.Description)
+	if in.Pattern != defaultRoutePattern && !routePatternPattern.MatchString(in.Pattern) {
+		return errors.New("pattern must be 1-8 letters of an AFTN address, or * for the default route")
+	}
+	if in.NextHop != "" && !nextHopPattern.MatchString(in.NextHop) {
+		return errors.New("next_hop must be 1-32 letters, digits, '.', '_' or '-'")
+	}
+	// Nothing would ever take traffic queued for another hop.
+	if in.NextHop != "" && !servedNextHop(in.NextHop) {
+		return fmt.Errorf("next_hop %q is not a relay peer or the AFTN gateway", in.NextHop)
+	}
+	if len(in.Description) > appConfig.Limits.MaxSubjectLen {
+		return errors.New("description is too long")
+	}
+	return nil
+}
+
+// servedNextHop reports whether traffic queued for hop is taken by the
+// relay or the AFTN gateway.
+func servedNextHop(hop string) bool {
+	if _, ok := appConfig.Relay.Peers[hop]; ok {
+		return true
+	}
+	return appConfig.AFTN.Name != "" && hop == appConfig.AFTN.Name
+}
+
+// routeFor returns the route whose pattern is the longest prefix of
+// address, falling back to the default route.
+func routeFor(db dbtx, address string) (Route, bool, error) {
+	rt, err := scanRoute(db.QueryRow(
+		`SELECT `+routeColumns+` FROM routes
+		 WHERE starts_with($1, pattern) OR pattern=$2
+		 ORDER BY pattern=$2, length(pattern) DESC LIMIT 1`,
+		address, defaultRoutePattern,
+	))
+	if err == sql.ErrNoRows {
+		return rt, false, nil
+	}
+	return rt, err == nil, err
+}
+
+// routesHandler serves GET and POST /api/routes for admins.
+func routesHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query(`SELECT `+routeColumns+` FROM routes ORDER BY pattern=$1, length(pattern) DESC, pattern`, defaultRoutePattern)
+			if err != nil {
+				log.Println("select routes error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			routes := []Route{}
+			for rows.Next() {
+				rt, err := scanRoute(rows)
+				if err != nil {
+					log.Println("scan error:", err)
+					continue
+				}
+				routes = append(routes, rt)
+			}
+			writeJSON(w, routes)
+
+		case http.MethodPost:
+			var in routeInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			if err := in.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rt, err := scanRoute(db.QueryRow(
+				`INSERT INTO routes(pattern, next_hop, description) VALUES($1,$2,$3) RETURNING `+routeColumns,
+				in.Pattern, in.NextHop, in.Description,
+			))
+			if err != nil {
+				if strings.Contains(strings.ToLower(err.Error()), "unique") {
+					http.Error(w, "a route for that pattern already exists", http.StatusConflict)
+					return
+				}
+				log.Println("insert route error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, rt)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// routeID parses the {id} path value, answering 400 when it is invalid.
+func routeID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "invalid route id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// updateRouteHandler serves PUT /api/routes/{id} for admins. Messages
+// already routed keep the route they were given.
+func updateRouteHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := routeID(w, r)
+		if !ok {
+			return
+		}
+		var in routeInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if err := in.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rt, err := scanRoute(db.QueryRow(
+			`UPDATE routes SET pattern=$1, next_hop=$2, description=$3, updated_at=NOW()
+			 WHERE id=$4 RETURNING `+routeColumns,
+			in.Pattern, in.NextHop, in.Description, id,
+		))
+		if err == sql.ErrNoRows {
+			http.Error(w, "route not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			if strings.Contains(strings.ToLower(err.Error()), "unique") {
+				http.Error(w, "a route for that pattern already exists", http.StatusConflict)
+				return
+			}
+			log.Println("update route error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, rt)
+	})
+}
+
+// deleteRouteHandler serves DELETE /api/routes/{id} for admins.
+func deleteRouteHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := routeID(w, r)
+		if !ok {
+			return
+		}
+		res, err := db.Exec(`DELETE FROM routes WHERE id=$1`, id)
+		if err != nil {
+			log.Println("delete route error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "route not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
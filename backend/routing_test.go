@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var routeColumnNames = []string{"id", "pattern", "next_hop", "description", "created_at", "updated_at"}
+
+func TestRouteInput_Validate(t *testing.T) {
+	asRelayServer(t)
+	defer func(name string) { appConfig.AFTN.Name = name }(appConfig.AFTN.Name)
+	appConfig.AFTN.Name = "aftn"
+
+	in := routeInput{Pattern: " eg ", NextHop: "paris-mta"}
+	assert.NoError(t, in.validate())
+	assert.Equal(t, "EG", in.Pattern)
+	in = routeInput{Pattern: "EG", NextHop: "aftn"}
+	assert.NoError(t, in.validate())
+
+	in = routeInput{Pattern: "*"}
+	assert.NoError(t, in.validate())
+
+	in = routeInput{Pattern: "EG*"}
+	assert.Error(t, in.validate())
+	in = routeInput{Pattern: "EGLLZPZXX"}
+	assert.Error(t, in.validate())
+	in = routeInput{Pattern: "EG", NextHop: "london mta"}
+	assert.Error(t, in.validate())
+
+	// Traffic for a hop nothing serves would wait forever.
+	in = routeInput{Pattern: "EG", NextHop: "oslo-mta"}
+	assert.EqualError(t, in.validate(), `next_hop "oslo-mta" is not a relay peer or the AFTN gateway`)
+}
+
+func TestMessagesHandler_RoutesRemoteAddress(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+
+	// EGKKZTZX is not in the directory; the longest matching prefix sends
+	// it to the London MTA, and it is held for relay.
+	mock.ExpectQuery(`SELECT username FROM directory_entries`).
+		WithArgs("egkkztzx", "EGKKZTZX").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE username=\$1\)`).
+		WithArgs("egkkztzx").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`SELECT .* FROM routes WHERE starts_with\(\$1, pattern\) OR pattern=\$2 ORDER BY pattern=\$2, length\(pattern\) DESC LIMIT 1`).
+		WithArgs("EGKKZTZX", defaultRoutePattern).
+		WillReturnRows(sqlmock.NewRows(routeColumnNames).AddRow(3, "EGKK", "london-mta", "", now, now))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs("alice", "EGKKZTZX", "Slot", "CTOT 1030", "GG", nil, nil, nil, nil, "", "", "", false, nil, "EGKK", "london-mta").
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(9, "alice", "EGKKZTZX", "Slot", "CTOT 1030", "GG", false, false, false, nil, nil, nil, 9, now, nil, nil, nil, false, "", "", "", false, nil, "EGKK", "london-mta"))
+	mock.ExpectExec(`INSERT INTO outbound_queue`).
+		WithArgs(int64(9), "london-mta", nil, []byte("[]")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectAudit(mock, auditMessageSend)
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/messages", strings.NewReader(`{"receiver":"egkkztzx","subject":"Slot","body":"CTOT 1030"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, "alice"))
+	rr := httptest.NewRecorder()
+	messagesHandler(db, nil).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var msg Message
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &msg))
+	assert.Equal(t, "EGKK", msg.Route)
+	assert.Equal(t, "london-mta", msg.NextHop)
+	assert.Nil(t, msg.DeliveredAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRoutesHandler_Create(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	asRelayServer(t)
+	handler := routesHandler(db)
+	now := time.Now()
+
+	mock.ExpectQuery(`INSERT INTO routes`).
+		WithArgs("LF", "paris-mta", "France").
+		WillReturnRows(sqlmock.NewRows(routeColumnNames).AddRow(1, "LF", "paris-mta", "France", now, now))
+	req, _ := http.NewRequest(http.MethodPost, "/api/routes", strings.NewReader(`{"pattern":"lf","next_hop":"paris-mta","description":"France"}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	mock.ExpectQuery(`INSERT INTO routes`).
+		WithArgs("EG", "", "").
+		WillReturnError(errors.New(`pq: duplicate key value violates unique constraint "routes_pattern_key"`))
+	req, _ = http.NewRequest(http.MethodPost, "/api/routes", strings.NewReader(`{"pattern":"EG"}`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// releaseDueMessages delivers deferred messages whose delivery time has
+// come and tells both parties about them.
+func releaseDueMessages(db *sql.DB, now time.Time) ([]Message, error) {
+	var released []Message
+	err := withTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`UPDATE messages SET delivered_at=NOW()
+			 WHERE delivered_at IS NULL AND deliver_at <= $1 AND next_hop = ''
+			 RETURNING `+messageColumns,
+			now,
+		)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			m, err := scanMessage(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			released = append(released, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, m := range released {
+			if err := appendAudit(tx, auditSystemActor, auditMessageDeliver, m.ID, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range released {
+		notifyDelivered(m)
+		events.publish(m.Sender, Event{Type: eventMessageDelivered, Data: m})
+	}
+	return released, nil
+}
+
+// runDeliveryScheduler releases due deferred messages and reports expired
+// ones every interval until ctx is done.
+func runDeliveryScheduler(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			released, err := releaseDueMessages(db, time.Now())
+			if err != nil {
+				log.Println("delivery scheduler error:", err)
+				continue
+			}
+			if len(released) > 0 {
+				log.Printf("delivered %d deferred messages", len(released))
+			}
+			expired, err := sendNonDeliveryReports(db, time.Now())
+			if err != nil {
+				log.Println("non-delivery report error:", err)
+				continue
+			}
+			if len(expired) > 0 {
+				log.Printf("sent %d non-delivery notices", len(expired))
+			}
+		}
+	}
+}
+
+// scheduledMessagesHandler serves GET /api/messages/scheduled: the
+// caller's deferred messages that are not delivered yet, soonest first.
+func scheduledMessagesHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rows, err := db.Query(
+			`SELECT `+messageColumns+`
+			 FROM messages
+			 WHERE sender=$1 AND delivered_at IS NULL AND sender_deleted_at IS NULL
+			 ORDER BY deliver_at ASC, id ASC`,
+			username,
+		)
+		if err != nil {
+			log.Println("scheduled query error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		messages := []Message{}
+		for rows.Next() {
+			m, err := scanMessage(rows)
+			if err != nil {
+				log.Println("scan error:", err)
+				continue
+			}
+			messages = append(messages, m)
+		}
+		writeJSON(w, messages)
+	})
+}
+
+// cancelScheduledHandler serves POST /api/messages/{id}/cancel. A deferred
+// message the receiver has never seen is removed outright, together with
+// its attachments.
+func cancelScheduledHandler(db *sql.DB, store attachmentStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, username, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+		if msg.Sender != username {
+			http.Error(w, "only the sender can cancel delivery", http.StatusForbidden)
+			return
+		}
+
+		var keys []string
+		err := withTx(db, func(tx *sql.Tx) error {
+			atts, err := loadAttachments(tx, msg.ID)
+			if err != nil {
+				return err
+			}
+			// The scheduler may have delivered it since it was loaded.
+			var id int64
+			err = tx.QueryRow(`DELETE FROM messages WHERE id=$1 AND delivered_at IS NULL RETURNING id`, msg.ID).Scan(&id)
+			if err != nil {
+				return err
+			}
+			for _, a := range atts {
+				keys = append(keys, a.StorageKey)
+			}
+			return appendAudit(tx, username, auditMessageCancel, msg.ID, map[string]any{
+				"receiver": msg.Receiver, "deliver_at": msg.DeliverAt,
+			})
+		})
+		if err == sql.ErrNoRows {
+			http.Error(w, "message already delivered", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println("cancel error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		for _, key := range keys {
+			if err := store.Delete(key); err != nil {
+				log.Println("cancel attachment error:", err)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleaseDueMessages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	due := now.Add(-time.Minute)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE messages SET delivered_at=NOW\(\) WHERE delivered_at IS NULL AND deliver_at <= \$1 AND next_hop = '' RETURNING`).
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(5, "alice", "bob", "Shift", "Briefing at 0600", "GG", false, false, false, nil, nil, nil, 5, due.Add(-time.Hour), due, now, nil, false, "", "", "", false, nil, "", ""))
+	expectAudit(mock, auditMessageDeliver)
+	mock.ExpectCommit()
+
+	bobEvents, stopBob := events.subscribe("bob")
+	defer stopBob()
+	aliceEvents, stopAlice := events.subscribe("alice")
+	defer stopAlice()
+
+	released, err := releaseDueMessages(db, now)
+	assert.NoError(t, err)
+	assert.Len(t, released, 1)
+	assert.Equal(t, eventMessageCreated, (<-bobEvents).Type)
+	assert.Equal(t, eventMessageDelivered, (<-aliceEvents).Type)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetMessageHandler_DeferredHiddenFromReceiver(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	deliverAt := time.Now().Add(time.Hour)
+	mock.ExpectQuery(`SELECT .* FROM messages WHERE id=\$1`).
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows(messageColumnNames).AddRow(5, "alice", "bob", "Shift", "Briefing at 0600", "GG", false, false, false, nil, nil, nil, 5, time.Now(), deliverAt, nil, nil, false, "", "", "", false, nil, "", ""))
+
+	rr := httptest.NewRecorder()
+	getMessageHandler(db).ServeHTTP(rr, newMessageRequest("GET", "bob", "5", ""))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"mini-amhs/config"
+)
+
+const (
+	// keyRefreshInterval is how often every instance reloads the signing
+	// keys and, when due, rotates them.
+	keyRefreshInterval = time.Minute
+	// keyActivationDelay is how long a new key is published before it
+	// signs anything, so that every instance, and any JWKS cache, knows it
+	// by then.
+	keyActivationDelay = 5 * time.Minute
+	// signingKeyLockKey serialises rotation across instances
+	// (pg_advisory_xact_lock; released at commit or rollback).
+	signingKeyLockKey = 0x4a574b53
+)
+
+// signingKey is a key pair for RS256 or EdDSA auth tokens. A key signs
+// from activeFrom until the next key takes over at retiredAt, and verifies
+// until the last token it signed has expired.
+type signingKey struct {
+	kid        string
+	alg        string
+	private    crypto.Signer
+	createdAt  time.Time
+	activeFrom time.Time
+	retiredAt  *time.Time
+}
+
+// keyRing holds the signing keys loaded from the database, newest first.
+type keyRing struct {
+	mu   sync.RWMutex
+	keys []signingKey
+}
+
+// signingKeys is kept up to date by runKeyRotation when tokens are signed
+// with RS256 or EdDSA.
+var signingKeys = &keyRing{}
+
+func (kr *keyRing) set(keys []signingKey) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = keys
+}
+
+// current returns the key that signs tokens at now.
+func (kr *keyRing) current(now time.Time) (signingKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if !k.activeFrom.After(now) {
+			return k, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// publicKey returns the key that verifies tokens with the given kid.
+func (kr *keyRing) publicKey(kid string) (crypto.PublicKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if k.kid == kid {
+			return k.private.Public(), true
+		}
+	}
+	return nil, false
+}
+
+// jwks publishes every key that may sign or has signed unexpired tokens.
+func (kr *keyRing) jwks() jwkSet {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	set := jwkSet{Keys: []jwk{}}
+	for _, k := range kr.keys {
+		j, err := publicJWK(k.kid, k.alg, k.private.Public())
+		if err != nil {
+			log.Printf("signing key %s: %v", k.kid, err)
+			continue
+		}
+		set.Keys = append(set.Keys, j)
+	}
+	return set
+}
+
+// generateSigningKey makes a new key pair for alg and returns it with its
+// PKCS #8 PEM encoding.
+func generateSigningKey(alg string) (crypto.Signer, string, error) {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, "", fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func parseSigningKey(s string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	return signer, nil
+}
+
+// rotateSigningKeys drops keys no token can still need, makes a new key
+// when the newest is older than cfg.KeyRotation (or there is none), and
+// loads the rest into ring. A new key is published keyActivationDelay
+// before it starts signing, and its predecessor is retired at that moment.
+func rotateSigningKeys(db *sql.DB, ring *keyRing, cfg config.AuthConfig, now time.Time) error {
+	var keys []signingKey
+	err := withTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, signingKeyLockKey); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM jwt_keys WHERE retired_at < $1`, now.Add(-cfg.TokenLifetime)); err != nil {
+			return err
+		}
+		// Tokens of another algorithm are refused anyway.
+		if _, err := tx.Exec(`UPDATE jwt_keys SET retired_at=$1 WHERE alg<>$2 AND retired_at IS NULL`, now, cfg.SigningAlg); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(
+			`SELECT kid, private_key, created_at, active_from, retired_at
+			 FROM jwt_keys WHERE alg=$1 ORDER BY active_from DESC`, cfg.SigningAlg)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			k := signingKey{alg: cfg.SigningAlg}
+			var private string
+			if err := rows.Scan(&k.kid, &private, &k.createdAt, &k.activeFrom, &k.retiredAt); err != nil {
+				return err
+			}
+			if k.private, err = parseSigningKey(private); err != nil {
+				return fmt.Errorf("signing key %s: %w", k.kid, err)
+			}
+			keys = append(keys, k)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(keys) > 0 && (cfg.KeyRotation == 0 || now.Sub(keys[0].createdAt) < cfg.KeyRotation) {
+			return nil
+		}
+		k := signingKey{alg: cfg.SigningAlg, createdAt: now, activeFrom: now}
+		if len(keys) > 0 {
+			k.activeFrom = now.Add(keyActivationDelay)
+		}
+		var private string
+		if k.private, private, err = generateSigningKey(cfg.SigningAlg); err != nil {
+			return err
+		}
+		if k.kid, err = randomToken(8); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE jwt_keys SET retired_at=$1 WHERE retired_at IS NULL`, k.activeFrom); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO jwt_keys(kid, alg, private_key, created_at, active_from) VALUES($1, $2, $3, $4, $5)`,
+			k.kid, k.alg, private, k.createdAt, k.activeFrom,
+		); err != nil {
+			return err
+		}
+		log.Printf("new %s signing key %s, signing from %s", k.alg, k.kid, k.activeFrom.Format(time.RFC3339))
+		keys = append([]signingKey{k}, keys...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ring.set(keys)
+	return nil
+}
+
+// runKeyRotation keeps ring in step with the database until ctx is done.
+func runKeyRotation(ctx context.Context, db *sql.DB, ring *keyRing, cfg config.AuthConfig) {
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rotateSigningKeys(db, ring, cfg, time.Now()); err != nil {
+				log.Println("signing key rotation error:", err)
+			}
+		}
+	}
+}
+
+// jwksHandler publishes the public signing keys, so that other services
+// can verify auth tokens. The set is empty when tokens are signed with
+// HS256.
+func jwksHandler(ring *keyRing) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		writeJSON(w, ring.jwks())
+	}
+}
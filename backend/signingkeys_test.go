@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"mini-amhs/config"
+)
+
+var jwtKeyColumnNames = []string{"kid", "private_key", "created_at", "active_from", "retired_at"}
+
+// useSigningKeys switches token signing to alg with the given keys for
+// the rest of the test.
+func useSigningKeys(t *testing.T, alg string, keys ...signingKey) {
+	savedAuth, savedKeys := appConfig.Auth, signingKeys.keys
+	t.Cleanup(func() {
+		appConfig.Auth = savedAuth
+		signingKeys.set(savedKeys)
+	})
+	appConfig.Auth.SigningAlg = alg
+	signingKeys.set(keys)
+}
+
+func newTestSigningKey(t *testing.T, kid, alg string, activeFrom time.Time) (signingKey, string) {
+	private, pem, err := generateSigningKey(alg)
+	require.NoError(t, err)
+	return signingKey{kid: kid, alg: alg, private: private, createdAt: activeFrom, activeFrom: activeFrom}, pem
+}
+
+func expectKeyRotationStart(mock sqlmock.Sqlmock, now time.Time, alg string) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1\)`).
+		WithArgs(signingKeyLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM jwt_keys WHERE retired_at < \$1`).
+		WithArgs(now.Add(-24 * time.Hour)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE jwt_keys SET retired_at=\$1 WHERE alg<>\$2 AND retired_at IS NULL`).
+		WithArgs(now, alg).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestRotateSigningKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	cfg := config.AuthConfig{SigningAlg: "EdDSA", TokenLifetime: 24 * time.Hour, KeyRotation: 30 * 24 * time.Hour}
+	now := time.Now()
+	ring := &keyRing{}
+
+	// The first key signs at once.
+	kid := &captureArg{}
+	expectKeyRotationStart(mock, now, "EdDSA")
+	mock.ExpectQuery(`SELECT kid, private_key, created_at, active_from, retired_at FROM jwt_keys WHERE alg=\$1`).
+		WithArgs("EdDSA").
+		WillReturnRows(sqlmock.NewRows(jwtKeyColumnNames))
+	mock.ExpectExec(`UPDATE jwt_keys SET retired_at=\$1 WHERE retired_at IS NULL`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO jwt_keys`).
+		WithArgs(kid, "EdDSA", sqlmock.AnyArg(), now, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.NoError(t, rotateSigningKeys(db, ring, cfg, now))
+	current, ok := ring.current(now)
+	require.True(t, ok)
+	assert.Equal(t, kid.v, current.kid)
+
+	// A key younger than key_rotation is kept.
+	old, oldPEM := newTestSigningKey(t, "old", "EdDSA", now.Add(-29*24*time.Hour))
+	expectKeyRotationStart(mock, now, "EdDSA")
+	mock.ExpectQuery(`SELECT kid, private_key`).
+		WithArgs("EdDSA").
+		WillReturnRows(sqlmock.NewRows(jwtKeyColumnNames).AddRow("old", oldPEM, old.createdAt, old.activeFrom, nil))
+	mock.ExpectCommit()
+	require.NoError(t, rotateSigningKeys(db, ring, cfg, now))
+	current, _ = ring.current(now)
+	assert.Equal(t, "old", current.kid)
+
+	// Once it is due, the next key is published ahead of signing and the
+	// old one retires when it takes over.
+	later := now.Add(2 * 24 * time.Hour)
+	activeFrom := later.Add(keyActivationDelay)
+	expectKeyRotationStart(mock, later, "EdDSA")
+	mock.ExpectQuery(`SELECT kid, private_key`).
+		WithArgs("EdDSA").
+		WillReturnRows(sqlmock.NewRows(jwtKeyColumnNames).AddRow("old", oldPEM, old.createdAt, old.activeFrom, nil))
+	mock.ExpectExec(`UPDATE jwt_keys SET retired_at=\$1 WHERE retired_at IS NULL`).
+		WithArgs(activeFrom).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO jwt_keys`).
+		WithArgs(sqlmock.AnyArg(), "EdDSA", sqlmock.AnyArg(), later, activeFrom).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.NoError(t, rotateSigningKeys(db, ring, cfg, later))
+	current, _ = ring.current(later)
+	assert.Equal(t, "old", current.kid)
+	current, _ = ring.current(activeFrom)
+	assert.NotEqual(t, "old", current.kid)
+	assert.Len(t, ring.jwks().Keys, 2)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestJWTAuthMiddleware_SigningKeys(t *testing.T) {
+	now := time.Now()
+	current, _ := newTestSigningKey(t, "k2", "EdDSA", now.Add(-time.Hour))
+	previous, _ := newTestSigningKey(t, "k1", "EdDSA", now.Add(-48*time.Hour))
+	next, _ := newTestSigningKey(t, "k3", "EdDSA", now.Add(time.Minute))
+	rsaKey, _ := newTestSigningKey(t, "r1", "RS256", now.Add(-time.Hour))
+	useSigningKeys(t, "EdDSA", next, current, previous)
+	jwtKey = []byte("test-secret")
+
+	whoami := jwtAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := getUsername(r.Context())
+		w.Write([]byte(username))
+	}))
+	do := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		whoami.ServeHTTP(rr, req)
+		return rr
+	}
+	claims := func() *Claims {
+		return &Claims{Username: "alice", RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "mini-amhs",
+			Audience:  jwt.ClaimStrings{"mini-amhs"},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		}}
+	}
+	sign := func(method jwt.SigningMethod, kid string, key any, c *Claims) string {
+		tok := jwt.NewWithClaims(method, c)
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(key)
+		require.NoError(t, err)
+		return s
+	}
+
+	// Issued tokens name the current key.
+	token, err := issueToken(User{Username: "alice", Role: roleUser})
+	require.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "k2", parsed.Header["kid"])
+	rr := do(token)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "alice", rr.Body.String())
+
+	// Tokens of the previous key are still good after rotation.
+	assert.Equal(t, http.StatusOK, do(sign(jwt.SigningMethodEdDSA, "k1", previous.private, claims())).Code)
+
+	refused := map[string]string{
+		"unknown kid":      sign(jwt.SigningMethodEdDSA, "k9", current.private, claims()),
+		"wrong key":        sign(jwt.SigningMethodEdDSA, "k2", previous.private, claims()),
+		"other algorithm":  sign(jwt.SigningMethodRS256, "k2", rsaKey.private, claims()),
+		"HMAC with secret": sign(jwt.SigningMethodHS256, "k2", jwtKey, claims()),
+	}
+	c := claims()
+	c.Issuer = "someone-else"
+	refused["wrong issuer"] = sign(jwt.SigningMethodEdDSA, "k2", current.private, c)
+	c = claims()
+	c.Audience = jwt.ClaimStrings{"another-service"}
+	refused["wrong audience"] = sign(jwt.SigningMethodEdDSA, "k2", current.private, c)
+	c = claims()
+	c.ExpiresAt = nil
+	refused["no expiry"] = sign(jwt.SigningMethodEdDSA, "k2", current.private, c)
+	for name, token := range refused {
+		rr := do(token)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, name)
+		assert.Equal(t, "invalid auth token\n", rr.Body.String(), name)
+	}
+}
+
+func TestJWTAuthMiddleware_HS256(t *testing.T) {
+	useSigningKeys(t, "HS256")
+	jwtKey = []byte("test-secret")
+	handler := jwtAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	token, err := issueToken(User{Username: "alice", Role: roleUser})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, do(token))
+
+	// Tokens from before issuer and audience were set are refused.
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{Username: "alice", RegisteredClaims: jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}).SignedString(jwtKey)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, do(legacy))
+}
+
+func TestJWKSHandler(t *testing.T) {
+	now := time.Now()
+	ed, _ := newTestSigningKey(t, "e1", "EdDSA", now)
+	rs, _ := newTestSigningKey(t, "r1", "RS256", now)
+	rr := httptest.NewRecorder()
+	jwksHandler(&keyRing{keys: []signingKey{ed, rs}}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var set jwkSet
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &set))
+	require.Len(t, set.Keys, 2)
+	assert.Equal(t, jwk{Kty: "OKP", Kid: "e1", Use: "sig", Alg: "EdDSA", Crv: "Ed25519", X: set.Keys[0].X}, set.Keys[0])
+	assert.Equal(t, "RSA", set.Keys[1].Kty)
+	for i, k := range []signingKey{ed, rs} {
+		pub, err := set.Keys[i].publicKey()
+		require.NoError(t, err)
+		assert.True(t, pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(k.private.Public()))
+	}
+
+	// Nothing is published for HS256.
+	rr = httptest.NewRecorder()
+	jwksHandler(&keyRing{}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	assert.JSONEq(t, `{"keys": []}`, rr.Body.String())
+}
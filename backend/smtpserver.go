@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSMTPRecipients bounds the RCPT commands of one transaction.
+const maxSMTPRecipients = 100
+
+// smtpReply is an SMTP status a backend answers with, such as a refused
+// recipient. Other errors are reported as temporary failures.
+type smtpReply struct {
+	Code int
+	Msg  string
+}
+
+func (e *smtpReply) Error() string { return fmt.Sprintf("%d %s", e.Code, e.Msg) }
+
+// smtpBackend decides what the SMTP server accepts and takes the mail.
+type smtpBackend interface {
+	// checkRecipient is asked for each RCPT TO address.
+	checkRecipient(addr string) error
+	// deliver takes one mail once its data has been received. from is
+	// empty for the null sender.
+	deliver(from string, to []string, data []byte) error
+}
+
+// smtpServer is a minimal SMTP server: enough of RFC 5321 for mail
+// clients and relays to hand over mail, without authentication or TLS.
+type smtpServer struct {
+	hostname string
+	maxSize  int
+	timeout  time.Duration
+	backend  smtpBackend
+}
+
+// serve accepts connections on ln until ctx is done.
+func (s *smtpServer) serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// smtpTransaction is the state between MAIL and the end of DATA.
+type smtpTransaction struct {
+	started bool
+	from    string
+	to      []string
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	reply := func(code int, format string, args ...any) error {
+		return tc.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+	}
+
+	var greeted bool
+	var tx smtpTransaction
+	if reply(220, "%s ESMTP mini-amhs", s.hostname) != nil {
+		return
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(s.timeout))
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			greeted, tx = true, smtpTransaction{}
+			err = tc.PrintfLine("250-%s\r\n250-SIZE %d\r\n250 8BITMIME", s.hostname, s.maxSize)
+		case "HELO":
+			greeted, tx = true, smtpTransaction{}
+			err = reply(250, "%s", s.hostname)
+		case "MAIL":
+			err = s.mail(reply, greeted, &tx, arg)
+		case "RCPT":
+			err = s.rcpt(reply, &tx, arg)
+		case "DATA":
+			if len(tx.to) == 0 {
+				err = reply(503, "5.5.1 need RCPT first")
+				break
+			}
+			if err = reply(354, "end data with <CR><LF>.<CR><LF>"); err != nil {
+				break
+			}
+			err = s.data(reply, tc, tx)
+			tx = smtpTransaction{}
+		case "RSET":
+			tx = smtpTransaction{}
+			err = reply(250, "2.0.0 ok")
+		case "NOOP":
+			err = reply(250, "2.0.0 ok")
+		case "VRFY":
+			err = reply(252, "2.1.5 cannot verify, but will accept the message")
+		case "QUIT":
+			reply(221, "2.0.0 %s closing connection", s.hostname)
+			return
+		default:
+			err = reply(502, "5.5.2 command not implemented")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *smtpServer) mail(reply func(int, string, ...any) error, greeted bool, tx *smtpTransaction, arg string) error {
+	if !greeted {
+		return reply(503, "5.5.1 send EHLO first")
+	}
+	if tx.started {
+		return reply(503, "5.5.1 nested MAIL command")
+	}
+	from, params, ok := parseSMTPPath(arg, "FROM:")
+	if !ok {
+		return reply(501, "5.5.4 syntax: MAIL FROM:<address>")
+	}
+	for _, p := range strings.Fields(params) {
+		if v, ok := strings.CutPrefix(strings.ToUpper(p), "SIZE="); ok {
+			if n, err := strconv.Atoi(v); err == nil && n > s.maxSize {
+				return reply(552, "5.3.4 message exceeds maximum size of %d bytes", s.maxSize)
+			}
+		}
+	}
+	*tx = smtpTransaction{started: true, from: from}
+	return reply(250, "2.1.0 ok")
+}
+
+func (s *smtpServer) rcpt(reply func(int, string, ...any) error, tx *smtpTransaction, arg string) error {
+	if !tx.started {
+		return reply(503, "5.5.1 need MAIL first")
+	}
+	to, _, ok := parseSMTPPath(arg, "TO:")
+	if !ok || to == "" {
+		return reply(501, "5.5.4 syntax: RCPT TO:<address>")
+	}
+	if len(tx.to) >= maxSMTPRecipients {
+		return reply(452, "4.5.3 too many recipients")
+	}
+	if err := s.backend.checkRecipient(to); err != nil {
+		return replyError(reply, err)
+	}
+	tx.to = append(tx.to, to)
+	return reply(250, "2.1.5 ok")
+}
+
+func (s *smtpServer) data(reply func(int, string, ...any) error, tc *textproto.Conn, tx smtpTransaction) error {
+	dr := tc.DotReader()
+	data, err := io.ReadAll(io.LimitReader(dr, int64(s.maxSize)+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > s.maxSize {
+		if _, err := io.Copy(io.Discard, dr); err != nil {
+			return err
+		}
+		return reply(552, "5.3.4 message exceeds maximum size of %d bytes", s.maxSize)
+	}
+	if err := s.backend.deliver(tx.from, tx.to, data); err != nil {
+		return replyError(reply, err)
+	}
+	return reply(250, "2.0.0 ok: queued")
+}
+
+// replyError answers with the status of an smtpReply, or a temporary
+// failure for anything else.
+func replyError(reply func(int, string, ...any) error, err error) error {
+	var r *smtpReply
+	if errors.As(err, &r) {
+		return reply(r.Code, "%s", r.Msg)
+	}
+	log.Println("smtp error:", err)
+	return reply(451, "4.3.0 local error, try again later")
+}
+
+// parseSMTPPath reads the "FROM:<address> PARAMS" argument of MAIL, or the
+// "TO:" one of RCPT. The null path <> gives an empty address.
+func parseSMTPPath(arg, prefix string) (addr, params string, ok bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", "", false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", "", false
+	}
+	addr = rest[1:end]
+	// Source routes (<@a,@b:user@c>) are obsolete; keep only the mailbox.
+	if i := strings.IndexByte(addr, ':'); i >= 0 && strings.HasPrefix(addr, "@") {
+		addr = addr[i+1:]
+	}
+	return addr, strings.TrimSpace(rest[end+1:]), true
+}
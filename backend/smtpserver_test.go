@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingBackend accepts mail for @amhs.local and keeps what it gets.
+type recordingBackend struct {
+	mu   sync.Mutex
+	from string
+	to   []string
+	data string
+}
+
+func (b *recordingBackend) checkRecipient(addr string) error {
+	if !strings.HasSuffix(addr, "@amhs.local") {
+		return &smtpReply{550, "5.7.1 relaying denied"}
+	}
+	return nil
+}
+
+func (b *recordingBackend) deliver(from string, to []string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.from, b.to, b.data = from, to, string(data)
+	return nil
+}
+
+func startSMTPServer(t *testing.T, backend smtpBackend, maxSize int) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv := &smtpServer{hostname: "amhs.test", maxSize: maxSize, timeout: 5 * time.Second, backend: backend}
+	go srv.serve(ctx, ln)
+	return ln.Addr().String()
+}
+
+func TestSMTPServer_Delivers(t *testing.T) {
+	backend := &recordingBackend{}
+	addr := startSMTPServer(t, backend, 1<<20)
+
+	mail := "From: ops@partner.example\r\nSubject: Hello\r\n\r\nLine one\r\n.leading dot\r\n"
+	err := smtp.SendMail(addr, nil, "ops@partner.example", []string{"alice@amhs.local", "bob@amhs.local"}, []byte(mail))
+	require.NoError(t, err)
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	assert.Equal(t, "ops@partner.example", backend.from)
+	assert.Equal(t, []string{"alice@amhs.local", "bob@amhs.local"}, backend.to)
+	assert.Equal(t, "From: ops@partner.example\nSubject: Hello\n\nLine one\n.leading dot\n", backend.data)
+}
+
+func TestSMTPServer_Refusals(t *testing.T) {
+	addr := startSMTPServer(t, &recordingBackend{}, 64)
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Hello("client.test"))
+	ok, size := c.Extension("SIZE")
+	assert.True(t, ok)
+	assert.Equal(t, "64", size)
+
+	require.NoError(t, c.Mail("ops@partner.example"))
+	err = c.Rcpt("carol@elsewhere.example")
+	var perr *textproto.Error
+	require.ErrorAs(t, err, &perr)
+	assert.Equal(t, 550, perr.Code)
+
+	require.NoError(t, c.Rcpt("alice@amhs.local"))
+	w, err := c.Data()
+	require.NoError(t, err)
+	w.Write([]byte(strings.Repeat("x", 100) + "\r\n"))
+	err = w.Close()
+	require.ErrorAs(t, err, &perr)
+	assert.Equal(t, 552, perr.Code)
+
+	// The session goes on after a refused message.
+	assert.NoError(t, c.Reset())
+	assert.NoError(t, c.Quit())
+}
+
+func TestParseSMTPPath(t *testing.T) {
+	addr, params, ok := parseSMTPPath("FROM:<ops@partner.example> SIZE=1024", "FROM:")
+	assert.True(t, ok)
+	assert.Equal(t, "ops@partner.example", addr)
+	assert.Equal(t, "SIZE=1024", params)
+
+	addr, _, ok = parseSMTPPath("from: <>", "FROM:")
+	assert.True(t, ok)
+	assert.Empty(t, addr)
+
+	addr, _, ok = parseSMTPPath("TO:<@relay.example:alice@amhs.local>", "TO:")
+	assert.True(t, ok)
+	assert.Equal(t, "alice@amhs.local", addr)
+
+	_, _, ok = parseSMTPPath("TO:alice@amhs.local", "TO:")
+	assert.False(t, ok)
+	_, _, ok = parseSMTPPath("FROM:<alice@amhs.local>", "TO:")
+	assert.False(t, ok)
+}
+
+func TestSMTPSink(t *testing.T) {
+	var out syncBuffer
+	dir := t.TempDir()
+	addr := startSMTPServer(t, &smtpSink{dir: dir, out: &out}, 1<<20)
+
+	mail := "From: amhs@localhost\r\nSubject: METAR\r\nX-AFTN-Priority: FF\r\n\r\nEGLL 191020Z\r\n"
+	require.NoError(t, smtp.SendMail(addr, nil, "amhs@localhost", []string{"ops@partner.example"}, []byte(mail)))
+
+	assert.Contains(t, out.String(), "<< #1 from <amhs@localhost> to ops@partner.example")
+	assert.Contains(t, out.String(), "Subject: METAR (FF), 0 attachments\nEGLL 191020Z")
+	assert.Len(t, storedFiles(t, dir), 1)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpSink is a stand-in mail server for local testing of email
+// forwarding. It accepts all mail, prints a summary of each, and can keep
+// them as .eml files.
+type smtpSink struct {
+	dir string
+	out io.Writer
+
+	mu sync.Mutex
+	n  int
+}
+
+// runSMTPSink implements the smtp-sink subcommand.
+func runSMTPSink(args []string) int {
+	fs := flag.NewFlagSet("smtp-sink", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:2525", "address to accept mail on")
+	dir := fs.String("dir", "", "directory to write received mail to as .eml files")
+	maxSize := fs.Int("max-message-size", 25<<20, "largest mail accepted in bytes")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if *dir != "" {
+		if err := os.MkdirAll(*dir, 0o755); err != nil {
+			log.Printf("smtp-sink: %v", err)
+			return 1
+		}
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Printf("smtp-sink: %v", err)
+		return 1
+	}
+	log.Printf("smtp-sink listening on %s", ln.Addr())
+	srv := &smtpServer{
+		hostname: "smtp-sink",
+		maxSize:  *maxSize,
+		timeout:  5 * time.Minute,
+		backend:  &smtpSink{dir: *dir, out: os.Stdout},
+	}
+	if err := srv.serve(context.Background(), ln); err != nil {
+		log.Printf("smtp-sink: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func (s *smtpSink) checkRecipient(addr string) error { return nil }
+
+func (s *smtpSink) deliver(from string, to []string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	summary := fmt.Sprintf("<< #%d from <%s> to %s, %d bytes", s.n, from, strings.Join(to, ", "), len(data))
+	if m, err := parseMail(data); err == nil {
+		summary += fmt.Sprintf("\n   Subject: %s (%s), %d attachments\n%s", m.Subject, m.Priority, len(m.Attachments), m.Text)
+	}
+	fmt.Fprintln(s.out, strings.TrimRight(summary, "\n"))
+	if s.dir == "" {
+		return nil
+	}
+	name := filepath.Join(s.dir, fmt.Sprintf("%s-%03d.eml", time.Now().UTC().Format("20060102T150405"), s.n))
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "   saved to %s\n", name)
+	return nil
+}
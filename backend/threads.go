@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// quoteBody renders msg as a quoted block for a reply.
+func quoteBody(msg Message) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "On %s, %s wrote:\n", msg.CreatedAt.UTC().Format("2006-01-02 15:04 MST"), msg.Sender)
+	for _, line := range strings.Split(msg.Body, "\n") {
+		b.WriteString("> ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// quoteTruncated ends a quote that was cut to fit the body limit, and
+// forwardTruncated a forwarded message.
+const (
+	quoteTruncated   = "> [...]\n"
+	forwardTruncated = "[...]\n"
+)
+
+// appendCut puts text under lead, cutting text at a line boundary where
+// needed so the result stays within max bytes, and marking the cut with
+// truncated. A lead that is itself too long is left for validate to
+// refuse.
+func appendCut(lead, text, truncated string, max int) string {
+	sep := "\n\n"
+	if lead == "" {
+		sep = ""
+	}
+	room := max - len(lead) - len(sep)
+	if len(text) <= room {
+		return lead + sep + text
+	}
+	room -= len(truncated)
+	if room <= 0 {
+		return lead
+	}
+	cut := strings.LastIndexByte(text[:room], '\n')
+	if cut < 0 {
+		return lead
+	}
+	return lead + sep + text[:cut+1] + truncated
+}
+
+// replyBody puts the quoted original under the reply, cut to stay within
+// max bytes.
+func replyBody(reply string, orig Message, max int) string {
+	return appendCut(strings.TrimSpace(reply), quoteBody(orig), quoteTruncated, max)
+}
+
+// forwardedBody renders msg as an inline forwarded message under note, cut
+// to stay within max bytes.
+func forwardedBody(note string, msg Message, max int) string {
+	fwd := fmt.Sprintf("---------- Forwarded message ----------\nFrom: %s\nTo: %s\nDate: %s\nSubject: %s\n\n%s",
+		msg.Sender, msg.Receiver, msg.CreatedAt.UTC().Format("2006-01-02 15:04 MST"), msg.Subject, msg.Body)
+	return appendCut(strings.TrimSpace(note), fwd, forwardTruncated, max)
+}
+
+// prefixSubject adds prefix ("Re:" or "Fwd:") unless the subject already
+// carries it.
+func prefixSubject(prefix, subject string) string {
+	if strings.HasPrefix(strings.ToLower(subject), strings.ToLower(prefix)) {
+		return subject
+	}
+	return prefix + " " + subject
+}
+
+// replyHandler serves POST /api/messages/{id}/reply. The reply goes to the
+// other party of the original message and joins its thread.
+func replyHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orig, username, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+
+		var in struct {
+			Subject string `json:"subject"`
+			Body    string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(in.Body) == "" {
+			http.Error(w, "missing fields", http.StatusBadRequest)
+			return
+		}
+
+		subject := in.Subject
+		if strings.TrimSpace(subject) == "" {
+			subject = prefixSubject("Re:", orig.Subject)
+		}
+		counterpart := orig.Sender
+		if orig.Sender == username {
+			counterpart = orig.Receiver
+		}
+		receiver, rt, err := resolveRecipient(db, counterpart)
+		if errors.Is(err, errUnknownRecipient) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("resolve receiver error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		nm := newMessage{
+			Receiver:  receiver,
+			Route:     rt,
+			Subject:   subject,
+			Body:      replyBody(in.Body, orig, appConfig.Limits.MaxBodyLen),
+			Priority:  orig.Priority,
+			InReplyTo: &orig.ID,
+			ThreadID:  &orig.ThreadID,
+		}
+		sendComposed(db, w, username, nm)
+	})
+}
+
+// forwardHandler serves POST /api/messages/{id}/forward. A forward starts
+// from the original thread so both ends can follow where it went.
+func forwardHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orig, username, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+
+		var in struct {
+			Receiver string `json:"receiver"`
+			Subject  string `json:"subject"`
+			Body     string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+
+		subject := in.Subject
+		if strings.TrimSpace(subject) == "" {
+			subject = prefixSubject("Fwd:", orig.Subject)
+		}
+		receiver, rt, err := resolveRecipient(db, strings.TrimSpace(in.Receiver))
+		if errors.Is(err, errUnknownRecipient) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("resolve receiver error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		nm := newMessage{
+			Receiver:  receiver,
+			Subject:   subject,
+			Body:      forwardedBody(in.Body, orig, appConfig.Limits.MaxBodyLen),
+			Priority:  orig.Priority,
+			InReplyTo: &orig.ID,
+			ThreadID:  &orig.ThreadID,
+			Route:     rt,
+		}
+		sendComposed(db, w, username, nm)
+	})
+}
+
+// sendComposed validates and stores a message built by reply or forward.
+func sendComposed(db *sql.DB, w http.ResponseWriter, username string, nm newMessage) {
+	if err := nm.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg, err := sendMessage(db, username, nm)
+	if err != nil {
+		log.Println("insert error:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, msg)
+}
+
+// threadHandler serves GET /api/messages/{id}/thread: every message in the
+// conversation that the caller sent or received and has not deleted,
+// oldest first.
+func threadHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, username, ok := loadOwnedMessage(db, w, r)
+		if !ok {
+			return
+		}
+
+		rows, err := db.Query(
+			`SELECT `+messageColumns+`
+			 FROM messages
+			 WHERE COALESCE(thread_id, id)=$1
+			   AND ((sender=$2 AND sender_deleted_at IS NULL) OR (receiver=$2 AND receiver_deleted_at IS NULL AND `+receiverVisible+`))
+			 ORDER BY created_at ASC, id ASC`,
+			msg.ThreadID, username,
+		)
+		if err != nil {
+			log.Println("thread query error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		messages := []Message{}
+		for rows.Next() {
+			m, err := scanMessage(rows)
+			if err != nil {
+				log.Println("scan error:", err)
+				continue
+			}
+			messages = append(messages, m)
+		}
+		writeJSON(w, map[string]any{"thread_id": msg.ThreadID, "data": messages})
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"mini-amhs/config"
+)
+
+// certReloader serves the current server certificate and client CA pool and
+// swaps them in place when reload is called, so rotating certificates does
+// not require a restart.
+type certReloader struct {
+	cfg config.TLSConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+func newCertReloader(cfg config.TLSConfig) (*certReloader, error) {
+	c := &certReloader{cfg: cfg}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if c.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("read client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA file contains no certificates")
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCA = pool
+	c.mu.Unlock()
+	return nil
+}
+
+// watchSIGHUP reloads the certificates every time the process receives
+// SIGHUP. A failed reload keeps the previous certificates in service.
+func (c *certReloader) watchSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := c.reload(); err != nil {
+				log.Println("tls reload error:", err)
+				continue
+			}
+			log.Println("tls certificates reloaded")
+		}
+	}()
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// tlsConfig builds the server TLS configuration. Client certificates are
+// optional so that browsers can still authenticate with a bearer token.
+func (c *certReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+	}
+	if c.cfg.ClientCAFile == "" {
+		return base
+	}
+	base.ClientAuth = tls.VerifyClientCertIfGiven
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientCAs = c.clientCA
+		return cfg, nil
+	}
+	return base
+}
+
+// clientCertSubject returns the subject of the verified client certificate
+// on r, if the client presented one.
+func clientCertSubject(r *http.Request) (pkix.Name, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return pkix.Name{}, false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject, true
+}
+
+// subjectMatches reports whether pattern names subject by its full DN or
+// its common name.
+func subjectMatches(subject pkix.Name, pattern string) bool {
+	return pattern != "" && (pattern == subject.String() || pattern == subject.CommonName)
+}
+
+// clientCertIdentity returns the platform username for a verified client
+// certificate on r. presented is false when the client sent no verified
+// certificate; mapped reports whether its subject maps to an identity.
+func clientCertIdentity(r *http.Request) (username string, presented, mapped bool) {
+	subject, ok := clientCertSubject(r)
+	if !ok {
+		return "", false, false
+	}
+	ids := appConfig.TLS.ClientIdentities
+	if u, found := ids[subject.String()]; found {
+		return u, true, true
+	}
+	if u, found := ids[subject.CommonName]; found {
+		return u, true, true
+	}
+	return "", true, false
+}
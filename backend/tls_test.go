@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"mini-amhs/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"Mini AMHS Test"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) writePEM(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestMutualTLS_ClientCertificateIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil, true)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	serverCert, serverKey := newTestCert(t, "localhost", ca, false).writePEM(t, dir, "server")
+	gateway := newTestCert(t, "gateway-eglx", ca, false)
+	stranger := newTestCert(t, "stranger", ca, false)
+
+	old := appConfig
+	appConfig = config.Default()
+	appConfig.TLS = config.TLSConfig{
+		CertFile:         serverCert,
+		KeyFile:          serverKey,
+		ClientCAFile:     caFile,
+		ClientIdentities: map[string]string{"gateway-eglx": "EGLXGATE"},
+	}
+	defer func() { appConfig = old }()
+
+	certs, err := newCertReloader(appConfig.TLS)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(jwtAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := getUsername(r.Context())
+		w.Write([]byte(username))
+	})))
+	srv.TLS = certs.tlsConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(clientCert *testCert) (int, string) {
+		tlsCfg := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			tlsCfg.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+		resp, err := client.Get(srv.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get(gateway)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "EGLXGATE", body)
+
+	code, _ = get(stranger)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body = get(nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "missing auth token\n", body)
+}
+
+func TestCertReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil, true)
+	first := newTestCert(t, "first", ca, false)
+	certFile, keyFile := first.writePEM(t, dir, "server")
+
+	certs, err := newCertReloader(config.TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	got, _ := certs.getCertificate(nil)
+	assert.Equal(t, first.cert.Raw, got.Certificate[0])
+
+	second := newTestCert(t, "second", ca, false)
+	second.writePEM(t, dir, "server")
+	require.NoError(t, certs.reload())
+	got, _ = certs.getCertificate(nil)
+	assert.Equal(t, second.cert.Raw, got.Certificate[0])
+
+	// A broken file keeps the last good certificate in service.
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	assert.Error(t, certs.reload())
+	got, _ = certs.getCertificate(nil)
+	assert.Equal(t, second.cert.Raw, got.Certificate[0])
+}
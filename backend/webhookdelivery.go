@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"mini-amhs/config"
+)
+
+// Headers of webhook requests. The signature is computed like a relay
+// signature (see signRelayBody), with the webhook's secret.
+const (
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	// webhookBatchSize bounds the deliveries sent per poll.
+	webhookBatchSize = 50
+	// webhookBacklog is how many published events may wait to be queued
+	// before new ones are dropped.
+	webhookBacklog = 1024
+)
+
+// webhookPayload is the JSON body posted to a webhook.
+type webhookPayload struct {
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Username   string    `json:"username"`
+	Data       any       `json:"data"`
+}
+
+// publishedEvent is an event seen on the hub, waiting to be queued.
+type publishedEvent struct {
+	username string
+	ev       Event
+	at       time.Time
+}
+
+// webhookItem is a claimed delivery with what is needed to send it.
+type webhookItem struct {
+	ID       int64
+	Event    string
+	Payload  []byte
+	Attempts int
+	URL      string
+	Secret   string
+}
+
+// webhookDispatcher queues a delivery for every webhook matching a
+// published event, and sends the deliveries.
+type webhookDispatcher struct {
+	db      *sql.DB
+	cfg     config.WebhookConfig
+	client  *http.Client
+	pending chan publishedEvent
+}
+
+func newWebhookDispatcher(db *sql.DB, cfg config.WebhookConfig) *webhookDispatcher {
+	return &webhookDispatcher{
+		db:      db,
+		cfg:     cfg,
+		client:  newWebhookClient(cfg.Timeout),
+		pending: make(chan publishedEvent, webhookBacklog),
+	}
+}
+
+// newWebhookClient returns the client that posts deliveries. Webhook URLs
+// are chosen by users, so it only connects to public addresses, checked
+// after name resolution, and does not follow redirects; a redirect counts
+// as a failed delivery.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: refuseInternalAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// refuseInternalAddress is a dialer Control that refuses loopback,
+// private, link-local and unspecified addresses.
+func refuseInternalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// runWebhookWorker queues the events published on hub and sends due
+// deliveries every cfg.PollInterval until ctx is done.
+func runWebhookWorker(ctx context.Context, db *sql.DB, hub *eventHub, cfg config.WebhookConfig) {
+	d := newWebhookDispatcher(db, cfg)
+	hub.observe(d.observe)
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pe := <-d.pending:
+			if err := d.enqueue(pe); err != nil {
+				log.Printf("webhook queue error for %s: %v", pe.ev.Type, err)
+			}
+		case <-ticker.C:
+			if err := d.deliverDue(ctx); err != nil {
+				log.Println("webhook delivery error:", err)
+			}
+		}
+	}
+}
+
+// observe is called by the hub for every event; it must not block.
+func (d *webhookDispatcher) observe(username string, ev Event) {
+	select {
+	case d.pending <- publishedEvent{username: username, ev: ev, at: time.Now()}:
+	default:
+		log.Printf("webhook backlog is full, dropping %s for %s", ev.Type, username)
+	}
+}
+
+// enqueue records a delivery of the event for every active webhook that
+// subscribes to it: the user's own, and those for all users.
+func (d *webhookDispatcher) enqueue(pe publishedEvent) error {
+	payload, err := json.Marshal(webhookPayload{Event: pe.ev.Type, OccurredAt: pe.at.UTC(), Username: pe.username, Data: pe.ev.Data})
+	if err != nil {
+		return err
+	}
+	var priority string
+	if msg, ok := pe.ev.Data.(Message); ok {
+		priority = msg.Priority
+	}
+	_, err = d.db.Exec(
+		`INSERT INTO webhook_deliveries(webhook_id, event, username, payload)
+		 SELECT id, $1, $2, $3 FROM webhooks
+		 WHERE active AND $1 = ANY(events) AND (all_users OR created_by = $2)
+		   AND (cardinality(priorities) = 0 OR $4 = ANY(priorities))`,
+		pe.ev.Type, pe.username, string(payload), priority,
+	)
+	return err
+}
+
+// deliverDue claims the deliveries that are due and sends them one by one.
+func (d *webhookDispatcher) deliverDue(ctx context.Context) error {
+	items, err := d.claim()
+	if err != nil {
+		return err
+	}
+	for _, it := range items {
+		d.deliver(ctx, it)
+	}
+	return nil
+}
+
+// claim takes due deliveries, leasing them for the attempt.
+func (d *webhookDispatcher) claim() ([]webhookItem, error) {
+	rows, err := d.db.Query(
+		`UPDATE webhook_deliveries d SET attempts=d.attempts+1, next_attempt_at=$1, updated_at=NOW()
+		 FROM webhooks w
+		 WHERE w.id = d.webhook_id AND d.id IN (
+		   SELECT id FROM webhook_deliveries WHERE status=$2 AND next_attempt_at <= NOW()
+		   ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED)
+		 RETURNING d.id, d.event, d.payload, d.attempts, w.url, w.secret`,
+		time.Now().Add(d.cfg.Timeout+time.Minute), queuePending, webhookBatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []webhookItem
+	for rows.Next() {
+		var it webhookItem
+		if err := rows.Scan(&it.ID, &it.Event, &it.Payload, &it.Attempts, &it.URL, &it.Secret); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// deliver posts one delivery and records the attempt. Any answer but 2xx
+// is retried with backoff until the attempts are used up.
+func (d *webhookDispatcher) deliver(ctx context.Context, it webhookItem) {
+	start := time.Now()
+	code, err := d.post(ctx, it)
+	elapsed := time.Since(start)
+
+	status, next, reason := queueSent, time.Time{}, ""
+	if err != nil {
+		reason = err.Error()
+		status, next = queuePending, time.Now().Add(backoff(d.cfg.BackoffBase, d.cfg.BackoffMax, it.Attempts))
+		if it.Attempts >= d.cfg.MaxAttempts {
+			status = queueDead
+		}
+	}
+	err = withTx(d.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			`INSERT INTO webhook_attempts(delivery_id, status_code, error, duration_ms) VALUES($1,$2,$3,$4)`,
+			it.ID, code, reason, elapsed.Milliseconds(),
+		); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			`UPDATE webhook_deliveries SET status=$1, next_attempt_at=COALESCE($2, next_attempt_at), last_error=$3,
+			        delivered_at=CASE WHEN $1 = 'sent' THEN NOW() END, updated_at=NOW()
+			 WHERE id=$4`,
+			status, nullTime(next), reason, it.ID,
+		)
+		return err
+	})
+	if err != nil {
+		log.Printf("webhook bookkeeping error for delivery %d: %v", it.ID, err)
+	}
+}
+
+// post sends the delivery, returning the response status (0 if none came).
+func (d *webhookDispatcher) post(ctx context.Context, it webhookItem) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, it.URL, bytes.NewReader(it.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mini-amhs-webhooks")
+	req.Header.Set(webhookEventHeader, it.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(it.ID, 10))
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookSignatureHeader, signRelayBody(it.Secret, ts, it.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Only the status is kept: the body is the receiver's, and may not be
+	// meant for the webhook's owner.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// nullTime is nil for the zero time, for optional timestamp arguments.
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const webhookColumns = `id, created_by, url, events, priorities, all_users, active, created_at, updated_at`
+
+const webhookDeliveryColumns = `id, webhook_id, event, username, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at`
+
+// webhookEvents are the event types a webhook can subscribe to.
+var webhookEvents = []string{eventMessageCreated, eventMessageDelivered, eventMessageRead, eventReportNDR}
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var wh Webhook
+	err := row.Scan(&wh.ID, &wh.CreatedBy, &wh.URL, pq.Array(&wh.Events), pq.Array(&wh.Priorities), &wh.AllUsers, &wh.Active, &wh.CreatedAt, &wh.UpdatedAt)
+	return wh, err
+}
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload string
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Username, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+	d.Payload = json.RawMessage(payload)
+	if d.Status != queuePending {
+		d.NextAttemptAt = nil
+	}
+	return d, err
+}
+
+// webhookInput is a webhook as created or updated by its owner.
+type webhookInput struct {
+	URL        string   `json:"url"`
+	Events     []string `json:"events"`
+	Priorities []string `json:"priorities"`
+	// AllUsers subscribes to the events of every user; admins only.
+	AllUsers bool  `json:"all_users"`
+	Active   *bool `json:"active"`
+}
+
+func (in *webhookInput) validate() error {
+	in.URL = strings.TrimSpace(in.URL)
+	if u, err := url.Parse(in.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an http or https URL")
+	}
+	if len(in.Events) == 0 {
+		return errors.New("events must name at least one event")
+	}
+	for _, ev := range in.Events {
+		if !slices.Contains(webhookEvents, ev) {
+			return fmt.Errorf("events must be among %s", strings.Join(webhookEvents, ", "))
+		}
+	}
+	slices.Sort(in.Events)
+	in.Events = slices.Compact(in.Events)
+	if in.Priorities == nil {
+		in.Priorities = []string{}
+	}
+	for i, p := range in.Priorities {
+		in.Priorities[i] = strings.ToUpper(strings.TrimSpace(p))
+		if !slices.Contains(messagePriorities, in.Priorities[i]) {
+			return fmt.Errorf("priorities must be among %s", strings.Join(messagePriorities, ", "))
+		}
+	}
+	slices.Sort(in.Priorities)
+	in.Priorities = slices.Compact(in.Priorities)
+	return nil
+}
+
+// newWebhookSecret returns a random signing secret.
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// webhooksHandler serves GET and POST /api/webhooks. Users see and create
+// their own webhooks; admins see all, and may subscribe to every user's
+// events.
+func webhooksHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := getUsername(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		isAdmin := getRole(r.Context()) == roleAdmin
+
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query(`SELECT `+webhookColumns+` FROM webhooks WHERE $1 OR created_by=$2 ORDER BY id`, isAdmin, username)
+			if err != nil {
+				log.Println("select webhooks error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+
+			hooks := []Webhook{}
+			for rows.Next() {
+				wh, err := scanWebhook(rows)
+				if err != nil {
+					log.Println("scan error:", err)
+					continue
+				}
+				hooks = append(hooks, wh)
+			}
+			writeJSON(w, hooks)
+
+		case http.MethodPost:
+			var in webhookInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			if err := in.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if in.AllUsers && !isAdmin {
+				http.Error(w, "only admins can subscribe to all users' events", http.StatusForbidden)
+				return
+			}
+			secret, err := newWebhookSecret()
+			if err != nil {
+				log.Println("webhook secret error:", err)
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			active := in.Active == nil || *in.Active
+
+			var wh Webhook
+			err = withTx(db, func(tx *sql.Tx) error {
+				var err error
+				wh, err = scanWebhook(tx.QueryRow(
+					`INSERT INTO webhooks(created_by, url, secret, events, priorities, all_users, active)
+					 VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING `+webhookColumns,
+					username, in.URL, secret, pq.Array(in.Events), pq.Array(in.Priorities), in.AllUsers, active,
+				))
+				if err != nil {
+					return err
+				}
+				return appendAudit(tx, username, auditWebhookCreate, 0, webhookAuditDetails(wh))
+			})
+			if err != nil {
+				log.Println("insert webhook error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			// The secret is shown this once.
+			wh.Secret = secret
+			writeJSON(w, wh)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func webhookAuditDetails(wh Webhook) map[string]any {
+	return map[string]any{
+		"webhook_id": wh.ID, "url": wh.URL, "events": wh.Events, "priorities": wh.Priorities,
+		"all_users": wh.AllUsers, "active": wh.Active,
+	}
+}
+
+// loadOwnedWebhook fetches the webhook named by the {id} path value,
+// answering 404 unless the caller created it or is an admin.
+func loadOwnedWebhook(db *sql.DB, w http.ResponseWriter, r *http.Request) (wh Webhook, username string, ok bool) {
+	username, ok = getUsername(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return wh, "", false
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "invalid webhook id", http.StatusBadRequest)
+		return wh, "", false
+	}
+	wh, err = scanWebhook(db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id=$1`, id))
+	if err == nil && wh.CreatedBy != username && getRole(r.Context()) != roleAdmin {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return wh, "", false
+	}
+	if err != nil {
+		log.Println("select webhook error:", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return wh, "", false
+	}
+	return wh, username, true
+}
+
+// updateWebhookHandler serves PUT /api/webhooks/{id}. The secret stays.
+func updateWebhookHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wh, username, ok := loadOwnedWebhook(db, w, r)
+		if !ok {
+			return
+		}
+		var in webhookInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if err := in.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if in.AllUsers && getRole(r.Context()) != roleAdmin {
+			http.Error(w, "only admins can subscribe to all users' events", http.StatusForbidden)
+			return
+		}
+		active := wh.Active
+		if in.Active != nil {
+			active = *in.Active
+		}
+
+		err := withTx(db, func(tx *sql.Tx) error {
+			var err error
+			wh, err = scanWebhook(tx.QueryRow(
+				`UPDATE webhooks SET url=$1, events=$2, priorities=$3, all_users=$4, active=$5, updated_at=NOW()
+				 WHERE id=$6 RETURNING `+webhookColumns,
+				in.URL, pq.Array(in.Events), pq.Array(in.Priorities), in.AllUsers, active, wh.ID,
+			))
+			if err != nil {
+				return err
+			}
+			return appendAudit(tx, username, auditWebhookUpdate, 0, webhookAuditDetails(wh))
+		})
+		if err != nil {
+			log.Println("update webhook error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, wh)
+	})
+}
+
+// deleteWebhookHandler serves DELETE /api/webhooks/{id}. Its pending
+// deliveries go with it.
+func deleteWebhookHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wh, username, ok := loadOwnedWebhook(db, w, r)
+		if !ok {
+			return
+		}
+		err := withTx(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DELETE FROM webhooks WHERE id=$1`, wh.ID); err != nil {
+				return err
+			}
+			return appendAudit(tx, username, auditWebhookDelete, 0, webhookAuditDetails(wh))
+		})
+		if err != nil {
+			log.Println("delete webhook error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// webhookDeliveriesHandler serves GET /api/webhooks/{id}/deliveries, the
+// delivery log of a webhook, newest first, with every attempt made.
+// status narrows it to pending, sent or dead deliveries.
+func webhookDeliveriesHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wh, _, ok := loadOwnedWebhook(db, w, r)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		status := query.Get("status")
+		if status != "" && status != queuePending && status != queueSent && status != queueDead {
+			http.Error(w, "status must be pending, sent or dead", http.StatusBadRequest)
+			return
+		}
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if limit <= 0 || limit > appConfig.Limits.MaxPageSize {
+			limit = appConfig.Limits.MaxPageSize
+		}
+
+		rows, err := db.Query(
+			`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+			 WHERE webhook_id=$1 AND ($2 = '' OR status=$2) ORDER BY id DESC LIMIT $3`,
+			wh.ID, status, limit,
+		)
+		if err != nil {
+			log.Println("select webhook deliveries error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		deliveries := []WebhookDelivery{}
+		byID := map[int64]int{}
+		for rows.Next() {
+			d, err := scanWebhookDelivery(rows)
+			if err != nil {
+				log.Println("scan error:", err)
+				continue
+			}
+			d.Log = []WebhookAttempt{}
+			byID[d.ID] = len(deliveries)
+			deliveries = append(deliveries, d)
+		}
+		rows.Close()
+		if len(deliveries) == 0 {
+			writeJSON(w, deliveries)
+			return
+		}
+
+		ids := make([]int64, 0, len(deliveries))
+		for _, d := range deliveries {
+			ids = append(ids, d.ID)
+		}
+		rows, err = db.Query(
+			`SELECT delivery_id, attempted_at, status_code, error, duration_ms FROM webhook_attempts
+			 WHERE delivery_id = ANY($1) ORDER BY id`,
+			pq.Array(ids),
+		)
+		if err != nil {
+			log.Println("select webhook attempts error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			var a WebhookAttempt
+			if err := rows.Scan(&id, &a.At, &a.StatusCode, &a.Error, &a.DurationMS); err != nil {
+				log.Println("scan error:", err)
+				continue
+			}
+			d := &deliveries[byID[id]]
+			d.Log = append(d.Log, a)
+		}
+		writeJSON(w, deliveries)
+	})
+}
+
+// replayWebhookDeliveryHandler serves POST
+// /api/webhooks/{id}/deliveries/{did}/replay. The delivery is sent again
+// with its original payload and a fresh set of attempts.
+func replayWebhookDeliveryHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wh, username, ok := loadOwnedWebhook(db, w, r)
+		if !ok {
+			return
+		}
+		did, err := strconv.ParseInt(r.PathValue("did"), 10, 64)
+		if err != nil || did < 1 {
+			http.Error(w, "invalid delivery id", http.StatusBadRequest)
+			return
+		}
+
+		var d WebhookDelivery
+		err = withTx(db, func(tx *sql.Tx) error {
+			var err error
+			d, err = scanWebhookDelivery(tx.QueryRow(
+				`UPDATE webhook_deliveries SET status=$1, attempts=0, next_attempt_at=NOW(), updated_at=NOW()
+				 WHERE id=$2 AND webhook_id=$3 AND status <> $1
+				 RETURNING `+webhookDeliveryColumns,
+				queuePending, did, wh.ID,
+			))
+			if err != nil {
+				return err
+			}
+			return appendAudit(tx, username, auditWebhookReplay, 0, map[string]any{
+				"webhook_id": wh.ID, "delivery_id": d.ID, "event": d.Event,
+			})
+		})
+		if err == sql.ErrNoRows {
+			http.Error(w, "delivery not found or already pending", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("replay webhook delivery error:", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, d)
+	})
+}
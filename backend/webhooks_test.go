@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"mini-amhs/config"
+)
+
+var webhookColumnNames = []string{"id", "created_by", "url", "events", "priorities", "all_users", "active", "created_at", "updated_at"}
+
+var webhookDeliveryColumnNames = []string{"id", "webhook_id", "event", "username", "payload", "status", "attempts", "next_attempt_at", "last_error", "created_at", "delivered_at"}
+
+var webhookTestConfig = config.WebhookConfig{PollInterval: time.Second, Timeout: 5 * time.Second, MaxAttempts: 3, BackoffBase: time.Minute, BackoffMax: time.Hour}
+
+func TestWebhooksHandler_Create(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	post := func(role, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/api/webhooks", strings.NewReader(body))
+		req = req.WithContext(withIdentity(req.Context(), "alice", role))
+		rr := httptest.NewRecorder()
+		webhooksHandler(db).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post(roleUser, `{"url":"ftp://hooks.example/x","events":["message.created"]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "url must be an http or https URL\n", rr.Body.String())
+	assert.Equal(t, http.StatusBadRequest, post(roleUser, `{"url":"https://hooks.example/x","events":["message.sent"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(roleUser, `{"url":"https://hooks.example/x","events":["message.read"],"priorities":["XX"]}`).Code)
+	assert.Equal(t, http.StatusForbidden, post(roleUser, `{"url":"https://hooks.example/x","events":["message.read"],"all_users":true}`).Code)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO webhooks`).
+		WithArgs("alice", "https://hooks.example/x", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), false, true).
+		WillReturnRows(sqlmock.NewRows(webhookColumnNames).AddRow(1, "alice", "https://hooks.example/x", "{message.created,message.read}", "{FF}", false, true, now, now))
+	expectAudit(mock, auditWebhookCreate)
+	mock.ExpectCommit()
+	rr = post(roleUser, `{"url":" https://hooks.example/x ","events":["message.read","message.created","message.read"],"priorities":["ff"]}`)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var wh Webhook
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &wh))
+	assert.Equal(t, []string{eventMessageCreated, eventMessageRead}, wh.Events)
+	assert.Equal(t, []string{prioritySafety}, wh.Priorities)
+	assert.True(t, strings.HasPrefix(wh.Secret, "whsec_"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookDeliveriesHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	get := func(user, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.SetPathValue("id", "1")
+		req = req.WithContext(withIdentity(req.Context(), user, roleUser))
+		rr := httptest.NewRecorder()
+		webhookDeliveriesHandler(db).ServeHTTP(rr, req)
+		return rr
+	}
+	expectWebhook := func() {
+		mock.ExpectQuery(`SELECT .* FROM webhooks WHERE id=\$1`).
+			WithArgs(int64(1)).
+			WillReturnRows(sqlmock.NewRows(webhookColumnNames).AddRow(1, "alice", "https://hooks.example/x", "{message.created}", "{}", false, true, now, now))
+	}
+
+	// Someone else's webhook does not exist for bob.
+	expectWebhook()
+	assert.Equal(t, http.StatusNotFound, get("bob", "/api/webhooks/1/deliveries").Code)
+
+	expectWebhook()
+	assert.Equal(t, http.StatusBadRequest, get("alice", "/api/webhooks/1/deliveries?status=lost").Code)
+
+	expectWebhook()
+	mock.ExpectQuery(`SELECT .* FROM webhook_deliveries`).
+		WithArgs(int64(1), queueDead, appConfig.Limits.MaxPageSize).
+		WillReturnRows(sqlmock.NewRows(webhookDeliveryColumnNames).
+			AddRow(9, 1, eventMessageCreated, "alice", `{"event":"message.created"}`, queueDead, 2, now, "answered 500", now, nil))
+	mock.ExpectQuery(`SELECT delivery_id, attempted_at, status_code, error, duration_ms FROM webhook_attempts`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"delivery_id", "attempted_at", "status_code", "error", "duration_ms"}).
+			AddRow(9, now, 0, "connection refused", 3).
+			AddRow(9, now, 500, "answered 500", 12))
+	rr := get("alice", "/api/webhooks/1/deliveries?status=dead")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var got []WebhookDelivery
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.JSONEq(t, `{"event":"message.created"}`, string(got[0].Payload))
+	assert.Nil(t, got[0].NextAttemptAt)
+	require.Len(t, got[0].Log, 2)
+	assert.Equal(t, 500, got[0].Log[1].StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReplayWebhookDeliveryHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	replay := func(did string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/api/webhooks/1/deliveries/"+did+"/replay", nil)
+		req.SetPathValue("id", "1")
+		req.SetPathValue("did", did)
+		req = req.WithContext(withIdentity(req.Context(), "alice", roleUser))
+		rr := httptest.NewRecorder()
+		replayWebhookDeliveryHandler(db).ServeHTTP(rr, req)
+		return rr
+	}
+	expectWebhook := func() {
+		mock.ExpectQuery(`SELECT .* FROM webhooks WHERE id=\$1`).
+			WithArgs(int64(1)).
+			WillReturnRows(sqlmock.NewRows(webhookColumnNames).AddRow(1, "alice", "https://hooks.example/x", "{message.created}", "{}", false, true, now, now))
+	}
+
+	expectWebhook()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE webhook_deliveries SET status=\$1, attempts=0`).
+		WithArgs(queuePending, int64(8), int64(1)).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	assert.Equal(t, http.StatusNotFound, replay("8").Code)
+
+	expectWebhook()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE webhook_deliveries SET status=\$1, attempts=0`).
+		WithArgs(queuePending, int64(9), int64(1)).
+		WillReturnRows(sqlmock.NewRows(webhookDeliveryColumnNames).
+			AddRow(9, 1, eventMessageCreated, "alice", `{}`, queuePending, 0, now, "answered 500", now, nil))
+	expectAudit(mock, auditWebhookReplay)
+	mock.ExpectCommit()
+	rr := replay("9")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"status": "pending"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookDispatcher_Enqueue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	d := newWebhookDispatcher(db, webhookTestConfig)
+	hub := newEventHub()
+	hub.observe(d.observe)
+
+	msg := Message{ID: 5, Sender: "alice", Receiver: "bob", Subject: "METAR", Priority: prioritySafety}
+	hub.publish("alice", Event{Type: eventMessageRead, Data: msg})
+	pe := <-d.pending
+	assert.Equal(t, "alice", pe.username)
+
+	mock.ExpectExec(`INSERT INTO webhook_deliveries\(webhook_id, event, username, payload\)`).
+		WithArgs(eventMessageRead, "alice", sqlmock.AnyArg(), prioritySafety).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	require.NoError(t, d.enqueue(pe))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookDispatcher_Deliver(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	var verified []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := signRelayBody("whsec_test", r.Header.Get(webhookTimestampHeader), body)
+		if r.Header.Get(webhookSignatureHeader) != want {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		verified = append(verified, r.Header.Get(webhookDeliveryHeader)+" "+r.Header.Get(webhookEventHeader))
+		if r.URL.Path == "/broken" {
+			http.Error(w, "oops", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	d := newWebhookDispatcher(db, webhookTestConfig)
+	// The test server is on loopback, which deliveries refuse.
+	d.client = srv.Client()
+
+	mock.ExpectQuery(`UPDATE webhook_deliveries d SET attempts=d.attempts\+1`).
+		WithArgs(sqlmock.AnyArg(), queuePending, webhookBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event", "payload", "attempts", "url", "secret"}).
+			AddRow(1, eventMessageCreated, `{"event":"message.created"}`, 1, srv.URL+"/ok", "whsec_test").
+			AddRow(2, eventMessageRead, `{"event":"message.read"}`, 1, srv.URL+"/broken", "whsec_test").
+			AddRow(3, eventMessageRead, `{"event":"message.read"}`, 3, srv.URL+"/broken", "whsec_test"))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO webhook_attempts`).
+		WithArgs(int64(1), 200, "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE webhook_deliveries SET status=\$1`).
+		WithArgs(queueSent, nil, "", int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// Failed, retried later.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO webhook_attempts`).
+		WithArgs(int64(2), 500, "answered 500", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec(`UPDATE webhook_deliveries SET status=\$1`).
+		WithArgs(queuePending, sqlmock.AnyArg(), "answered 500", int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// Failed on the last attempt.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO webhook_attempts`).
+		WithArgs(int64(3), 500, "answered 500", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec(`UPDATE webhook_deliveries SET status=\$1`).
+		WithArgs(queueDead, sqlmock.AnyArg(), "answered 500", int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, d.deliverDue(context.Background()))
+	assert.Equal(t, []string{"1 message.created", "2 message.read", "3 message.read"}, verified)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookClient(t *testing.T) {
+	reached := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hook" {
+			http.Redirect(w, r, "/internal", http.StatusFound)
+			return
+		}
+		reached = true
+	}))
+	defer srv.Close()
+
+	// Internal addresses are refused once the name is resolved.
+	client := newWebhookClient(time.Second)
+	_, err := client.Post(srv.URL+"/hook", "application/json", strings.NewReader(`{}`))
+	assert.ErrorContains(t, err, "webhook address 127.0.0.1 is not public")
+	for addr, public := range map[string]bool{
+		"93.184.216.34:443":  true,
+		"[2606:2800::1]:443": true,
+		"10.1.2.3:443":       false,
+		"192.168.0.10:80":    false,
+		"169.254.169.254:80": false,
+		"[::1]:443":          false,
+		"[fe80::1]:443":      false,
+		"0.0.0.0:80":         false,
+	} {
+		assert.Equal(t, public, refuseInternalAddress("tcp", addr, nil) == nil, addr)
+	}
+
+	// Redirects are not followed.
+	client.Transport = srv.Client().Transport
+	resp, err := client.Post(srv.URL+"/hook", "application/json", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.False(t, reached)
+}
@@ -6,6 +6,7 @@ CREATE TABLE IF NOT EXISTS users (
   id SERIAL PRIMARY KEY,
   username TEXT NOT NULL UNIQUE,
   password_hash TEXT NOT NULL,
+  role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'supervisor', 'admin')),
   created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
@@ -17,10 +18,26 @@ CREATE TABLE IF NOT EXISTS messages (
   receiver TEXT NOT NULL,
   subject TEXT NOT NULL,
   body TEXT NOT NULL,
+  priority TEXT NOT NULL DEFAULT 'GG' CHECK (priority IN ('SS', 'DD', 'FF', 'GG', 'KK')),
   is_read BOOLEAN NOT NULL DEFAULT FALSE,
   receiver_archived BOOLEAN NOT NULL DEFAULT FALSE,
   sender_archived BOOLEAN NOT NULL DEFAULT FALSE,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+  receiver_deleted_at TIMESTAMPTZ,
+  sender_deleted_at TIMESTAMPTZ,
+  in_reply_to INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+  thread_id INTEGER,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  deliver_at TIMESTAMPTZ,
+  delivered_at TIMESTAMPTZ DEFAULT NOW(),
+  expires_at TIMESTAMPTZ,
+  ndn_sent_at TIMESTAMPTZ,
+  originator TEXT NOT NULL DEFAULT '',
+  filing_time TEXT NOT NULL DEFAULT '',
+  channel_seq TEXT NOT NULL DEFAULT '',
+  possible_duplicate BOOLEAN NOT NULL DEFAULT FALSE,
+  duplicate_of INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+  route TEXT NOT NULL DEFAULT '',
+  next_hop TEXT NOT NULL DEFAULT ''
 );
 
 CREATE INDEX IF NOT EXISTS idx_messages_receiver_created_at
@@ -45,3 +62,359 @@ END $$;
 
 
 ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_read BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Threading: replies and forwards point at the message they answer and
+-- share the thread id of the conversation root (NULL on the root itself).
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS in_reply_to INTEGER REFERENCES messages(id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_id INTEGER;
+CREATE INDEX IF NOT EXISTS idx_messages_thread ON messages((COALESCE(thread_id, id)));
+
+-- Soft delete: each party trashes only their own copy. The purge job
+-- removes a row once both sides are deleted and the retention has passed.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS receiver_deleted_at TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS sender_deleted_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_messages_purge
+  ON messages(GREATEST(receiver_deleted_at, sender_deleted_at))
+  WHERE receiver_deleted_at IS NOT NULL AND sender_deleted_at IS NOT NULL;
+
+-- Roles and AFTN priorities. Promote supervisors by hand, e.g.
+--   UPDATE users SET role='supervisor' WHERE username='ops-sup';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'
+  CHECK (role IN ('user', 'supervisor', 'admin'));
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'GG'
+  CHECK (priority IN ('SS', 'DD', 'FF', 'GG', 'KK'));
+
+-- Deferred delivery: delivered_at stays NULL, hiding the message from its
+-- receiver, until the scheduler releases it at deliver_at.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deliver_at TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMPTZ DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS idx_messages_pending
+  ON messages(deliver_at) WHERE delivered_at IS NULL;
+
+-- Latest delivery time: unread messages past expires_at are hidden from
+-- the inbox and reported to the sender once (ndn_sent_at).
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS ndn_sent_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_messages_expiring
+  ON messages(expires_at) WHERE ndn_sent_at IS NULL AND NOT is_read;
+
+-- Transmission identifier of gateway traffic, for spotting redelivered
+-- telegrams. possible_duplicate outlives the original's purge.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS originator TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS filing_time TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS channel_seq TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS possible_duplicate BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS duplicate_of INTEGER REFERENCES messages(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_messages_transmission
+  ON messages(originator, filing_time, channel_seq, created_at) WHERE originator <> '';
+
+-- The route a message took: the matched pattern and the neighbouring MTA
+-- it is relayed to, or '' for local delivery.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS route TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS next_hop TEXT NOT NULL DEFAULT '';
+
+-- Legal holds keep messages sent in [starts_at, ends_at) from being purged.
+CREATE TABLE IF NOT EXISTS legal_holds (
+  id SERIAL PRIMARY KEY,
+  reason TEXT NOT NULL,
+  mailbox TEXT,
+  starts_at TIMESTAMPTZ NOT NULL,
+  ends_at TIMESTAMPTZ NOT NULL,
+  placed_by TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  released_by TEXT,
+  released_at TIMESTAMPTZ,
+  CHECK (ends_at > starts_at)
+);
+
+-- Body parts of a message. The contents live in the attachment store under
+-- storage_key; rows go with their message when it is purged.
+CREATE TABLE IF NOT EXISTS attachments (
+  id SERIAL PRIMARY KEY,
+  message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  filename TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  size BIGINT NOT NULL,
+  sha256 TEXT NOT NULL,
+  storage_key TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id);
+
+-- Unsent messages. Fields may be empty until the draft is sent; version
+-- is bumped on every save for optimistic concurrency.
+CREATE TABLE IF NOT EXISTS drafts (
+  id SERIAL PRIMARY KEY,
+  owner TEXT NOT NULL,
+  receiver TEXT NOT NULL DEFAULT '',
+  subject TEXT NOT NULL DEFAULT '',
+  body TEXT NOT NULL DEFAULT '',
+  priority TEXT NOT NULL DEFAULT '',
+  version INTEGER NOT NULL DEFAULT 1,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_drafts_owner ON drafts(owner, updated_at);
+
+-- Distribution lists. owner is NULL for global lists, which admins manage;
+-- names are unique per owner, case-insensitively.
+CREATE TABLE IF NOT EXISTS distribution_lists (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  owner TEXT,
+  description TEXT NOT NULL DEFAULT '',
+  members TEXT[] NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_distribution_lists_name
+  ON distribution_lists(COALESCE(owner, ''), lower(name));
+
+-- What a list resolved to when a message was sent to it. Rows keep the
+-- list's name and members after the list is changed or deleted.
+CREATE TABLE IF NOT EXISTS list_expansions (
+  id SERIAL PRIMARY KEY,
+  list_id INTEGER REFERENCES distribution_lists(id) ON DELETE SET NULL,
+  list_name TEXT NOT NULL,
+  sender TEXT NOT NULL,
+  recipients TEXT[] NOT NULL,
+  message_ids INTEGER[] NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_list_expansions_messages ON list_expansions USING GIN (message_ids);
+
+-- Address book: each entry maps a station to the username that receives
+-- its traffic. aftn_address is unique when set.
+CREATE TABLE IF NOT EXISTS directory_entries (
+  id SERIAL PRIMARY KEY,
+  username TEXT NOT NULL UNIQUE,
+  aftn_address TEXT NOT NULL DEFAULT '',
+  organisation TEXT NOT NULL DEFAULT '',
+  location_indicator TEXT NOT NULL DEFAULT '',
+  display_name TEXT NOT NULL DEFAULT '',
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_directory_entries_aftn
+  ON directory_entries(aftn_address) WHERE aftn_address <> '';
+CREATE INDEX IF NOT EXISTS idx_directory_entries_location ON directory_entries(location_indicator);
+
+-- Routing table. pattern is a prefix of AFTN addresses, or '*' for the
+-- default route; the longest matching prefix wins. An empty next_hop
+-- means local delivery.
+CREATE TABLE IF NOT EXISTS routes (
+  id SERIAL PRIMARY KEY,
+  pattern TEXT NOT NULL UNIQUE,
+  next_hop TEXT NOT NULL DEFAULT '',
+  description TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Messages waiting to be relayed to their next hop. Items move from
+-- pending to sending (locked until locked_until) to sent, or to dead once
+-- their attempts are used up or the peer refuses them. trace holds the
+-- servers a message received from a peer came through.
+CREATE TABLE IF NOT EXISTS outbound_queue (
+  id SERIAL PRIMARY KEY,
+  message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  next_hop TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sending', 'sent', 'dead')),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_error TEXT NOT NULL DEFAULT '',
+  locked_until TIMESTAMPTZ,
+  trace JSONB NOT NULL DEFAULT '[]',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  sent_at TIMESTAMPTZ
+);
+
+ALTER TABLE outbound_queue ADD COLUMN IF NOT EXISTS trace JSONB NOT NULL DEFAULT '[]';
+
+CREATE INDEX IF NOT EXISTS idx_outbound_queue_due
+  ON outbound_queue(next_hop, next_attempt_at) WHERE status IN ('pending', 'sending');
+CREATE INDEX IF NOT EXISTS idx_outbound_queue_message ON outbound_queue(message_id);
+
+-- Messages received from peer servers by their relay id, so that a batch
+-- the peer sends again is not stored twice. Ids are only unique per peer.
+CREATE TABLE IF NOT EXISTS relay_inbound (
+  peer TEXT NOT NULL,
+  relay_id TEXT NOT NULL,
+  message_id INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+  received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (peer, relay_id)
+);
+
+-- External email address a user's messages are forwarded to, from
+-- forward_since on; NULL forward_since means forwarding is off.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS forward_email TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS forward_since TIMESTAMPTZ;
+
+-- Messages to forward by email, one per message. Items stay pending
+-- (leased by next_attempt_at while being sent) until sent, or dead once
+-- their attempts are used up or the mail server refuses them.
+CREATE TABLE IF NOT EXISTS email_forwards (
+  id SERIAL PRIMARY KEY,
+  message_id INTEGER NOT NULL UNIQUE REFERENCES messages(id) ON DELETE CASCADE,
+  address TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'dead')),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_forwards_due ON email_forwards(next_attempt_at) WHERE status = 'pending';
+
+-- Service accounts are users with no password that authenticate with API
+-- keys. Keys are stored as SHA-256 hashes; prefix identifies them.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS service BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS api_keys (
+  id SERIAL PRIMARY KEY,
+  username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  prefix TEXT NOT NULL,
+  key_hash TEXT NOT NULL UNIQUE,
+  scopes TEXT[] NOT NULL,
+  created_by TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ,
+  last_used_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_username ON api_keys(username);
+
+-- Users who sign in through OpenID Connect are linked to the provider's
+-- subject; they have no password.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject TEXT UNIQUE;
+
+-- Single sign-on logins in progress, by state, until the provider sends
+-- the browser back.
+CREATE TABLE IF NOT EXISTS oidc_logins (
+  state TEXT PRIMARY KEY,
+  nonce TEXT NOT NULL,
+  code_verifier TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Outgoing webhooks. A webhook receives the listed events of its creator,
+-- or of every user when all_users is set (admins only); an empty
+-- priorities list matches messages of any priority.
+CREATE TABLE IF NOT EXISTS webhooks (
+  id SERIAL PRIMARY KEY,
+  created_by TEXT NOT NULL,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  events TEXT[] NOT NULL,
+  priorities TEXT[] NOT NULL DEFAULT '{}',
+  all_users BOOLEAN NOT NULL DEFAULT FALSE,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_created_by ON webhooks(created_by);
+
+-- One row per event to post to a webhook, kept as a delivery log. Like
+-- email_forwards, rows stay pending until sent or dead.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id BIGSERIAL PRIMARY KEY,
+  webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+  event TEXT NOT NULL,
+  username TEXT NOT NULL,
+  payload TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'dead')),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  delivered_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+
+-- Every attempt at a webhook delivery; status_code is 0 when no response came.
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+  id BIGSERIAL PRIMARY KEY,
+  delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+  attempted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  status_code INTEGER NOT NULL,
+  error TEXT NOT NULL DEFAULT '',
+  duration_ms INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery ON webhook_attempts(delivery_id, attempted_at);
+
+-- Idempotency-Key values per user with the response of the submission
+-- that first used them. Old keys are pruned by the purge job.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  username TEXT NOT NULL,
+  key TEXT NOT NULL,
+  request_hash TEXT NOT NULL,
+  message_id INTEGER,
+  response BYTEA,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (username, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
+
+-- One row per purge run that found deleted messages.
+CREATE TABLE IF NOT EXISTS retention_reports (
+  id SERIAL PRIMARY KEY,
+  ran_at TIMESTAMPTZ NOT NULL,
+  purged_count INTEGER NOT NULL,
+  held_count INTEGER NOT NULL,
+  retained_count INTEGER NOT NULL,
+  purged JSONB NOT NULL
+);
+
+-- Append-only, hash-chained audit log. message_id is deliberately not a
+-- foreign key: entries outlive purged messages. details holds the exact
+-- JSON text that was hashed.
+CREATE TABLE IF NOT EXISTS audit_log (
+  id BIGSERIAL PRIMARY KEY,
+  occurred_at TIMESTAMPTZ NOT NULL,
+  actor TEXT NOT NULL,
+  action TEXT NOT NULL,
+  message_id INTEGER,
+  details TEXT NOT NULL,
+  prev_hash TEXT NOT NULL,
+  hash TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor, occurred_at);
+CREATE INDEX IF NOT EXISTS idx_audit_log_message ON audit_log(message_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_occurred_at ON audit_log(occurred_at);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_log is append-only';
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+  FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+-- Key pairs for RS256 and EdDSA auth tokens. A key signs from active_from
+-- until retired_at and is kept until the tokens it signed have expired.
+CREATE TABLE IF NOT EXISTS jwt_keys (
+  kid TEXT PRIMARY KEY,
+  alg TEXT NOT NULL,
+  private_key TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  active_from TIMESTAMPTZ NOT NULL,
+  retired_at TIMESTAMPTZ
+);